@@ -0,0 +1,125 @@
+/*
+  access.go
+
+  Routes for choosing who can see a user's pages. Rules can be set for
+  single pages, or for folders of pages. Users get a link which signs
+  them in to their own site, so that they can see their private pages.
+  They're part of the edit handler.
+*/
+
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/colin353/markdown.ninja/requesthandler"
+)
+
+// Return the user's access rules. Pages which aren't covered by any of
+// them are public.
+func accessRules(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	rules, err := models.LoadAccessRules(u.Domain)
+	if err != nil {
+		log.Printf("Tried to load access rules for `%s`, but it failed.", u.Domain)
+		return requesthandler.Unavailable(w)
+	}
+
+	ruleList := make([]map[string]interface{}, 0, len(rules))
+	for _, rule := range rules {
+		ruleList = append(ruleList, rule.Export())
+	}
+	return ruleList
+}
+
+// Return the path which signs the user in to their site, relative to its
+// root. The link only works for a while, so it's fetched each time the
+// user opens their site.
+func ownerLink(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	return map[string]interface{}{"path": requesthandler.OwnerPath(u)}
+}
+
+// Set the visibility of a page, or of a folder if the path ends with a
+// slash. Password protected pages need a password, unless they already
+// have one which should be kept.
+func setAccess(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type accessArgs struct {
+		Path       string `json:"path"`
+		Visibility string `json:"visibility"`
+		Password   string `json:"password"`
+	}
+	args := accessArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	rule := models.AccessRule{}
+	rule.Domain = u.Domain
+	rule.Path = args.Path
+	err = models.Load(&rule)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	exists := err == nil
+
+	rule.Visibility = args.Visibility
+	if args.Visibility != models.VisibilityPassword {
+		rule.PasswordHash, rule.PasswordSalt = "", ""
+	} else if args.Password != "" {
+		rule.SetPassword(args.Password)
+	}
+	if exists {
+		err = models.Save(&rule)
+	} else {
+		err = models.Insert(&rule)
+	}
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	return requesthandler.ResponseOK
+}
+
+// Remove the access rule for a page or folder, so that it goes back to
+// the visibility of the folder it's in.
+func deleteAccess(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type deleteArgs struct {
+		Path string `json:"path"`
+	}
+	args := deleteArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	rule := models.AccessRule{}
+	rule.Domain = u.Domain
+	rule.Path = args.Path
+	err = models.Load(&rule)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		http.Error(w, "", http.StatusNotFound)
+		return requesthandler.ResponseError
+	}
+
+	err = models.Delete(&rule)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		log.Printf("Failed to delete access rule `%s`: %v", rule.Key(), err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return requesthandler.ResponseError
+	}
+	return requesthandler.ResponseOK
+}
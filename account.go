@@ -39,7 +39,10 @@ func updateEmail(u *models.User, w http.ResponseWriter, r *http.Request) interfa
 	}
 
 	u.Email = args.Email
-	err = models.Save(u)
+	err = models.SaveFields(u, "email")
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
 	if err != nil {
 		http.Error(w, "", http.StatusBadRequest)
 		return requesthandler.ResponseError
@@ -60,7 +63,10 @@ func updatePassword(u *models.User, w http.ResponseWriter, r *http.Request) inte
 	}
 
 	u.SetPassword(args.Password)
-	err = models.Save(u)
+	err = models.SaveFields(u, "password_hash")
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
 	if err != nil {
 		http.Error(w, "", http.StatusBadRequest)
 		return requesthandler.ResponseError
@@ -87,20 +93,34 @@ func updateCustomDomain(u *models.User, w http.ResponseWriter, r *http.Request)
 		d := models.Domain{}
 		d.ExternalDomain = u.ExternalDomain
 
-		// We won't check for errors here, because if their
-		// domain was not registered for some reason, that's
+		// We won't check for a missing record here, because if
+		// their domain was not registered for some reason, that's
 		// fine.
-		models.Load(&d)
+		err = models.Load(&d)
+		if models.IsStorageError(err) {
+			return requesthandler.Unavailable(w)
+		}
 
 		// Need to check that the user actually owns
 		// the domain in question.
 		if d.InternalDomain == u.Domain {
-			models.Delete(&d)
+			err = models.Delete(&d)
+			if models.IsStorageError(err) {
+				return requesthandler.Unavailable(w)
+			}
+			if err != nil {
+				log.Printf("Failed to delete domain `%s`: %v", d.Key(), err)
+				http.Error(w, "", http.StatusInternalServerError)
+				return requesthandler.ResponseError
+			}
 		}
 
 		// Temporarily blank their external domain.
 		u.ExternalDomain = ""
-		err = models.Save(u)
+		err = models.SaveFields(u, "external_domain")
+		if models.IsStorageError(err) {
+			return requesthandler.Unavailable(w)
+		}
 		if err != nil {
 			http.Error(w, "", http.StatusInternalServerError)
 			return requesthandler.ResponseError
@@ -111,17 +131,23 @@ func updateCustomDomain(u *models.User, w http.ResponseWriter, r *http.Request)
 	domain.InternalDomain = u.Domain
 	domain.ExternalDomain = args.Domain
 	err = models.Insert(&domain)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
 	if err != nil {
 		http.Error(w, "", http.StatusBadRequest)
 		return requesthandler.ResponseDuplicate
 	}
 
 	u.ExternalDomain = args.Domain
-	err = models.Save(u)
+	err = models.SaveFields(u, "external_domain")
 	if err != nil {
 		// Clean up by deleting the domain we created.
 		models.Delete(&domain)
 
+		if models.IsStorageError(err) {
+			return requesthandler.Unavailable(w)
+		}
 		http.Error(w, "", http.StatusBadRequest)
 		return requesthandler.ResponseInvalidArgs
 	}
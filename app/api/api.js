@@ -20,6 +20,12 @@ if(window.hasOwnProperty("jasmine")) {
 // for no de.js in case we are running this file as a test.
 var fetch = require('isomorphic-fetch');
 
+function flattenPageTree(folder: PageFolder): Page[] {
+  return folder.folders.reduce((pages, f) => {
+    return pages.concat(flattenPageTree(f));
+  }, folder.pages);
+}
+
 class API {
   BASE_URL: string;
   BASE_DOMAIN: string;
@@ -180,8 +186,18 @@ class API {
     return this.request("/api/edit/page", {name: name})
   }
 
+  // The server returns the pages as a tree of folders, but the editor
+  // shows them as a flat list of paths.
   pages() : Promise<Page[]> {
-    return this.request("/api/edit/pages");
+    return this.request("/api/edit/pages").then(flattenPageTree);
+  }
+
+  renameFolder(oldPath: string, newPath: string) {
+    return this.request("/api/edit/rename_folder", {old_path: oldPath, new_path: newPath});
+  }
+
+  deleteFolder(path: string) {
+    return this.request("/api/edit/delete_folder", {path});
   }
 
   createPage(params: { html: string, markdown: string }): Promise<Page> {
@@ -192,6 +208,12 @@ class API {
     return this.request("/api/edit/edit_page", params);
   }
 
+  // Publishes the current draft of the page. If publishAt is given, the
+  // page is published automatically at that time instead.
+  publishPage(name: string, publishAt?: string) {
+    return this.request("/api/edit/publish", {name, publish_at: publishAt});
+  }
+
   renamePage(oldName: string, newName: string) {
     return this.request("/api/edit/rename_page", {old_name: oldName, new_name: newName});
   }
@@ -200,6 +222,16 @@ class API {
     return this.request("/api/files/rename", {old_name: oldName, new_name: newName});
   }
 
+  // Renaming a page or file rewrites the links to it in the other pages.
+  // The previews list those changes without renaming anything.
+  previewRenamePage(oldName: string, newName: string): Promise<Array<{page: string, old: string, new: string}>> {
+    return this.request("/api/edit/preview_rename", {old_name: oldName, new_name: newName});
+  }
+
+  previewRenameFile(oldName: string, newName: string): Promise<Array<{page: string, old: string, new: string}>> {
+    return this.request("/api/files/preview_rename", {old_name: oldName, new_name: newName});
+  }
+
   deletePage(page: Page) {
     return this.request("/api/edit/delete_page", page);
   }
@@ -222,6 +254,122 @@ class API {
     });
   }
 
+  // Searches the drafts of the user's pages. The snippets are HTML, with
+  // the matching words wrapped in <mark>.
+  search(query: string): Promise<Array<{name: string, title: string, path: string, score: number, snippet: string}>> {
+    return this.request("/api/edit/search", {query});
+  }
+
+  // The names of the pages which link to the page.
+  backlinks(name: string): Promise<Array<string>> {
+    return this.request("/api/edit/backlinks", {name});
+  }
+
+  // Links to pages or files which don't exist.
+  brokenLinks(): Promise<Array<{page: string, link: string}>> {
+    return this.request("/api/edit/broken_links");
+  }
+
+  // Lets visitors search the published site at /search.
+  setPublicSearch(enabled: boolean) {
+    return this.request("/api/edit/set_public_search", {enabled});
+  }
+
+  // Pages are public unless a rule says otherwise. A rule for a path
+  // ending in a slash applies to the whole folder. Password protected
+  // rules keep their password if none is given.
+  accessRules(): Promise<Array<{path: string, visibility: "public" | "unlisted" | "password" | "private"}>> {
+    return this.request("/api/edit/access");
+  }
+
+  setAccess(path: string, visibility: "public" | "unlisted" | "password" | "private", password?: string) {
+    return this.request("/api/edit/set_access", {path, visibility, password});
+  }
+
+  deleteAccess(path: string) {
+    return this.request("/api/edit/delete_access", {path});
+  }
+
+  // Opens the user's site in a new tab. The link signs them in to the
+  // site, so that they can see their own private pages. The tab is
+  // opened straight away, or the browser would block it.
+  openSite() {
+    var site = window.open("", "_blank");
+    var root = window.location.protocol + "//" + this.user.domain + "." + this.BASE_DOMAIN;
+    return this.request("/api/edit/owner_link").then((r) => {
+      site.location = root + r.path;
+    }).catch(() => {
+      site.location = root;
+    });
+  }
+
+  // Preview links let someone who isn't logged in see the drafts of a
+  // page, or of the whole site if no name is given, until they expire.
+  // The path is relative to the root of the site.
+  previews(): Promise<Array<{token: string, page: string, created_at: string, expires_at: string, path: string}>> {
+    return this.request("/api/edit/previews");
+  }
+
+  createPreview(name: string, hours?: number): Promise<{token: string, page: string, created_at: string, expires_at: string, path: string}> {
+    return this.request("/api/edit/create_preview", {name, hours});
+  }
+
+  revokePreview(token: string) {
+    return this.request("/api/edit/revoke_preview", {token});
+  }
+
+  // The rules file redirects, rewrites and adds headers to the site's
+  // URLs. If it can't be parsed, the message says which line is wrong.
+  getRules(): Promise<string> {
+    return this.request("/api/edit/rules").then((r) => {
+      return r.text;
+    });
+  }
+
+  setRules(text: string) {
+    return this.request("/api/edit/set_rules", {text});
+  }
+
+  // The page shown when visitors ask for something that doesn't exist.
+  // An empty name means 404.md.
+  setNotFoundPage(name: string) {
+    return this.request("/api/edit/set_not_found", {name});
+  }
+
+  // An empty robots.txt means the site uses the default one.
+  setRobots(robots: string) {
+    return this.request("/api/edit/set_robots", {robots});
+  }
+
+  getRobots(): Promise<string> {
+    return this.request("/api/edit/get_robots").then((r) => {
+      return r.robots;
+    });
+  }
+
+  // The navigation menu lists the site's published pages. Pages named in
+  // order come first, and hidden pages are left out.
+  getNavigation(): Promise<{enabled: boolean, order: Array<string>, hidden: Array<string>}> {
+    return this.request("/api/edit/navigation");
+  }
+
+  setNavigation(enabled: boolean, order: Array<string>, hidden: Array<string>) {
+    return this.request("/api/edit/set_navigation", {enabled, order, hidden});
+  }
+
+  // Custom layouts are html templates which wrap the user's pages.
+  layouts(): Promise<Array<{name: string, template: string}>> {
+    return this.request("/api/edit/layouts");
+  }
+
+  saveLayout(name: string, template: string) {
+    return this.request("/api/edit/save_layout", {name, template});
+  }
+
+  deleteLayout(name: string) {
+    return this.request("/api/edit/delete_layout", {name});
+  }
+
   uploadFile(name: string, file: any, onProgress: (progress: number, e: Event) => void) {
     var data = new FormData();
     data.append('file', file);
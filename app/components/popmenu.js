@@ -56,7 +56,7 @@ class PopMenu extends React.Component {
   // When the user clicks on their domain, we'll open it for them
   // in a new tab.
   clickDomain() {
-    window.open(window.location.protocol + "//" + this.state.domain + "." + this.props.api.BASE_DOMAIN, '_blank');
+    this.props.api.openSite();
   }
 
   render() {
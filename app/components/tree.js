@@ -84,7 +84,7 @@ class Tree extends React.Component {
 
   // Open your subdomain in a new tab.
   clickDomain() {
-    window.open(window.location.protocol + "//" + this.state.domain + "." + this.props.api.BASE_DOMAIN, '_blank');
+    this.props.api.openSite();
   }
 
   render() {
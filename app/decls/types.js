@@ -11,6 +11,13 @@ declare type Page = {
   html?: string
 }
 
+declare type PageFolder = {
+  name: string,
+  path: string,
+  pages: Page[],
+  folders: PageFolder[]
+}
+
 declare type File = {
   name: string
 }
@@ -224,6 +224,11 @@ class Edit extends React.Component {
         showDeletePagePopover: true,
         contextPage: data.page
       });
+    } else if(button == "publish" && data.page) {
+      // Saving only changes the draft, so make sure any changes are
+      // saved before publishing.
+      var name = data.page.name;
+      this.save().then(() => this.props.api.publishPage(name));
     }
   }
 
@@ -387,6 +392,9 @@ class Edit extends React.Component {
           <MenuItem key="delete" onClick={this.handleClick.bind(this, "delete")}>
             Delete
           </MenuItem>
+          <MenuItem key="publish" onClick={this.handleClick.bind(this, "publish")}>
+            Publish
+          </MenuItem>
           <MenuItem divider />
           <MenuItem key="newfile" onClick={this.handleClick.bind(this, "newfile")}>
             New file
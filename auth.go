@@ -29,7 +29,10 @@ func NewAuthenticationHandler() *requesthandler.GenericRequestHandler {
 // upon the authentication state, but ultimately it is up to the server, not the client
 // to decide who is authenticated.
 func check(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
-	authenticated, user := requesthandler.CheckAuthentication(w, r)
+	authenticated, user, err := requesthandler.CheckAuthentication(w, r)
+	if err != nil {
+		return requesthandler.Unavailable(w)
+	}
 
 	if authenticated {
 		return map[string]interface{}{
@@ -58,6 +61,9 @@ func login(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
 	me := models.User{}
 	me.Domain = args.Domain
 	err = models.Load(&me)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
 	if err != nil {
 		// The user doesn't exist in the database.
 		log.Printf("User @ domain `%v` doesn't exist.\n", args.Domain)
@@ -116,6 +122,9 @@ func checkDomain(u *models.User, w http.ResponseWriter, r *http.Request) interfa
 	user := models.User{}
 	user.Domain = args.Domain
 	err = models.Load(&user)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
 	if err != nil {
 		return requesthandler.SimpleResponse{
 			Result: "domain-available",
@@ -166,6 +175,9 @@ func signup(u *models.User, w http.ResponseWriter, r *http.Request) interface{}
 
 	me.SetPassword(args.Password)
 	err = models.Insert(me)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
 	if err != nil {
 		log.Printf("Failed to validate: %v", err.Error())
 		return requesthandler.SimpleResponse{Result: "failed-validation", Error: true}
@@ -181,10 +193,15 @@ func signup(u *models.User, w http.ResponseWriter, r *http.Request) interface{}
 		p.Name = filepath.Base(file)
 
 		markdown, _ := ioutil.ReadFile(file)
-		html, _ := ioutil.ReadFile(file + ".html")
 		p.Markdown = string(markdown)
-		p.HTML = string(html)
-		models.Insert(&p)
+		p.EditedBy = me.Name
+		err = models.Insert(&p)
+		if err == nil {
+			err = p.Publish()
+		}
+		if err != nil {
+			log.Printf("Unable to create default file `%s`: %v", p.Key(), err)
+		}
 	}
 
 	// I guess we created the user OK, so let's log them in also.
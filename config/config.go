@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/imdario/mergo"
@@ -25,9 +26,13 @@ type Config struct {
 	Mode          string
 	Port          string
 	RedisURL      string
+	Database      string
+	DatabaseFile  string
 	DataDirectory string
 	Hostnames     []string
 	CookieSecret  string
+	RevisionLimit int
+	IframeHosts   []string
 }
 
 // LoadConfig generates the configuration using three rules:
@@ -79,6 +84,13 @@ func LoadConfig(directory string) *Config {
 		switch typ {
 		case reflect.String:
 			v.SetString(env)
+		case reflect.Int:
+			value, err := strconv.Atoi(env)
+			if err != nil {
+				log.Printf("Ignoring invalid integer for %s: `%s`", t.Name, env)
+				continue
+			}
+			v.SetInt(int64(value))
 		// Only an array/slice of strings is permitted right now.
 		case reflect.Slice:
 			array := strings.Split(env, ",")
@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/colin353/markdown.ninja/models"
 	"github.com/colin353/markdown.ninja/requesthandler"
@@ -13,23 +14,52 @@ import (
 func NewEditHandler() *requesthandler.GenericRequestHandler {
 	a := requesthandler.GenericRequestHandler{}
 	a.RouteMap = map[string]requesthandler.Responder{
-		"page":        page,
-		"pages":       pages,
-		"create_page": createPage,
-		"edit_page":   editPage,
-		"rename_page": renamePage,
-		"delete_page": deletePage,
-		"set_style":   setStyle,
-		"get_style":   getStyle,
+		"page":              page,
+		"pages":             pages,
+		"create_page":       createPage,
+		"edit_page":         editPage,
+		"rename_page":       renamePage,
+		"preview_rename":    previewRenamePage,
+		"publish":           publishPage,
+		"delete_page":       deletePage,
+		"rename_folder":     renameFolder,
+		"delete_folder":     deleteFolder,
+		"page_revisions":    pageRevisions,
+		"diff_revisions":    diffRevisions,
+		"restore_revision":  restoreRevision,
+		"layouts":           layouts,
+		"save_layout":       saveLayout,
+		"delete_layout":     deleteLayout,
+		"set_style":         setStyle,
+		"get_style":         getStyle,
+		"set_robots":        setRobots,
+		"get_robots":        getRobots,
+		"search":            search,
+		"set_public_search": setPublicSearch,
+		"set_not_found":     setNotFoundPage,
+		"navigation":        getNavigation,
+		"set_navigation":    setNavigation,
+		"backlinks":         backlinks,
+		"broken_links":      brokenLinks,
+		"rules":             getRules,
+		"set_rules":         setRules,
+		"access":            accessRules,
+		"set_access":        setAccess,
+		"delete_access":     deleteAccess,
+		"owner_link":        ownerLink,
+		"previews":          previews,
+		"create_preview":    createPreview,
+		"revoke_preview":    revokePreview,
 	}
 	return &a
 }
 
 // Create a new page. If that page already exists, will return an error.
+// The HTML is rendered from the markdown, so any HTML sent by the client
+// is ignored.
 func createPage(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
 	type createArgs struct {
 		Markdown string `json:"markdown"`
-		HTML     string `json:"html"`
 	}
 	args := createArgs{}
 	err := requesthandler.ParseArguments(r, &args)
@@ -41,29 +71,50 @@ func createPage(u *models.User, w http.ResponseWriter, r *http.Request) interfac
 	// Create a new instance of the page object.
 	p := models.Page{
 		Markdown: args.Markdown,
-		HTML:     args.HTML,
 		Domain:   u.Domain,
+		EditedBy: u.Name,
 	}
 	err = p.GenerateName()
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
 	if err != nil {
 		log.Printf("Tried to create a new page, but couldn't make a unique name. (tried %s)", p.Key())
 		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseError
 	}
 
 	err = models.Insert(&p)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
 	if err != nil {
 		log.Printf("Tried to create a new page called `%s`, but encountered an error.", p.Key())
 		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseError
 	}
 
 	return p.Export()
 }
 
+// The response to a page edit. If the edit succeeds, it contains the
+// new revision number, which should be sent as the expected revision for
+// the next edit. If the page was changed by somebody else, it contains
+// the current copy of the page, so the editor can help merge the changes.
+type editResponse struct {
+	requesthandler.SimpleResponse
+	Revision int                    `json:"revision"`
+	Page     map[string]interface{} `json:"page,omitempty"`
+}
+
+// Edit an existing page. If the expected_revision is provided, the edit
+// only succeeds if the page hasn't been saved since that revision. Like
+// createPage, any HTML sent by the client is ignored.
 func editPage(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
 	type editArgs struct {
-		Name     string `json:"name"`
-		Markdown string `json:"markdown"`
-		HTML     string `json:"html"`
+		Name             string `json:"name"`
+		Markdown         string `json:"markdown"`
+		ExpectedRevision *int   `json:"expected_revision"`
 	}
 	args := editArgs{}
 	err := requesthandler.ParseArguments(r, &args)
@@ -77,21 +128,58 @@ func editPage(u *models.User, w http.ResponseWriter, r *http.Request) interface{
 	p.Domain = u.Domain
 	p.Name = args.Name
 	err = models.Load(&p)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
 	if err != nil {
 		http.Error(w, "", http.StatusBadRequest)
 		return requesthandler.ResponseInvalidArgs
 	}
 
-	// Update the data and save it.
+	// Update the data and save it. If no expected revision was given,
+	// we'll still refuse to save if the page changes between loading it
+	// and saving it.
+	if args.ExpectedRevision != nil {
+		p.Revision = *args.ExpectedRevision
+	}
 	p.Markdown = args.Markdown
-	p.HTML = args.HTML
+	p.EditedBy = u.Name
 	err = models.Save(&p)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if models.IsRevisionConflict(err) {
+		return pageConflict(&p, w)
+	}
 	if err != nil {
 		http.Error(w, "", http.StatusBadRequest)
 		return requesthandler.ResponseInvalidArgs
 	}
 
-	return requesthandler.ResponseOK
+	return editResponse{SimpleResponse: requesthandler.ResponseOK, Revision: p.Revision}
+}
+
+// Reports that an edit conflicted with somebody else's, along with the
+// current version of the page.
+func pageConflict(p *models.Page, w http.ResponseWriter) interface{} {
+	current := models.Page{}
+	current.Domain = p.Domain
+	current.Name = p.Name
+	err := models.Load(&current)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		http.Error(w, "", http.StatusNotFound)
+		return requesthandler.ResponseError
+	}
+
+	http.Error(w, "", http.StatusConflict)
+	return editResponse{
+		SimpleResponse: requesthandler.ResponseConflict,
+		Revision:       current.Revision,
+		Page:           current.Export(),
+	}
 }
 
 // Rename an existing page to a new name.
@@ -112,6 +200,9 @@ func renamePage(u *models.User, w http.ResponseWriter, r *http.Request) interfac
 	p.Domain = u.Domain
 	p.Name = args.OldName
 	err = models.Load(&p)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
 	if err != nil {
 		http.Error(w, "", http.StatusBadRequest)
 		return requesthandler.ResponseInvalidArgs
@@ -119,6 +210,9 @@ func renamePage(u *models.User, w http.ResponseWriter, r *http.Request) interfac
 
 	// Rename that page.
 	err = p.RenamePage(args.NewName)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
 
 	// The most common reason this fails is because of validation
 	// failure because an invalid name was provided.
@@ -130,6 +224,43 @@ func renamePage(u *models.User, w http.ResponseWriter, r *http.Request) interfac
 	return requesthandler.ResponseOK
 }
 
+// Show the changes which renaming a page would make to the links in the
+// user's other pages, without renaming it.
+func previewRenamePage(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type renameArgs struct {
+		OldName string `json:"old_name"`
+		NewName string `json:"new_name"`
+	}
+	args := renameArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	p := models.Page{}
+	p.Domain = u.Domain
+	p.Name = args.OldName
+	err = models.Load(&p)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	rewrites, err := p.RenamePreview(args.NewName)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+	return rewrites
+}
+
 // This function searches for a specific page, and returns it.
 func page(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
 	type pageArgs struct {
@@ -147,16 +278,84 @@ func page(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
 	p.Domain = u.Domain
 	p.Name = args.Name
 	err = models.Load(&p)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
 	if err != nil {
 		http.Error(w, "", http.StatusNotFound)
 		return requesthandler.ResponseError
 	}
 
+	// Let the editor know which revision of the page is live, if any.
+	published := models.Page{Published: true, Domain: p.Domain, Name: p.Name}
+	err = models.Load(&published)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	export := p.Export()
+	export["published"] = err == nil
+	if err == nil {
+		export["published_revision"] = published.Revision
+	}
+
 	// Return the page.
-	return p.Export()
+	return export
 }
 
-// Return a list of pages belonging to that user.
+// Publish a page, making the current draft visible on the site. If a
+// publish_at time in the future is given, the page will be published
+// automatically at that time instead.
+func publishPage(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type publishArgs struct {
+		Name             string    `json:"name"`
+		PublishAt        time.Time `json:"publish_at"`
+		ExpectedRevision *int      `json:"expected_revision"`
+	}
+	args := publishArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	p := models.Page{}
+	p.Domain = u.Domain
+	p.Name = args.Name
+	err = models.Load(&p)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		http.Error(w, "", http.StatusNotFound)
+		return requesthandler.ResponseError
+	}
+
+	// The expected revision makes sure that the draft being published
+	// is the one that the user was looking at.
+	if args.ExpectedRevision != nil {
+		p.Revision = *args.ExpectedRevision
+	}
+	if args.PublishAt.After(time.Now()) {
+		err = p.SchedulePublish(args.PublishAt)
+	} else {
+		err = p.Publish()
+	}
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if models.IsRevisionConflict(err) {
+		return pageConflict(&p, w)
+	}
+	if err != nil {
+		log.Printf("Failed to publish page `%s`: %v", p.Key(), err)
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	return editResponse{SimpleResponse: requesthandler.ResponseOK, Revision: p.Revision, Page: p.Export()}
+}
+
+// Return the pages belonging to that user, as a tree of folders.
 func pages(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
 	// Create a page object and use it to search for its own siblings.
 	p := models.Page{}
@@ -164,15 +363,74 @@ func pages(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
 	iterator, err := models.GetList(&p)
 	if err != nil {
 		log.Printf("Tried to load pages under `%s`, but it failed.", p.RegistrationKey())
-		return requesthandler.ResponseError
+		return requesthandler.Unavailable(w)
 	}
 
-	pageList := make([]map[string]interface{}, 0, iterator.Count())
+	pageList := make([]*models.Page, 0, iterator.Count())
 	for iterator.Next() {
-		pageList = append(pageList, iterator.Value().Export())
+		page := *iterator.Value().(*models.Page)
+		pageList = append(pageList, &page)
+	}
+	if iterator.Err() != nil {
+		return requesthandler.Unavailable(w)
+	}
+
+	return models.PageTree(pageList)
+}
+
+// Rename a folder, moving all of the pages inside of it. The new path
+// can be inside a different folder.
+func renameFolder(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type renameArgs struct {
+		OldPath string `json:"old_path"`
+		NewPath string `json:"new_path"`
+	}
+	args := renameArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
 	}
 
-	return pageList
+	err = models.RenameFolder(u.Domain, args.OldPath, args.NewPath)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+
+	// This usually fails because the new path is invalid, or because a
+	// page already exists at one of the new names.
+	if err != nil {
+		log.Printf("Failed to rename folder `%s`: %v", args.OldPath, err)
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	return requesthandler.ResponseOK
+}
+
+// Delete a folder, and all of the pages inside of it.
+func deleteFolder(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type deleteArgs struct {
+		Path string `json:"path"`
+	}
+	args := deleteArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	err = models.DeleteFolder(u.Domain, args.Path)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		log.Printf("Failed to delete folder `%s`: %v", args.Path, err)
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	return requesthandler.ResponseOK
 }
 
 // Delete a page.
@@ -192,6 +450,9 @@ func deletePage(u *models.User, w http.ResponseWriter, r *http.Request) interfac
 	p.Domain = u.Domain
 	p.Name = args.Name
 	err = models.Load(&p)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
 	if err != nil {
 		log.Printf("Tried to delete existing page `%s`", p.Key())
 		http.Error(w, "", http.StatusBadRequest)
@@ -200,8 +461,11 @@ func deletePage(u *models.User, w http.ResponseWriter, r *http.Request) interfac
 
 	// Now, delete the page.
 	err = models.Delete(&p)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
 	if err != nil {
-		log.Printf("Failed to delete page `%s`", p.Key())
+		log.Printf("Failed to delete page `%s`: %v", p.Key(), err)
 		http.Error(w, "", http.StatusInternalServerError)
 		return requesthandler.ResponseError
 	}
@@ -224,7 +488,10 @@ func setStyle(u *models.User, w http.ResponseWriter, r *http.Request) interface{
 	log.Printf("Set style: %s", args.Style)
 
 	u.Style = args.Style
-	err = models.Save(u)
+	err = models.SaveFields(u, "style")
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
 	if err != nil {
 		log.Printf("Failed to set style for `%s`", u.Key())
 		http.Error(w, "", http.StatusInternalServerError)
@@ -241,3 +508,173 @@ func getStyle(u *models.User, w http.ResponseWriter, r *http.Request) interface{
 	}
 	return styleResponse{u.Style}
 }
+
+// Set the robots.txt for this user's site. Setting it to an empty string
+// goes back to the default, which allows everything.
+func setRobots(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type robotsArgs struct {
+		Robots string `json:"robots"`
+	}
+	args := robotsArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	u.Robots = args.Robots
+	err = models.SaveFields(u, "robots")
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		log.Printf("Failed to set robots.txt for `%s`", u.Key())
+		http.Error(w, "", http.StatusInternalServerError)
+		return requesthandler.ResponseError
+	}
+
+	return requesthandler.ResponseOK
+}
+
+// Get the robots.txt setting for this user's site.
+func getRobots(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type robotsResponse struct {
+		Robots string `json:"robots"`
+	}
+	return robotsResponse{u.Robots}
+}
+
+// Search the user's pages. The drafts are searched, since that's what
+// the user is editing.
+func search(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type searchArgs struct {
+		Query string `json:"query"`
+	}
+	args := searchArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	results, err := models.Search(u.Domain, false, args.Query, searchLimit)
+	if err != nil {
+		log.Printf("Failed to search pages of `%s`: %v", u.Domain, err)
+		return requesthandler.Unavailable(w)
+	}
+	return results
+}
+
+// The maximum number of results returned by a search.
+const searchLimit = 20
+
+// Set whether visitors can search the user's site.
+func setPublicSearch(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type publicSearchArgs struct {
+		Enabled bool `json:"enabled"`
+	}
+	args := publicSearchArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	u.PublicSearch = args.Enabled
+	err = models.SaveFields(u, "public_search")
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		log.Printf("Failed to set public search for `%s`", u.Key())
+		http.Error(w, "", http.StatusInternalServerError)
+		return requesthandler.ResponseError
+	}
+
+	return requesthandler.ResponseOK
+}
+
+// Choose the page which is shown when visitors ask for something on the
+// user's site that doesn't exist. An empty name goes back to 404.md.
+func setNotFoundPage(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type notFoundArgs struct {
+		Name string `json:"name"`
+	}
+	args := notFoundArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil || (args.Name != "" && !models.ValidPagePath(args.Name)) {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	u.NotFoundPage = args.Name
+	err = models.SaveFields(u, "not_found_page")
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		log.Printf("Failed to set the not found page for `%s`", u.Key())
+		http.Error(w, "", http.StatusInternalServerError)
+		return requesthandler.ResponseError
+	}
+
+	return requesthandler.ResponseOK
+}
+
+// Return the settings for the navigation menu on this user's site.
+func getNavigation(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	n := models.Navigation{}
+	n.Domain = u.Domain
+	err := models.Load(&n)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		// The user hasn't changed the settings yet.
+		n.MakeDefault()
+	}
+	return n.Export()
+}
+
+// Set whether the navigation menu is shown on this user's site, the
+// order of the pages in it, and which pages are hidden from it.
+func setNavigation(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type navigationArgs struct {
+		Enabled bool     `json:"enabled"`
+		Order   []string `json:"order"`
+		Hidden  []string `json:"hidden"`
+	}
+	args := navigationArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	n := models.Navigation{}
+	n.Domain = u.Domain
+	err = models.Load(&n)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	exists := err == nil
+
+	n.Enabled = args.Enabled
+	n.Order = args.Order
+	n.Hidden = args.Hidden
+	n.MakeDefault()
+	if exists {
+		err = models.Save(&n)
+	} else {
+		err = models.Insert(&n)
+	}
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	return requesthandler.ResponseOK
+}
@@ -8,13 +8,9 @@
 package main
 
 import (
-	"crypto/md5"
-	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
 
 	"github.com/colin353/markdown.ninja/models"
 	"github.com/colin353/markdown.ninja/requesthandler"
@@ -25,10 +21,11 @@ import (
 func NewFileHandler() *requesthandler.GenericRequestHandler {
 	a := requesthandler.GenericRequestHandler{}
 	a.RouteMap = map[string]requesthandler.Responder{
-		"files":  files,
-		"upload": upload,
-		"rename": renameFile,
-		"delete": deleteFile,
+		"files":          files,
+		"upload":         upload,
+		"rename":         renameFile,
+		"preview_rename": previewRenameFile,
+		"delete":         deleteFile,
 	}
 	return &a
 }
@@ -39,13 +36,16 @@ func files(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
 	iterator, err := models.GetList(&f)
 	if err != nil {
 		log.Printf("Tried to load files under `%s`, but it failed.", f.RegistrationKey())
-		return requesthandler.ResponseError
+		return requesthandler.Unavailable(w)
 	}
 
 	fileList := make([]map[string]interface{}, 0, iterator.Count())
 	for iterator.Next() {
 		fileList = append(fileList, iterator.Value().Export())
 	}
+	if iterator.Err() != nil {
+		return requesthandler.Unavailable(w)
+	}
 
 	return fileList
 }
@@ -80,13 +80,6 @@ func upload(u *models.User, w http.ResponseWriter, r *http.Request) interface{}
 		return requesthandler.ResponseFileTooBig
 	}
 
-	// We need to check if the user has enough space remaining to upload
-	// the file. We allow 100 MiB of space.
-	if int64(u.SpaceUsage)+size > (100 << 20) {
-		log.Printf("Unable to upload file because we reached the space limit.")
-		return requesthandler.ResponseInssuficientSpace
-	}
-
 	if err != nil {
 		log.Printf("Trying to load uploaded file, but it failed.")
 		return requesthandler.ResponseError
@@ -100,67 +93,28 @@ func upload(u *models.User, w http.ResponseWriter, r *http.Request) interface{}
 	f.SetNameSafely(handler.Filename)
 	f.Domain = u.Domain
 
-	// We need to check if that file already exists. If it does,
-	// we'll delete it so we can replace it.
-	err = models.Load(&f)
-	if err == nil {
-		// The file DOES exist. So we'll delete the redis record
-		// and the actual file.
-		os.Remove(f.GetPath())
-		models.Delete(&f)
-
-		// Release the space from the deleted file so the user can
-		// upload more stuff.
-		u.SpaceUsage -= f.Size
-		models.Save(u)
-	}
-
-	f.Size = int(size)
-
-	// Now we need to compute the file hash using MD5.
 	data, err := ioutil.ReadAll(file)
 	if err != nil {
 		log.Printf("Unable to read uploaded file.")
 		return requesthandler.ResponseError
 	}
-	f.Hash = fmt.Sprintf("%x", md5.Sum(data))
-
-	if !f.Validate() {
-		log.Printf("Validation failed on attempted upload: `%s`", f.Key())
-		return requesthandler.ResponseError
-	}
-
-	// Seek back to the beginning of the file so we can copy it.
-	_, err = file.Seek(0, 0)
 
-	// Finally, we'll move the file to the appropriate location
-	// on the server.
-	targetFile, err := os.OpenFile(f.GetPath(), os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
-		log.Printf("Unable to create a new file and copy the upload.")
-		return requesthandler.ResponseError
+	// Store the file, replacing the old one with the same name if there
+	// is one. The user's space usage is updated along with it, and we
+	// allow 100 MiB of space.
+	err = models.SaveFile(&f, data, 100<<20)
+	if err == models.ErrNotEnoughSpace {
+		log.Printf("Unable to upload file because we reached the space limit.")
+		return requesthandler.ResponseInssuficientSpace
 	}
-	defer targetFile.Close()
-
-	// Copy the file over.
-	_, err = io.Copy(targetFile, file)
-	if err != nil {
-		log.Printf("Unable to copy the upload.")
-		return requesthandler.ResponseError
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
 	}
-
-	// Okay, everything was a success so far. So our final step will
-	// be to create the new record of the file in redis.
-	err = models.Insert(&f)
 	if err != nil {
-		log.Printf("Unable to create a record of the upload in the database.")
+		log.Printf("Unable to store the upload `%s`: %v", f.Key(), err)
 		return requesthandler.ResponseError
 	}
 
-	// Now we'll update the user's file space usage.
-	u.SpaceUsage += f.Size
-	models.Save(u)
-
 	return requesthandler.ResponseOK
 }
 
@@ -181,6 +135,9 @@ func renameFile(u *models.User, w http.ResponseWriter, r *http.Request) interfac
 	f.Domain = u.Domain
 	f.Name = args.OldName
 	err = models.Load(&f)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
 	if err != nil {
 		http.Error(w, "", http.StatusBadRequest)
 		return requesthandler.ResponseInvalidArgs
@@ -188,6 +145,9 @@ func renameFile(u *models.User, w http.ResponseWriter, r *http.Request) interfac
 
 	// Rename that page.
 	err = f.RenameFile(args.NewName)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
 
 	// The most common reason this fails is because of validation
 	// failure because an invalid name was provided.
@@ -199,6 +159,43 @@ func renameFile(u *models.User, w http.ResponseWriter, r *http.Request) interfac
 	return requesthandler.ResponseOK
 }
 
+// Show the changes which renaming a file would make to the links in the
+// user's pages, without renaming it.
+func previewRenameFile(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type renameArgs struct {
+		OldName string `json:"old_name"`
+		NewName string `json:"new_name"`
+	}
+	args := renameArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	f := models.File{}
+	f.Domain = u.Domain
+	f.Name = args.OldName
+	err = models.Load(&f)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	rewrites, err := f.RenamePreview(args.NewName)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+	return rewrites
+}
+
 func deleteFile(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
 	type deleteArgs struct {
 		Name string `json:"name"`
@@ -215,30 +212,26 @@ func deleteFile(u *models.User, w http.ResponseWriter, r *http.Request) interfac
 	f.Domain = u.Domain
 	f.Name = args.Name
 	err = models.Load(&f)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
 	if err != nil {
 		log.Printf("Tried to delete file `%s`, but failed", f.Key())
 		return requesthandler.ResponseInvalidArgs
 	}
 
-	// Now try to delete the file from the hard drive.
-	err = os.Remove(f.GetPath())
-	if err != nil {
-		log.Printf("Failed to delete file `%s` from hard drive.", f.Key())
-		http.Error(w, "", http.StatusInternalServerError)
-		return requesthandler.ResponseError
+	// Delete the record, and the contents too, unless another file
+	// has the same contents. The space is released so the user can
+	// upload another file later.
+	err = models.DeleteFile(&f)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
 	}
-
-	// And now delete it from the database.
-	err = models.Delete(&f)
 	if err != nil {
-		log.Printf("Failed to delete file `%s` from database.", f.Key())
+		log.Printf("Failed to delete file `%s`: %v", f.Key(), err)
 		http.Error(w, "", http.StatusInternalServerError)
 		return requesthandler.ResponseError
 	}
 
-	// Release the space so the user can upload another file later.
-	u.SpaceUsage -= f.Size
-	models.Save(u)
-
 	return requesthandler.ResponseOK
 }
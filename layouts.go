@@ -0,0 +1,126 @@
+/*
+  layouts.go
+
+  Routes for managing a user's custom page layouts. They're part of the
+  edit handler.
+*/
+
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/colin353/markdown.ninja/requesthandler"
+)
+
+// Return the user's custom layouts.
+func layouts(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	l := models.Layout{}
+	l.Domain = u.Domain
+	iterator, err := models.GetList(&l)
+	if err != nil {
+		log.Printf("Tried to load layouts under `%s`, but it failed.", l.RegistrationKey())
+		return requesthandler.Unavailable(w)
+	}
+
+	layoutList := make([]map[string]interface{}, 0, iterator.Count())
+	for iterator.Next() {
+		layoutList = append(layoutList, iterator.Value().Export())
+	}
+	if iterator.Err() != nil {
+		return requesthandler.Unavailable(w)
+	}
+	return layoutList
+}
+
+// Create or replace one of the user's layouts. The layout must be a valid
+// template, or it won't be saved.
+func saveLayout(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type layoutArgs struct {
+		Name     string `json:"name"`
+		Template string `json:"template"`
+	}
+	args := layoutArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	// Let the user know what's wrong with their template, so they can
+	// fix it.
+	type layoutResponse struct {
+		requesthandler.SimpleResponse
+		Message string `json:"message,omitempty"`
+	}
+	_, err = requesthandler.ParseLayout(args.Name, args.Template)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return layoutResponse{requesthandler.ResponseInvalidArgs, err.Error()}
+	}
+
+	l := models.Layout{}
+	l.Domain = u.Domain
+	l.Name = args.Name
+	err = models.Load(&l)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	exists := err == nil
+
+	l.Template = args.Template
+	if exists {
+		err = models.Save(&l)
+	} else {
+		err = models.Insert(&l)
+	}
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	return layoutResponse{SimpleResponse: requesthandler.ResponseOK}
+}
+
+// Delete one of the user's layouts. Pages which used it go back to
+// using the default layout.
+func deleteLayout(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type deleteArgs struct {
+		Name string `json:"name"`
+	}
+	args := deleteArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	l := models.Layout{}
+	l.Domain = u.Domain
+	l.Name = args.Name
+	err = models.Load(&l)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		http.Error(w, "", http.StatusNotFound)
+		return requesthandler.ResponseError
+	}
+
+	err = models.Delete(&l)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		log.Printf("Failed to delete layout `%s`: %v", l.Key(), err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return requesthandler.ResponseError
+	}
+
+	return requesthandler.ResponseOK
+}
@@ -0,0 +1,48 @@
+/*
+  links.go
+
+  Routes for finding out how a user's pages link to each other. They're
+  part of the edit handler.
+*/
+
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/colin353/markdown.ninja/requesthandler"
+)
+
+// Return the names of the pages which link to a page.
+func backlinks(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type backlinksArgs struct {
+		Name string `json:"name"`
+	}
+	args := backlinksArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	p := models.Page{Domain: u.Domain, Name: args.Name}
+	names, err := p.Backlinks()
+	if err != nil {
+		log.Printf("Failed to load backlinks of `%s`: %v", p.Key(), err)
+		return requesthandler.Unavailable(w)
+	}
+	return names
+}
+
+// Return the links in the user's pages to pages or files which don't
+// exist.
+func brokenLinks(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	broken, err := models.BrokenLinks(u.Domain)
+	if err != nil {
+		log.Printf("Failed to find broken links of `%s`: %v", u.Domain, err)
+		return requesthandler.Unavailable(w)
+	}
+	return broken
+}
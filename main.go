@@ -3,9 +3,11 @@ package main
 import (
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/colin353/markdown.ninja/config"
 	"github.com/colin353/markdown.ninja/models"
+	"github.com/colin353/markdown.ninja/render"
 	"github.com/colin353/markdown.ninja/requesthandler"
 	"github.com/gorilla/context"
 	"github.com/gorilla/sessions"
@@ -20,13 +22,47 @@ func main() {
 	AppConfig = config.LoadConfig("./config")
 	models.AppConfig = AppConfig
 	requesthandler.AppConfig = AppConfig
+	render.Configure(AppConfig.IframeHosts)
 
-	// Connect to redis.
-	models.Connect()
+	// Connect to the database.
+	err := models.Connect()
+	if err != nil {
+		log.Fatalf("Unable to start server: %v", err.Error())
+	}
 
 	// If we are in testing mode, we must delete the database contents.
 	if AppConfig.Mode == "test" || AppConfig.Mode == "testing" {
-		models.ClearDatabase()
+		err = models.ClearDatabase()
+		if err != nil {
+			log.Fatalf("Unable to clear the database: %v", err.Error())
+		}
+	}
+
+	// Pages used to be published as soon as they were saved, so any
+	// pages from back then need to be published.
+	err = models.PublishExistingPages()
+	if err != nil {
+		log.Fatalf("Unable to publish existing pages: %v", err.Error())
+	}
+	go publishScheduledPages()
+
+	// Likewise, pages saved before there was a search index need to
+	// be indexed.
+	err = models.IndexExistingPages()
+	if err != nil {
+		log.Fatalf("Unable to index existing pages: %v", err.Error())
+	}
+
+	// Files used to be stored under their own names, rather than by
+	// their contents. Contents which weren't removed when the last file
+	// using them was deleted are cleaned up too.
+	err = models.MoveFilesToBlobs()
+	if err != nil {
+		log.Fatalf("Unable to move existing files into blobs: %v", err.Error())
+	}
+	err = models.RemoveUnusedBlobs()
+	if err != nil {
+		log.Fatalf("Unable to remove unused blobs: %v", err.Error())
 	}
 
 	// Set up the cookie store.
@@ -43,8 +79,21 @@ func main() {
 	http.HandleFunc("/", requesthandler.SubdomainHandler)
 
 	// Start up the server.
-	err := http.ListenAndServe(":"+AppConfig.Port, context.ClearHandler(http.DefaultServeMux))
+	err = http.ListenAndServe(":"+AppConfig.Port, context.ClearHandler(http.DefaultServeMux))
 	if err != nil {
 		log.Fatalf("Unable to start server: %v", err.Error())
 	}
 }
+
+// How often to check for pages which are scheduled to be published.
+const publishInterval = time.Minute
+
+// Runs forever, publishing pages when their scheduled time comes.
+func publishScheduledPages() {
+	for now := range time.Tick(publishInterval) {
+		err := models.PublishScheduledPages(now)
+		if err != nil {
+			log.Printf("Unable to publish scheduled pages: %v", err)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+/*
+  access.go
+
+  Pages are public unless the user says otherwise. A page, or a whole
+  folder of pages, can be unlisted, protected by a password, or private
+  to the user. Files are protected by the pages which link to them.
+*/
+
+package models
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// The visibilities which pages can have.
+const (
+	// Anyone can see the page, and it's listed in the site's menu,
+	// feeds, sitemap, search and listings of posts.
+	VisibilityPublic = "public"
+	// Anyone with the link can see the page, but it isn't listed.
+	VisibilityUnlisted = "unlisted"
+	// Visitors have to enter a password to see the page.
+	VisibilityPassword = "password"
+	// Only the user can see the page, when they're logged in.
+	VisibilityPrivate = "private"
+)
+
+// An AccessRule sets the visibility of a page, or of every page in a
+// folder. It's stored in the database under the key:
+//    access:[domain]:[path]
+// where the path is the name of a page, or the path of a folder followed
+// by a slash, like blog/drafts/. A list of those keys are stored under
+// the
+//    access:[domain]
+// list. The rule for a page overrides the rules for the folders it's in,
+// and the rule for a folder overrides the rules for the folders above it.
+type AccessRule struct {
+	Domain       string `json:"domain"`
+	Path         string `json:"path"`
+	Visibility   string `json:"visibility"`
+	PasswordHash string `json:"password_hash"`
+	PasswordSalt string `json:"password_salt"`
+}
+
+// AccessRules are all of the rules for a site.
+type AccessRules []*AccessRule
+
+// MakeDefault sets default values for the rule. Pages are public, unless
+// they say otherwise.
+func (a *AccessRule) MakeDefault() {
+	if a.Visibility == "" {
+		a.Visibility = VisibilityPublic
+	}
+}
+
+// Export returns the fields which are acceptable to send directly to
+// the client over the web. The password isn't one of them.
+func (a *AccessRule) Export() map[string]interface{} {
+	return map[string]interface{}{
+		"path":       a.Path,
+		"visibility": a.Visibility,
+	}
+}
+
+// RegistrationKey defines the set to which this rule will belong. It'll
+// be of the form:
+//    access:[domain]
+func (a *AccessRule) RegistrationKey() string {
+	return fmt.Sprintf("access:%s", a.Domain)
+}
+
+// Key returns a unique key for use in the redis database.
+func (a *AccessRule) Key() string {
+	return fmt.Sprintf("access:%s:%s", a.Domain, a.Path)
+}
+
+// Validate checks that the rule applies to a valid page or folder, and
+// that protected pages have a password.
+func (a *AccessRule) Validate() bool {
+	if !domainValidator.MatchString(a.Domain) {
+		log.Printf("Validation failed on access rule %s, illegal domain '%s'\n", a.Path, a.Domain)
+		return false
+	}
+
+	if !ValidPagePath(strings.TrimSuffix(a.Path, "/")) {
+		log.Printf("Validation failed on access rule %s, illegal path '%s'\n", a.Path, a.Path)
+		return false
+	}
+
+	switch a.Visibility {
+	case VisibilityPublic, VisibilityUnlisted, VisibilityPrivate:
+	case VisibilityPassword:
+		if a.PasswordHash == "" {
+			log.Printf("Validation failed on access rule %s, missing password\n", a.Path)
+			return false
+		}
+	default:
+		log.Printf("Validation failed on access rule %s, illegal visibility '%s'\n", a.Path, a.Visibility)
+		return false
+	}
+
+	return true
+}
+
+// IsFolder reports whether the rule applies to a folder of pages, rather
+// than a single page.
+func (a *AccessRule) IsFolder() bool {
+	return strings.HasSuffix(a.Path, "/")
+}
+
+// Listed reports whether the pages which the rule applies to are listed
+// on the site.
+func (a *AccessRule) Listed() bool {
+	return a.Visibility == VisibilityPublic
+}
+
+// SetPassword sets the password which visitors need to enter, using
+// scrypt. Each password gets a new salt.
+func (a *AccessRule) SetPassword(password string) {
+	a.PasswordSalt = newSalt()
+	a.PasswordHash = hashPassword(password, a.PasswordSalt)
+}
+
+// CheckPassword reports whether the password is the one which visitors
+// need to enter.
+func (a *AccessRule) CheckPassword(password string) bool {
+	return a.PasswordHash != "" && hashPassword(password, a.PasswordSalt) == a.PasswordHash
+}
+
+// LoadAccessRules returns all of the rules for the domain.
+func LoadAccessRules(domain string) (AccessRules, error) {
+	iterator, err := GetList(&AccessRule{Domain: domain})
+	if err != nil {
+		return nil, err
+	}
+	rules := AccessRules{}
+	for iterator.Next() {
+		copied := *iterator.Value().(*AccessRule)
+		rules = append(rules, &copied)
+	}
+	return rules, iterator.Err()
+}
+
+// For returns the rule which applies to the page with the name: its own
+// rule, or else the rule of the closest folder it's in. If there isn't
+// one, the page is public.
+func (rules AccessRules) For(domain, name string) *AccessRule {
+	var closest *AccessRule
+	for _, rule := range rules {
+		if rule.Path == name {
+			return rule
+		}
+		if rule.IsFolder() && strings.HasPrefix(name, rule.Path) && (closest == nil || len(rule.Path) > len(closest.Path)) {
+			closest = rule
+		}
+	}
+	if closest == nil {
+		return &AccessRule{Domain: domain, Visibility: VisibilityPublic}
+	}
+	return closest
+}
+
+// PageAccess returns the rule which applies to the page.
+func PageAccess(domain, name string) (*AccessRule, error) {
+	rules, err := LoadAccessRules(domain)
+	if err != nil {
+		return nil, err
+	}
+	return rules.For(domain, name), nil
+}
+
+// FileAccess returns the rules which protect a file. Files are as visible
+// as the pages that link to them, so visitors who can see any of those
+// pages can download the file. If any of them are listed, or none of the
+// published pages link to the file (it might be linked to from somewhere
+// else), nothing is returned and the file is public.
+func FileAccess(domain, name string) (AccessRules, error) {
+	p := &Page{Published: true, Domain: domain}
+	names, err := store.Members(p.backlinksKey(linkTarget("/files/" + name)))
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	rules, err := LoadAccessRules(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	protecting := AccessRules{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		rule := rules.For(domain, name)
+		if rule.Visibility == VisibilityPublic || rule.Visibility == VisibilityUnlisted {
+			return nil, nil
+		}
+		if !seen[rule.Path] {
+			seen[rule.Path] = true
+			protecting = append(protecting, rule)
+		}
+	}
+	return protecting, nil
+}
+
+// Adds the writes which move the page's own access rule to its new name
+// to the batch which renames it. The rules of the folders it's in stay
+// where they are.
+func (p *Page) renameAccess(b *Batch, oldName string) error {
+	old := &AccessRule{Domain: p.Domain, Path: oldName}
+	err := Load(old)
+	if IsStorageError(err) {
+		return err
+	}
+	if err != nil {
+		return nil
+	}
+	renamed := *old
+	renamed.Path = p.Name
+	b.Rename(old.Key(), renamed.Key())
+	b.Save(renamed.Key(), map[string]string{"path": renamed.Path})
+	b.RemoveFromSet(old.RegistrationKey(), old.Key())
+	b.AddToSet(renamed.RegistrationKey(), renamed.Key())
+	return nil
+}
+
+// Adds the writes which delete the page's own access rule to the batch
+// which deletes it.
+func (p *Page) deleteAccess(b *Batch) {
+	rule := &AccessRule{Domain: p.Domain, Path: p.Name}
+	b.Delete(rule.Key())
+	b.RemoveFromSet(rule.RegistrationKey(), rule.Key())
+}
+
+// Adds the writes which move the access rules of a folder, and of the
+// folders inside it, to the batch which renames the folder. The rules of
+// the pages are moved along with the pages.
+func renameFolderAccess(b *Batch, domain, oldPath, newPath string) error {
+	rules, err := LoadAccessRules(domain)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if !rule.IsFolder() || !strings.HasPrefix(rule.Path, oldPath+"/") {
+			continue
+		}
+		renamed := *rule
+		renamed.Path = newPath + strings.TrimPrefix(rule.Path, oldPath)
+		b.Rename(rule.Key(), renamed.Key())
+		b.Save(renamed.Key(), map[string]string{"path": renamed.Path})
+		b.RemoveFromSet(rule.RegistrationKey(), rule.Key())
+		b.AddToSet(renamed.RegistrationKey(), renamed.Key())
+	}
+	return nil
+}
+
+// Adds the writes which delete the access rules of a folder, and of the
+// folders inside it, to the batch which deletes the folder.
+func deleteFolderAccess(b *Batch, domain, path string) error {
+	rules, err := LoadAccessRules(domain)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.IsFolder() && strings.HasPrefix(rule.Path, path+"/") {
+			b.Delete(rule.Key())
+			b.RemoveFromSet(rule.RegistrationKey(), rule.Key())
+		}
+	}
+	return nil
+}
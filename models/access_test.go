@@ -0,0 +1,95 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestAccessRules(t *testing.T) {
+	rules := AccessRules{
+		{Domain: "accessdomain", Path: "blog/", Visibility: VisibilityPrivate},
+		{Domain: "accessdomain", Path: "blog/public/", Visibility: VisibilityUnlisted},
+		{Domain: "accessdomain", Path: "blog/public/hello.md", Visibility: VisibilityPublic},
+	}
+	for name, visibility := range map[string]string{
+		"index.md":             VisibilityPublic,
+		"blog/index.md":        VisibilityPrivate,
+		"blog/public/other.md": VisibilityUnlisted,
+		"blog/public/hello.md": VisibilityPublic,
+		"blogs.md":             VisibilityPublic,
+	} {
+		if rule := rules.For("accessdomain", name); rule.Visibility != visibility {
+			t.Fatalf("Expected %s to be %s, got %s", name, visibility, rule.Visibility)
+		}
+	}
+
+	rule := &AccessRule{Domain: "accessdomain", Path: "secret.md", Visibility: VisibilityPassword}
+	if rule.Validate() {
+		t.Fatalf("Password protected pages need a password")
+	}
+	rule.SetPassword("hunter2")
+	if !rule.Validate() || !rule.CheckPassword("hunter2") || rule.CheckPassword("hunter3") {
+		t.Fatalf("Password wasn't set properly")
+	}
+}
+
+func TestProtectedPages(t *testing.T) {
+	pages := []*Page{
+		{Domain: "protected", Name: "index.md", Markdown: "![Photo](/files/photo.png)"},
+		{Domain: "protected", Name: "secret.md", Markdown: "![Photo](/files/photo.png) [Plan](/files/plan.pdf)"},
+		{Domain: "protected", Name: "hidden/page.md", Markdown: "Hidden"},
+	}
+	for _, p := range pages {
+		err := Insert(p)
+		if err == nil {
+			err = p.Publish()
+		}
+		if err != nil {
+			t.Fatalf("Failed to publish page: %v", err)
+		}
+	}
+	secret := &AccessRule{Domain: "protected", Path: "secret.md", Visibility: VisibilityPassword}
+	secret.SetPassword("hunter2")
+	for _, rule := range []*AccessRule{secret, {Domain: "protected", Path: "hidden/", Visibility: VisibilityUnlisted}} {
+		err := Insert(rule)
+		if err != nil {
+			t.Fatalf("Failed to insert rule: %v", err)
+		}
+	}
+
+	// Only public pages are listed.
+	listed, err := PublishedPages("protected")
+	if err != nil || len(listed) != 1 || listed[0].Name != "index.md" {
+		t.Fatalf("Expected only the index to be listed, got %v (%v)", listed, err)
+	}
+	if names := searchNames(t, "protected", true, "hidden"); len(names) != 0 {
+		t.Fatalf("Unlisted pages shouldn't be found, got %v", names)
+	}
+
+	// Files are protected only if all of the pages which link to them
+	// are.
+	rules, err := FileAccess("protected", "photo.png")
+	if err != nil || len(rules) != 0 {
+		t.Fatalf("Expected the photo to be public, got %v (%v)", rules, err)
+	}
+	rules, err = FileAccess("protected", "plan.pdf")
+	if err != nil || len(rules) != 1 || rules[0].Path != "secret.md" {
+		t.Fatalf("Expected the plan to be protected by the secret page, got %v (%v)", rules, err)
+	}
+
+	// The rule follows the page when it's renamed.
+	err = pages[1].RenamePage("top_secret.md")
+	if err != nil {
+		t.Fatalf("Failed to rename page: %v", err)
+	}
+	rule, err := PageAccess("protected", "top_secret.md")
+	if err != nil || rule.Visibility != VisibilityPassword || !rule.CheckPassword("hunter2") {
+		t.Fatalf("Expected the rule to be renamed, got %+v (%v)", rule, err)
+	}
+	err = RenameFolder("protected", "hidden", "shown")
+	if err != nil {
+		t.Fatalf("Failed to rename folder: %v", err)
+	}
+	if rule, _ := PageAccess("protected", "shown/page.md"); rule.Visibility != VisibilityUnlisted {
+		t.Fatalf("Expected the folder's rule to be renamed, got %+v", rule)
+	}
+}
@@ -0,0 +1,508 @@
+/*
+  blob.go
+
+  The contents of uploaded files are stored on disk by their hash, so
+  identical files are only stored once, however many times (or by
+  however many users) they're uploaded. Each blob counts the files
+  which use it, and is removed when there aren't any left.
+*/
+
+package models
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// A Blob is the contents of one or more files. It's stored in the
+// database under the key:
+//    blobs:[hash]
+// and a list of those keys are stored under the
+//    blobs
+// list. The contents themselves are in the data directory. Blobs which
+// no files use any more are listed in the
+//    blobs:unused
+// set until their contents have been removed from the disk.
+type Blob struct {
+	Hash       string `json:"hash"`
+	Size       int    `json:"size"`
+	References int    `json:"references"`
+}
+
+// The set of blobs whose contents are waiting to be removed.
+const unusedBlobsKey = "blobs:unused"
+
+// Contents are written before the batch which saves their blob, so
+// contents without a blob are only removed once they've been left alone
+// for this long, since an upload might still be saving them.
+const abandonedBlobAge = time.Hour
+
+// How many times changes to files are retried, when another request
+// changes the same blobs or user at the same time.
+const fileAttempts = 5
+
+// ErrNotEnoughSpace is returned when saving a file would take the user
+// over their limit.
+var ErrNotEnoughSpace = errors.New("not enough space for the file")
+
+var blobHashValidator = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// MakeDefault sets default values for the blob. There aren't any.
+func (b *Blob) MakeDefault() {}
+
+// Export returns the fields which are acceptable to send directly to
+// the client over the web.
+func (b *Blob) Export() map[string]interface{} {
+	return map[string]interface{}{
+		"hash": b.Hash,
+		"size": b.Size,
+	}
+}
+
+// RegistrationKey defines the set to which this blob belongs. All blobs
+// are siblings, since they're shared between users.
+func (b *Blob) RegistrationKey() string {
+	return "blobs"
+}
+
+// Key returns a unique key for use in the redis database.
+func (b *Blob) Key() string {
+	return fmt.Sprintf("blobs:%s", b.Hash)
+}
+
+// Validate checks that the blob is named by a hash of its contents.
+func (b *Blob) Validate() bool {
+	if !blobHashValidator.MatchString(b.Hash) {
+		log.Printf("Validation failed on blob, illegal hash '%s'\n", b.Hash)
+		return false
+	}
+	return true
+}
+
+// GetPath returns the path where the blob's contents are stored.
+func (b *Blob) GetPath() string {
+	return fmt.Sprintf("%s/blob-%s", AppConfig.DataDirectory, b.Hash)
+}
+
+// Returns the path which the blob's contents are moved to while they're
+// being removed. Nothing else uses it, so it's always safe to delete.
+func (b *Blob) unusedPath() string {
+	return b.GetPath() + ".unused"
+}
+
+// HashContents returns the hash which identifies the contents of a file.
+func HashContents(contents []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(contents))
+}
+
+// Writes the contents to the blob's path. They're written to a temporary
+// file first, so nobody can download half of them.
+func (b *Blob) write(contents []byte) error {
+	temp, err := ioutil.TempFile(filepath.Dir(b.GetPath()), "upload-")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(contents)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), b.GetPath())
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
+
+// Loads the blob with the hash. If it doesn't exist, a new blob with no
+// references is returned, along with false.
+func loadBlob(hash string) (*Blob, bool, error) {
+	b := &Blob{Hash: hash}
+	err := Load(b)
+	if IsStorageError(err) {
+		return nil, false, err
+	}
+	return b, err == nil, nil
+}
+
+// Adds the writes which change the number of files using the blob to the
+// batch. The batch fails if somebody else changes it first. Returns
+// whether the blob is no longer used.
+func (b *Blob) addReferences(batch *Batch, exists bool, change int) bool {
+	references := b.References + change
+	if !exists {
+		batch.RequireMissing(b.Key())
+		batch.AddToSet(b.RegistrationKey(), b.Key())
+		batch.Save(b.Key(), map[string]string{"hash": b.Hash, "size": strconv.Itoa(b.Size)})
+	} else {
+		batch.RequireCounter(b.Key(), "references", b.References)
+	}
+	batch.Save(b.Key(), map[string]string{"references": strconv.Itoa(references)})
+	if references <= 0 {
+		batch.AddToSet(unusedBlobsKey, b.Hash)
+		return true
+	}
+	batch.RemoveFromSet(unusedBlobsKey, b.Hash)
+	return false
+}
+
+// Adds the writes which set the user's space usage to the batch. The
+// batch fails if somebody else changes it first.
+func (u *User) setSpaceUsage(batch *Batch, usage int) {
+	batch.RequireCounter(u.Key(), "space_usage", u.SpaceUsage)
+	batch.Save(u.Key(), map[string]string{"space_usage": strconv.Itoa(usage)})
+}
+
+// SaveFile stores the contents of the file, replacing the file with the
+// same name if there is one. Users are charged for the size of each of
+// their files, even when the contents are shared with other files, so
+// nobody can tell what anybody else has uploaded. If the user would have
+// more than limit bytes of files, ErrNotEnoughSpace is returned.
+func SaveFile(f *File, contents []byte, limit int) error {
+	f.Hash = HashContents(contents)
+	f.Size = len(contents)
+	if !f.Validate() {
+		return fmt.Errorf("Tried to save invalid file `%s`", f.Key())
+	}
+	fields, err := encodeModel(f)
+	if err != nil {
+		return err
+	}
+
+	// If the contents are written, but the file isn't saved, nothing
+	// uses them.
+	written, saved := false, false
+	defer func() {
+		if written && !saved {
+			abandonBlob(f.Hash)
+		}
+	}()
+
+	for attempt := 0; attempt < fileAttempts; attempt++ {
+		u := &User{Domain: f.Domain}
+		err = Load(u)
+		if err != nil {
+			return err
+		}
+		old := &File{Domain: f.Domain, Name: f.Name}
+		err = Load(old)
+		if IsStorageError(err) {
+			return err
+		}
+		replacing := err == nil
+
+		usage := u.SpaceUsage + f.Size
+		if replacing {
+			usage -= old.Size
+		}
+		if usage > limit && (!replacing || f.Size > old.Size) {
+			return ErrNotEnoughSpace
+		}
+
+		b := &Batch{}
+		u.setSpaceUsage(b, usage)
+		if replacing {
+			b.RequireExists(f.Key())
+			b.Delete(f.Key())
+		} else {
+			b.RequireMissing(f.Key())
+			b.AddToSet(f.RegistrationKey(), f.Key())
+		}
+		b.Save(f.Key(), fields)
+
+		blob, exists, err := loadBlob(f.Hash)
+		if err != nil {
+			return err
+		}
+		blob.Size = f.Size
+		if replacing && old.Hash == f.Hash {
+			// Replacing a file with the same contents doesn't change
+			// how many files use them, but if somebody else replaces
+			// it in the meantime, the count will have changed.
+			if exists {
+				b.RequireCounter(blob.Key(), "references", blob.References)
+			}
+		} else {
+			if blob.References <= 0 {
+				err = blob.write(contents)
+				if err != nil {
+					return err
+				}
+				written = true
+			}
+			blob.addReferences(b, exists, 1)
+		}
+		var unused *Blob
+		if replacing && old.Hash != f.Hash {
+			oldBlob, exists, err := loadBlob(old.Hash)
+			if err != nil {
+				return err
+			}
+			if exists && oldBlob.addReferences(b, true, -1) {
+				unused = oldBlob
+			}
+		}
+
+		err = store.Apply(b)
+		if _, ok := err.(*PreconditionError); ok {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		saved = true
+		if unused != nil {
+			removeUnusedBlob(unused.Hash)
+		}
+		return nil
+	}
+	return fmt.Errorf("Tried to save `%s`, but it kept changing", f.Key())
+}
+
+// DeleteFile deletes the file, and gives the space it used back to the
+// user. Its contents are removed too, unless other files use them.
+func DeleteFile(f *File) error {
+	for attempt := 0; attempt < fileAttempts; attempt++ {
+		u := &User{Domain: f.Domain}
+		err := Load(u)
+		if err != nil {
+			return err
+		}
+		err = Load(f)
+		if err != nil {
+			return err
+		}
+
+		b, err := deleteBatch(f)
+		if err != nil {
+			return err
+		}
+		b.RequireExists(f.Key())
+		u.setSpaceUsage(b, u.SpaceUsage-f.Size)
+
+		var unused *Blob
+		blob, exists, err := loadBlob(f.Hash)
+		if err != nil {
+			return err
+		}
+		if exists && blob.addReferences(b, true, -1) {
+			unused = blob
+		}
+
+		err = store.Apply(b)
+		if _, ok := err.(*PreconditionError); ok {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if unused != nil {
+			removeUnusedBlob(unused.Hash)
+		}
+		return nil
+	}
+	return fmt.Errorf("Tried to delete `%s`, but it kept changing", f.Key())
+}
+
+// Removes the contents of a blob which no files use any more, logging
+// rather than returning any errors. If it doesn't work, the blob stays
+// in the unused set, and RemoveUnusedBlobs tries again later.
+func removeUnusedBlob(hash string) {
+	err := removeBlob(hash)
+	if err != nil {
+		log.Printf("Unable to remove unused blob `%s`: %v", hash, err)
+	}
+}
+
+// Removes the blob's contents and its record, unless a file started
+// using it again in the meantime. The contents are moved out of the way
+// first, so that an upload of the same contents at the same time either
+// puts them back, or finds that the blob is gone and writes them again.
+func removeBlob(hash string) error {
+	blob, exists, err := loadBlob(hash)
+	if err != nil {
+		return err
+	}
+	if exists && blob.References > 0 {
+		return store.RemoveFromSet(unusedBlobsKey, hash)
+	}
+	if !exists {
+		info, err := os.Stat(blob.GetPath())
+		if err == nil && time.Since(info.ModTime()) < abandonedBlobAge {
+			return nil
+		}
+		if err == nil {
+			err = os.Remove(blob.GetPath())
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if exists {
+		err = os.Rename(blob.GetPath(), blob.unusedPath())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		moved := err == nil
+
+		b := &Batch{}
+		b.RequireCounter(blob.Key(), "references", blob.References)
+		b.Delete(blob.Key())
+		b.RemoveFromSet(blob.RegistrationKey(), blob.Key())
+		err = store.Apply(b)
+		if err != nil {
+			if moved {
+				os.Rename(blob.unusedPath(), blob.GetPath())
+			}
+			if _, ok := err.(*PreconditionError); ok {
+				return nil
+			}
+			return err
+		}
+	}
+
+	err = os.Remove(blob.unusedPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return store.RemoveFromSet(unusedBlobsKey, hash)
+}
+
+// Marks the contents of a blob, which were written for a change that
+// didn't happen, to be removed by RemoveUnusedBlobs if nothing uses them.
+func abandonBlob(hash string) {
+	err := store.AddToSet(unusedBlobsKey, hash)
+	if err != nil {
+		log.Printf("Unable to mark blob `%s` as unused: %v", hash, err)
+	}
+}
+
+// RemoveUnusedBlobs removes the contents of every blob which no files
+// use, which weren't removed when the last file using them was deleted.
+func RemoveUnusedBlobs() error {
+	hashes, err := store.Members(unusedBlobsKey)
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		err = removeBlob(hash)
+		if IsStorageError(err) {
+			return err
+		}
+		if err != nil {
+			log.Printf("Unable to remove unused blob `%s`: %v", hash, err)
+		}
+	}
+	return nil
+}
+
+// MoveFilesToBlobs moves every file which was uploaded before files were
+// stored by their contents into a blob. It only does anything the first
+// time it's run.
+func MoveFilesToBlobs() error {
+	migrations, err := store.Load(migrationsKey)
+	if err != nil || migrations["file_blobs"] != "" {
+		return err
+	}
+
+	users, err := GetList(&User{})
+	if err != nil {
+		return err
+	}
+	domains := []string{}
+	for users.Next() {
+		domains = append(domains, users.Value().(*User).Domain)
+	}
+	if users.Err() != nil {
+		return users.Err()
+	}
+
+	failed := 0
+	for _, domain := range domains {
+		files, err := GetList(&File{Domain: domain})
+		if err != nil {
+			return err
+		}
+		for files.Next() {
+			err = moveFileToBlob(files.Value().(*File))
+			if IsStorageError(err) {
+				return err
+			}
+			if err != nil {
+				log.Printf("Unable to move file `%s` into a blob: %v", files.Value().Key(), err)
+				failed++
+			}
+		}
+		if files.Err() != nil {
+			return files.Err()
+		}
+	}
+
+	// The files which couldn't be moved don't have any contents until
+	// they are, so the migration is tried again next time. The rest of
+	// the site still works in the meantime.
+	if failed > 0 {
+		log.Printf("Unable to move %d files into blobs, will try again next time", failed)
+		return nil
+	}
+	return store.Save(migrationsKey, map[string]string{"file_blobs": time.Now().Format(time.RFC3339)})
+}
+
+// Moves a file from where uploads used to be stored into its blob.
+// Files which have already been moved are left alone, since the
+// migration runs again if any of them couldn't be moved.
+func moveFileToBlob(f *File) error {
+	if blobHashValidator.MatchString(f.Hash) {
+		_, exists, err := loadBlob(f.Hash)
+		if err != nil || exists {
+			return err
+		}
+	}
+
+	legacyPath := fmt.Sprintf("%s/%s-%s-%s", AppConfig.DataDirectory, f.Domain, f.Hash, f.Name)
+	contents, err := ioutil.ReadFile(legacyPath)
+	if err != nil {
+		return err
+	}
+
+	f.Hash = HashContents(contents)
+	blob, exists, err := loadBlob(f.Hash)
+	if err != nil {
+		return err
+	}
+	blob.Size = len(contents)
+	written := false
+	if blob.References <= 0 {
+		err = blob.write(contents)
+		if err != nil {
+			return err
+		}
+		written = true
+	}
+
+	b := &Batch{}
+	b.RequireExists(f.Key())
+	b.Save(f.Key(), map[string]string{"hash": f.Hash})
+	blob.addReferences(b, exists, 1)
+	err = store.Apply(b)
+	if err != nil {
+		if written {
+			abandonBlob(f.Hash)
+		}
+		return err
+	}
+	return os.Remove(legacyPath)
+}
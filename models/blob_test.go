@@ -0,0 +1,282 @@
+package models
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func insertBlobUser(t *testing.T, domain string) {
+	u := NewUser()
+	u.Domain = domain
+	u.Email = "blobs@test.com"
+	u.SetPassword("blob password")
+	err := Insert(u)
+	if err != nil {
+		t.Fatalf("Failed to insert user: %v", err)
+	}
+}
+
+func blobReferences(t *testing.T, hash string) int {
+	b, exists, err := loadBlob(hash)
+	if err != nil {
+		t.Fatalf("Failed to load blob: %v", err)
+	}
+	if !exists {
+		return 0
+	}
+	return b.References
+}
+
+func spaceUsage(t *testing.T, domain string) int {
+	u := &User{Domain: domain}
+	err := Load(u)
+	if err != nil {
+		t.Fatalf("Failed to load user: %v", err)
+	}
+	return u.SpaceUsage
+}
+
+func TestFileBlobs(t *testing.T) {
+	insertBlobUser(t, "blobdomain")
+	insertBlobUser(t, "otherblobs")
+	photo := []byte("photo contents")
+	hash := HashContents(photo)
+
+	// Identical files are stored once, but each user pays for their own.
+	for _, f := range []*File{
+		{Domain: "blobdomain", Name: "photo.png"},
+		{Domain: "blobdomain", Name: "copy.png"},
+		{Domain: "otherblobs", Name: "photo.png"},
+	} {
+		err := SaveFile(f, photo, 100)
+		if err != nil {
+			t.Fatalf("Failed to save file: %v", err)
+		}
+		if f.Hash != hash || f.GetPath() != (&Blob{Hash: hash}).GetPath() {
+			t.Fatalf("Expected the file to be stored by its hash, got %+v", f)
+		}
+	}
+	contents, err := ioutil.ReadFile((&Blob{Hash: hash}).GetPath())
+	if err != nil || string(contents) != string(photo) {
+		t.Fatalf("Expected the contents to be stored, got %q (%v)", contents, err)
+	}
+	if refs := blobReferences(t, hash); refs != 3 {
+		t.Fatalf("Expected 3 references to the blob, got %d", refs)
+	}
+	if usage := spaceUsage(t, "blobdomain"); usage != 2*len(photo) {
+		t.Fatalf("Expected to use %d bytes, got %d", 2*len(photo), usage)
+	}
+
+	err = SaveFile(&File{Domain: "blobdomain", Name: "big.png"}, make([]byte, 100), 100)
+	if err != ErrNotEnoughSpace {
+		t.Fatalf("Expected to run out of space, got %v", err)
+	}
+
+	// Renaming a file doesn't change the space it uses, and saving the
+	// same contents again doesn't either.
+	f := &File{Domain: "blobdomain", Name: "copy.png"}
+	Load(f)
+	err = f.RenameFile("renamed.png")
+	if err != nil {
+		t.Fatalf("Failed to rename file: %v", err)
+	}
+	err = SaveFile(&File{Domain: "blobdomain", Name: "renamed.png"}, photo, 100)
+	if err != nil {
+		t.Fatalf("Failed to save file: %v", err)
+	}
+	if refs, usage := blobReferences(t, hash), spaceUsage(t, "blobdomain"); refs != 3 || usage != 2*len(photo) {
+		t.Fatalf("Expected 3 references and %d bytes, got %d and %d", 2*len(photo), refs, usage)
+	}
+
+	// Replacing a file moves it to the new contents.
+	edited := []byte("edited")
+	err = SaveFile(&File{Domain: "blobdomain", Name: "renamed.png"}, edited, 100)
+	if err != nil {
+		t.Fatalf("Failed to replace file: %v", err)
+	}
+	if refs := blobReferences(t, hash); refs != 2 {
+		t.Fatalf("Expected 2 references to the old blob, got %d", refs)
+	}
+	if refs := blobReferences(t, HashContents(edited)); refs != 1 {
+		t.Fatalf("Expected 1 reference to the new blob, got %d", refs)
+	}
+	if usage := spaceUsage(t, "blobdomain"); usage != len(photo)+len(edited) {
+		t.Fatalf("Expected to use %d bytes, got %d", len(photo)+len(edited), usage)
+	}
+
+	// Replacing it again leaves nothing using the edited contents, so
+	// they're removed.
+	err = SaveFile(&File{Domain: "blobdomain", Name: "renamed.png"}, photo, 100)
+	if err != nil {
+		t.Fatalf("Failed to replace file: %v", err)
+	}
+	if _, err = os.Stat((&Blob{Hash: HashContents(edited)}).GetPath()); !os.IsNotExist(err) {
+		t.Fatalf("Expected the unused contents to be removed, got %v", err)
+	}
+
+	// The contents stay until the last file using them is deleted.
+	for i, f := range []*File{
+		{Domain: "blobdomain", Name: "photo.png"},
+		{Domain: "blobdomain", Name: "renamed.png"},
+		{Domain: "otherblobs", Name: "photo.png"},
+	} {
+		if _, err = os.Stat((&Blob{Hash: hash}).GetPath()); err != nil {
+			t.Fatalf("Contents were removed while still in use: %v", err)
+		}
+		err = DeleteFile(f)
+		if err != nil {
+			t.Fatalf("Failed to delete file: %v", err)
+		}
+		if refs := blobReferences(t, hash); refs != 2-i {
+			t.Fatalf("Expected %d references to the blob, got %d", 2-i, refs)
+		}
+	}
+	if _, err = os.Stat((&Blob{Hash: hash}).GetPath()); !os.IsNotExist(err) {
+		t.Fatalf("Expected the contents to be removed, got %v", err)
+	}
+	if refs, usage := blobReferences(t, hash), spaceUsage(t, "blobdomain"); refs != 0 || usage != 0 {
+		t.Fatalf("Expected nothing to be used, got %d references and %d bytes", refs, usage)
+	}
+	unused, err := store.Members(unusedBlobsKey)
+	if err != nil || len(unused) != 0 {
+		t.Fatalf("Expected no unused blobs, got %v (%v)", unused, err)
+	}
+}
+
+func TestRemoveUnusedBlobs(t *testing.T) {
+	// Contents which couldn't be removed before are removed later, but
+	// contents which are in use again are kept.
+	for i, references := range []int{0, 1} {
+		contents := []byte(fmt.Sprintf("leftover %d", i))
+		blob := &Blob{Hash: HashContents(contents), Size: len(contents), References: references}
+		err := Insert(blob)
+		if err == nil {
+			err = blob.write(contents)
+		}
+		if err == nil {
+			err = store.AddToSet(unusedBlobsKey, blob.Hash)
+		}
+		if err != nil {
+			t.Fatalf("Failed to store blob: %v", err)
+		}
+		defer os.Remove(blob.GetPath())
+	}
+
+	err := RemoveUnusedBlobs()
+	if err != nil {
+		t.Fatalf("Failed to remove unused blobs: %v", err)
+	}
+	if _, err = os.Stat((&Blob{Hash: HashContents([]byte("leftover 0"))}).GetPath()); !os.IsNotExist(err) {
+		t.Fatalf("Expected the unused contents to be removed, got %v", err)
+	}
+	if _, err = os.Stat((&Blob{Hash: HashContents([]byte("leftover 1"))}).GetPath()); err != nil {
+		t.Fatalf("Expected the contents in use to be kept, got %v", err)
+	}
+	unused, err := store.Members(unusedBlobsKey)
+	if err != nil || len(unused) != 0 {
+		t.Fatalf("Expected no unused blobs, got %v (%v)", unused, err)
+	}
+}
+
+func TestMoveFilesToBlobs(t *testing.T) {
+	insertBlobUser(t, "legacyfiles")
+	f := &File{Domain: "legacyfiles", Name: "old.txt", Hash: "0123abcd"}
+	err := Insert(f)
+	if err != nil {
+		t.Fatalf("Failed to insert file: %v", err)
+	}
+	legacyPath := fmt.Sprintf("%s/legacyfiles-0123abcd-old.txt", AppConfig.DataDirectory)
+	ioutil.WriteFile(legacyPath, []byte("old contents"), 0644)
+	defer os.Remove(legacyPath)
+
+	err = MoveFilesToBlobs()
+	if err != nil {
+		t.Fatalf("Failed to move files: %v", err)
+	}
+	Load(f)
+	defer os.Remove(f.GetPath())
+	if f.Hash != HashContents([]byte("old contents")) || blobReferences(t, f.Hash) != 1 {
+		t.Fatalf("Expected the file to use a blob, got %+v", f)
+	}
+	contents, err := ioutil.ReadFile(f.GetPath())
+	if err != nil || string(contents) != "old contents" {
+		t.Fatalf("Expected the contents to be moved, got %q (%v)", contents, err)
+	}
+	if _, err = os.Stat(legacyPath); !os.IsNotExist(err) {
+		t.Fatalf("Expected the old copy to be removed, got %v", err)
+	}
+	// A file which can't be moved yet is tried again next time, and the
+	// files which were already moved are left alone.
+	store.Save(migrationsKey, map[string]string{"file_blobs": ""})
+	missing := &File{Domain: "legacyfiles", Name: "missing.txt", Hash: "4567cdef"}
+	err = Insert(missing)
+	if err != nil {
+		t.Fatalf("Failed to insert file: %v", err)
+	}
+	err = MoveFilesToBlobs()
+	if err != nil {
+		t.Fatalf("Failed to move files: %v", err)
+	}
+	if migrations, _ := store.Load(migrationsKey); migrations["file_blobs"] != "" {
+		t.Fatalf("Expected the migration to run again, since a file wasn't moved")
+	}
+	missingPath := fmt.Sprintf("%s/legacyfiles-4567cdef-missing.txt", AppConfig.DataDirectory)
+	ioutil.WriteFile(missingPath, []byte("found contents"), 0644)
+	defer os.Remove(missingPath)
+	err = MoveFilesToBlobs()
+	if err != nil {
+		t.Fatalf("Failed to move files: %v", err)
+	}
+	Load(missing)
+	defer os.Remove(missing.GetPath())
+	if missing.Hash != HashContents([]byte("found contents")) || blobReferences(t, f.Hash) != 1 {
+		t.Fatalf("Expected the file to be moved once it could be, got %+v", missing)
+	}
+	if migrations, _ := store.Load(migrationsKey); migrations["file_blobs"] == "" {
+		t.Fatalf("Expected the migration to be finished")
+	}
+}
+
+// A failingStore can't apply batches, but everything else works.
+type failingStore struct {
+	Store
+}
+
+func (failingStore) Apply(*Batch) error { return errBroken }
+
+func TestAbandonedBlobs(t *testing.T) {
+	insertBlobUser(t, "abandoned")
+	contents := []byte("abandoned contents")
+	blob := &Blob{Hash: HashContents(contents)}
+	defer os.Remove(blob.GetPath())
+
+	working := store
+	store = failingStore{working}
+	err := SaveFile(&File{Domain: "abandoned", Name: "lost.txt"}, contents, 100)
+	store = working
+	if err == nil {
+		t.Fatalf("Expected saving the file to fail")
+	}
+	unused, _ := store.Members(unusedBlobsKey)
+	if len(unused) != 1 || unused[0] != blob.Hash {
+		t.Fatalf("Expected the contents to be marked as unused, got %v", unused)
+	}
+
+	// They're kept for a while, in case an upload is still saving them.
+	err = RemoveUnusedBlobs()
+	if _, statErr := os.Stat(blob.GetPath()); err != nil || statErr != nil {
+		t.Fatalf("Expected the recent contents to be kept, got %v (%v)", statErr, err)
+	}
+	old := time.Now().Add(-2 * abandonedBlobAge)
+	os.Chtimes(blob.GetPath(), old, old)
+	err = RemoveUnusedBlobs()
+	if _, statErr := os.Stat(blob.GetPath()); err != nil || !os.IsNotExist(statErr) {
+		t.Fatalf("Expected the abandoned contents to be removed, got %v (%v)", statErr, err)
+	}
+	if unused, _ = store.Members(unusedBlobsKey); len(unused) != 0 {
+		t.Fatalf("Expected no unused blobs, got %v", unused)
+	}
+}
@@ -0,0 +1,54 @@
+/*
+  blog.go
+
+  Pages in the posts folder are blog posts. Posts are dated by the date
+  in their front matter, and the site lists them automatically, newest
+  first.
+*/
+
+package models
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// PostsFolder is the folder which contains a site's blog posts.
+const PostsFolder = "posts"
+
+// Matches the link targets of the generated listings of posts, like
+// posts, posts/page/2 or posts/2026.
+var listingTarget = regexp.MustCompile(`^` + PostsFolder + `(/\d{4})?(/page/\d+)?$`)
+
+// IsPost reports whether the page should be listed as a blog post. Pages
+// in the posts folder are posts, as long as they have a date and aren't
+// marked as drafts. The index of the folder isn't a post.
+func (p *Page) IsPost() bool {
+	if !strings.HasPrefix(p.Name, PostsFolder+"/") || p.Name == PostsFolder+"/index.md" {
+		return false
+	}
+	return !p.Date.IsZero() && !p.Draft
+}
+
+// PublishedPosts returns the site's published blog posts, newest first.
+func PublishedPosts(domain string) ([]*Page, error) {
+	pages, err := PublishedPages(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	posts := []*Page{}
+	for _, p := range pages {
+		if p.IsPost() {
+			posts = append(posts, p)
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		if !posts[i].Date.Equal(posts[j].Date) {
+			return posts[i].Date.After(posts[j].Date)
+		}
+		return posts[i].Name < posts[j].Name
+	})
+	return posts, nil
+}
@@ -0,0 +1,149 @@
+/*
+  codec.go
+
+  Models are stored as flat hashes of strings, so every field has to be
+  converted to and from a string. This file contains the conversions for
+  each of the field types that a model may use.
+*/
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ModelTag is the struct tag which controls how a field is stored. The
+// only option right now is `model:"json"`, which stores a nested struct
+// as JSON. Without it, structs (other than time.Time) can't be stored,
+// since it's easy to accidentally store something huge that way.
+const ModelTag = "model"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Returns the name a struct field is stored under, which is the name from
+// its JSON tag. If the field has no JSON name, it isn't stored at all,
+// and an empty string is returned.
+func storedFieldName(t reflect.StructField) string {
+	name := strings.Split(t.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+// Converts a struct field into the string used to store it.
+func encodeField(v reflect.Value, t reflect.StructField) (string, error) {
+	if t.Tag.Get(ModelTag) == "json" {
+		data, err := json.Marshal(v.Interface())
+		return string(data), err
+	}
+
+	if v.Type() == timeType {
+		return v.Interface().(time.Time).Format(time.RFC3339Nano), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits()), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Slice, reflect.Map:
+		data, err := json.Marshal(v.Interface())
+		return string(data), err
+	}
+	return "", fmt.Errorf("can't store field `%s` of type %v", t.Name, v.Type())
+}
+
+// Sets a struct field from the string it was stored as.
+func decodeField(v reflect.Value, t reflect.StructField, value string) error {
+	if t.Tag.Get(ModelTag) == "json" {
+		return json.Unmarshal([]byte(value), v.Addr().Interface())
+	}
+
+	if v.Type() == timeType {
+		result, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(result))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		result, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(result)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		result, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(result)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		result, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(result)
+	case reflect.Float32, reflect.Float64:
+		result, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(result)
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Slice, reflect.Map:
+		// Decode into a fresh value, so that nothing is left over
+		// from whatever the field held before.
+		result := reflect.New(v.Type())
+		err := json.Unmarshal([]byte(value), result.Interface())
+		if err != nil {
+			return err
+		}
+		v.Set(result.Elem())
+	default:
+		return fmt.Errorf("can't load field `%s` of type %v", t.Name, v.Type())
+	}
+	return nil
+}
+
+// Sets a struct field from a proposed change, which has usually been
+// decoded from a JSON request. The change may either be the value itself
+// (e.g. a number for an int field), or the stored string form of it.
+func setFieldFromChange(v reflect.Value, t reflect.StructField, change interface{}) error {
+	if s, ok := change.(string); ok && v.Kind() != reflect.String {
+		err := decodeField(v, t, s)
+		if err == nil {
+			return nil
+		}
+	}
+
+	// Round-tripping through JSON takes care of converting between the
+	// JSON types and the field types, e.g. float64 -> int.
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	result := reflect.New(v.Type())
+	err = json.Unmarshal(data, result.Interface())
+	if err != nil {
+		return fmt.Errorf("invalid value for field `%s`: %v", t.Name, err)
+	}
+	v.Set(result.Elem())
+	return nil
+}
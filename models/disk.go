@@ -0,0 +1,346 @@
+/*
+  disk.go
+
+  An implementation of the Store interface which keeps the database
+  in a single file on disk, using an embedded key-value store. It's
+  useful for small deployments where running redis isn't worth it.
+*/
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The embedded database is split into buckets, one for each of the
+// kinds of value that redis would store for us.
+var (
+	hashBucket    = []byte("hashes")
+	setBucket     = []byte("sets")
+	counterBucket = []byte("counters")
+)
+
+type diskStore struct {
+	db *bolt.DB
+}
+
+func newDiskStore(path string) (*diskStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &diskStore{db: db}
+	err = db.Update(createBuckets)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func createBuckets(tx *bolt.Tx) error {
+	for _, name := range [][]byte{hashBucket, setBucket, counterBucket} {
+		_, err := tx.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *diskStore) Exists(key string) (bool, error) {
+	exists := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		exists = diskKeyExists(tx, key)
+		return nil
+	})
+	return exists, diskError(err)
+}
+
+func diskKeyExists(tx *bolt.Tx, key string) bool {
+	k := []byte(key)
+	return tx.Bucket(hashBucket).Get(k) != nil ||
+		tx.Bucket(setBucket).Bucket(k) != nil ||
+		tx.Bucket(counterBucket).Get(k) != nil
+}
+
+func (s *diskStore) Load(key string) (map[string]string, error) {
+	var result map[string]string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		result, err = diskLoadHash(tx, key)
+		return err
+	})
+	return result, diskError(err)
+}
+
+func diskLoadHash(tx *bolt.Tx, key string) (map[string]string, error) {
+	hash := make(map[string]string)
+	data := tx.Bucket(hashBucket).Get([]byte(key))
+	if data == nil {
+		return hash, nil
+	}
+	err := json.Unmarshal(data, &hash)
+	return hash, err
+}
+
+func (s *diskStore) Save(key string, fields map[string]string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return diskSave(tx, key, fields)
+	})
+	return diskError(err)
+}
+
+func diskSave(tx *bolt.Tx, key string, fields map[string]string) error {
+	hash, err := diskLoadHash(tx, key)
+	if err != nil {
+		return err
+	}
+	for field, value := range fields {
+		hash[field] = value
+	}
+	data, err := json.Marshal(hash)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(hashBucket).Put([]byte(key), data)
+}
+
+func (s *diskStore) Delete(key string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return diskDelete(tx, key)
+	})
+	return diskError(err)
+}
+
+func diskDelete(tx *bolt.Tx, key string) error {
+	k := []byte(key)
+	err := tx.Bucket(hashBucket).Delete(k)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(counterBucket).Delete(k)
+	if err != nil {
+		return err
+	}
+	if tx.Bucket(setBucket).Bucket(k) != nil {
+		return tx.Bucket(setBucket).DeleteBucket(k)
+	}
+	return nil
+}
+
+func (s *diskStore) Rename(oldKey, newKey string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return diskRename(tx, oldKey, newKey)
+	})
+	return diskError(err)
+}
+
+func diskRename(tx *bolt.Tx, oldKey, newKey string) error {
+	if !diskKeyExists(tx, oldKey) {
+		return errNoSuchKey
+	}
+
+	// Read out the old value before clearing the destination, in
+	// case the two keys are the same.
+	oldK := []byte(oldKey)
+	hash := copyBytes(tx.Bucket(hashBucket).Get(oldK))
+	counter := copyBytes(tx.Bucket(counterBucket).Get(oldK))
+	var members [][]byte
+	if set := tx.Bucket(setBucket).Bucket(oldK); set != nil {
+		set.ForEach(func(member, _ []byte) error {
+			members = append(members, copyBytes(member))
+			return nil
+		})
+	}
+
+	err := diskDelete(tx, oldKey)
+	if err != nil {
+		return err
+	}
+	err = diskDelete(tx, newKey)
+	if err != nil {
+		return err
+	}
+
+	newK := []byte(newKey)
+	switch {
+	case hash != nil:
+		return tx.Bucket(hashBucket).Put(newK, hash)
+	case counter != nil:
+		return tx.Bucket(counterBucket).Put(newK, counter)
+	default:
+		set, err := tx.Bucket(setBucket).CreateBucket(newK)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			err = set.Put(member, []byte{})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Anything that goes wrong inside of the embedded database is reported
+// as a StorageError, apart from our own errNoSuchKey.
+func diskError(err error) error {
+	if err == nil || err == errNoSuchKey {
+		return err
+	}
+	return &StorageError{err}
+}
+
+// Values returned by bolt are only valid during the transaction, so
+// they need to be copied if they are used after modifying the bucket.
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func (s *diskStore) AddToSet(key, member string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return diskAddToSet(tx, key, member)
+	})
+	return diskError(err)
+}
+
+func diskAddToSet(tx *bolt.Tx, key, member string) error {
+	set, err := tx.Bucket(setBucket).CreateBucketIfNotExists([]byte(key))
+	if err != nil {
+		return err
+	}
+	return set.Put([]byte(member), []byte{})
+}
+
+func (s *diskStore) RemoveFromSet(key, member string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return diskRemoveFromSet(tx, key, member)
+	})
+	return diskError(err)
+}
+
+func diskRemoveFromSet(tx *bolt.Tx, key, member string) error {
+	k := []byte(key)
+	set := tx.Bucket(setBucket).Bucket(k)
+	if set == nil {
+		return nil
+	}
+	err := set.Delete([]byte(member))
+	if err != nil {
+		return err
+	}
+
+	// Like redis, we won't keep empty sets around.
+	if first, _ := set.Cursor().First(); first == nil {
+		return tx.Bucket(setBucket).DeleteBucket(k)
+	}
+	return nil
+}
+
+func (s *diskStore) Members(key string) ([]string, error) {
+	members := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		set := tx.Bucket(setBucket).Bucket([]byte(key))
+		if set == nil {
+			return nil
+		}
+		return set.ForEach(func(member, _ []byte) error {
+			members = append(members, string(member))
+			return nil
+		})
+	})
+	return members, diskError(err)
+}
+
+func (s *diskStore) Increment(key string) (int, error) {
+	value := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		counters := tx.Bucket(counterBucket)
+		if data := counters.Get([]byte(key)); data != nil {
+			var err error
+			value, err = strconv.Atoi(string(data))
+			if err != nil {
+				return err
+			}
+		}
+		value++
+		return counters.Put([]byte(key), []byte(strconv.Itoa(value)))
+	})
+	return value, diskError(err)
+}
+
+func (s *diskStore) Clear() error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{hashBucket, setBucket, counterBucket} {
+			err := tx.DeleteBucket(name)
+			if err != nil {
+				return err
+			}
+		}
+		return createBuckets(tx)
+	})
+	return diskError(err)
+}
+
+// Apply runs the whole batch inside of a single transaction, so if any
+// of the writes fail, the transaction is rolled back.
+func (s *diskStore) Apply(b *Batch) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		err := b.check(diskReader{tx})
+		if err != nil {
+			return err
+		}
+
+		for _, op := range b.ops {
+			err = diskApply(tx, op)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if _, ok := err.(*PreconditionError); ok {
+		return err
+	}
+	return diskError(err)
+}
+
+// Reads the database for checking batch preconditions, from within
+// the transaction that applies the batch.
+type diskReader struct {
+	tx *bolt.Tx
+}
+
+func (r diskReader) exists(key string) (bool, error) {
+	return diskKeyExists(r.tx, key), nil
+}
+
+func (r diskReader) field(key, field string) (string, error) {
+	hash, err := diskLoadHash(r.tx, key)
+	return hash[field], err
+}
+
+func diskApply(tx *bolt.Tx, op batchOp) error {
+	switch op.command {
+	case "HMSET":
+		return diskSave(tx, op.key, op.fields)
+	case "DEL":
+		return diskDelete(tx, op.key)
+	case "RENAME":
+		return diskRename(tx, op.key, op.arg)
+	case "SADD":
+		return diskAddToSet(tx, op.key, op.arg)
+	case "SREM":
+		return diskRemoveFromSet(tx, op.key, op.arg)
+	}
+	return fmt.Errorf("unknown batch command `%s`", op.command)
+}
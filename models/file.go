@@ -1,20 +1,20 @@
 /*
   file.go
 
-  The file model describes a file that the user has uploaded.
+  The file model describes a file that the user has uploaded. Its
+  contents are stored in a blob, which might be shared with other files.
 */
 
 package models
 
 import (
 	"fmt"
-	"log"
-	"os"
 	"regexp"
 )
 
 // A File is a file that a user has uploaded, such
-// as a resume or an image.
+// as a resume or an image. The hash identifies the
+// blob holding its contents.
 type File struct {
 	Name        string `json:"name"`
 	Hash        string `json:"hash"`
@@ -58,10 +58,10 @@ func (f *File) Validate() bool {
 	return true
 }
 
-// GetPath returns the path that the file should be uploaded
-// to, or can be accessed from.
+// GetPath returns the path that the file's contents can be
+// accessed from.
 func (f *File) GetPath() string {
-	return fmt.Sprintf("%s/%s-%s-%s", AppConfig.DataDirectory, f.Domain, f.Hash, f.Name)
+	return (&Blob{Hash: f.Hash}).GetPath()
 }
 
 var filenameReplacer = regexp.MustCompile("[^A-Za-z0-9_\\.]+")
@@ -74,43 +74,66 @@ func (f *File) SetNameSafely(name string) {
 
 // RenameFile takes an existing file and renames it. It's a bit tricky to rename the
 // file, because the file name defines the key, which is required in lookups. So you can't
-// just load the record, change the name, and save it.
+// just load the record, change the name, and save it. The old URL redirects to the new
+// one, and links to the file in the user's pages are changed to match. The contents
+// are stored by their hash, so they stay where they are.
 func (f *File) RenameFile(newName string) error {
-	pool, err := getRedisConnection()
-	if err != nil {
-		log.Fatal("Couldn't connect to the redis database.")
-		return err
-	}
-
-	oldPath := f.GetPath()
 	oldKey := f.Key()
+	oldURL := f.urlPath()
 	f.Name = newName
-	newPath := f.GetPath()
 
 	// Need to check key validation, in case the new name is not valid.
 	if !f.Validate() {
 		return fmt.Errorf("Tried to rename file to invalid name `%s`", newName)
 	}
 
-	// Step one: rename the old key to the new key.
-	pool.Cmd("RENAME", oldKey, f.Key())
+	if oldKey == f.Key() {
+		return nil
+	}
 
-	// Take the registration pool and delete the old key
-	// and add a new key.
-	pool.Cmd("SREM", f.RegistrationKey(), oldKey)
-	pool.Cmd("SADD", f.RegistrationKey(), f.Key())
+	b, err := renameBatch(f, oldKey)
+	if err != nil {
+		return err
+	}
+	err = addRedirect(b, f.Domain, oldURL, f.urlPath())
+	if err != nil {
+		return err
+	}
 
-	// Rename the associated file.
-	err = os.Rename(oldPath, newPath)
+	// Don't clobber another file's data when moving this one.
+	exists, err := store.Exists(f.Key())
 	if err != nil {
 		return err
 	}
+	if exists {
+		return fmt.Errorf("Tried to rename file to `%s`, but that name is taken", newName)
+	}
 
-	// Save the object with the new parameters.
-	err = Save(f)
+	err = store.Apply(b)
 	if err != nil {
 		return err
 	}
 
+	// Fix up the links to the file from the user's pages.
+	updateReferences(f.Domain, map[string]string{linkTarget(oldURL): f.urlPath()})
 	return nil
 }
+
+// RenamePreview returns the changes which renaming the file would make
+// to the links in the user's pages, without renaming it.
+func (f *File) RenamePreview(newName string) ([]LinkRewrite, error) {
+	renamed := *f
+	renamed.Name = newName
+	if !renamed.Validate() {
+		return nil, fmt.Errorf("Tried to rename file to invalid name `%s`", newName)
+	}
+	if renamed.Key() == f.Key() {
+		return []LinkRewrite{}, nil
+	}
+	return rewriteReferences(f.Domain, map[string]string{linkTarget(f.urlPath()): renamed.urlPath()}, false)
+}
+
+// Returns the URL which visitors use to download the file.
+func (f *File) urlPath() string {
+	return "/files/" + f.Name
+}
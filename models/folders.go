@@ -0,0 +1,164 @@
+/*
+  folders.go
+
+  Pages can be organized into folders by giving them names like
+  blog/2026/hello.md. Folders aren't stored by themselves: a folder
+  exists as long as there are pages inside of it.
+*/
+
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A PageFolder is a folder of pages, used to show the pages of a
+// site as a tree. The root folder has an empty name and path.
+type PageFolder struct {
+	Name    string                   `json:"name"`
+	Path    string                   `json:"path"`
+	Pages   []map[string]interface{} `json:"pages"`
+	Folders []*PageFolder            `json:"folders"`
+}
+
+func newPageFolder(name, path string) *PageFolder {
+	return &PageFolder{
+		Name:    name,
+		Path:    path,
+		Pages:   []map[string]interface{}{},
+		Folders: []*PageFolder{},
+	}
+}
+
+// PageTree arranges the pages into a tree of folders, based on their
+// paths. Within each folder, the subfolders and pages are sorted by name.
+func PageTree(pages []*Page) *PageFolder {
+	root := newPageFolder("", "")
+	folders := map[string]*PageFolder{"": root}
+
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i].Name < pages[j].Name
+	})
+	for _, p := range pages {
+		parent := root
+		segments := strings.Split(p.Name, "/")
+		for i, segment := range segments[:len(segments)-1] {
+			path := strings.Join(segments[:i+1], "/")
+			folder, ok := folders[path]
+			if !ok {
+				folder = newPageFolder(segment, path)
+				folders[path] = folder
+				parent.Folders = append(parent.Folders, folder)
+			}
+			parent = folder
+		}
+		parent.Pages = append(parent.Pages, p.Export())
+	}
+	return root
+}
+
+// PagesInFolder returns all of the pages in the folder at path, including
+// the pages in its subfolders.
+func PagesInFolder(domain, path string) ([]*Page, error) {
+	prefix := strings.Trim(path, "/") + "/"
+	iterator, err := GetList(&Page{Domain: domain})
+	if err != nil {
+		return nil, err
+	}
+
+	pages := []*Page{}
+	for iterator.Next() {
+		p := iterator.Value().(*Page)
+		if strings.HasPrefix(p.Name, prefix) {
+			copied := *p
+			pages = append(pages, &copied)
+		}
+	}
+	return pages, iterator.Err()
+}
+
+// RenameFolder moves every page in the folder at oldPath to newPath,
+// which might be in a different folder. Either all of the pages are
+// moved, or none of them are, e.g. if one of them would replace a page
+// which already exists. Links to the pages are changed to match.
+func RenameFolder(domain, oldPath, newPath string) error {
+	oldPath = strings.Trim(oldPath, "/")
+	newPath = strings.Trim(newPath, "/")
+	if !ValidPagePath(oldPath) || !ValidPagePath(newPath) {
+		return fmt.Errorf("Tried to rename folder `%s` to invalid path `%s`", oldPath, newPath)
+	}
+	if oldPath == newPath {
+		return nil
+	}
+
+	pages, err := PagesInFolder(domain, oldPath)
+	if err != nil {
+		return err
+	}
+	if len(pages) == 0 {
+		return fmt.Errorf("Folder `%s` doesn't exist", oldPath)
+	}
+
+	b := &Batch{}
+	moves := map[string]string{}
+	names := []string{}
+	for _, p := range pages {
+		oldName := p.Name
+		pageBatch, err := p.renameBatch(newPath + strings.TrimPrefix(p.Name, oldPath))
+		if err != nil {
+			return err
+		}
+		b.append(pageBatch)
+		moves[linkTarget(oldName)] = PageURLPath(p.Name)
+		names = append(names, p.Name)
+	}
+	err = renameFolderAccess(b, domain, oldPath, newPath)
+	if err != nil {
+		return err
+	}
+	err = store.Apply(b)
+	if err != nil {
+		return err
+	}
+
+	// Fix up the links to the pages from the user's other pages.
+	updateReferences(domain, moves, names...)
+	return nil
+}
+
+// DeleteFolder deletes every page in the folder at path, including the
+// pages in its subfolders.
+func DeleteFolder(domain, path string) error {
+	pages, err := PagesInFolder(domain, path)
+	if err != nil {
+		return err
+	}
+	if len(pages) == 0 {
+		return fmt.Errorf("Folder `%s` doesn't exist", path)
+	}
+
+	b := &Batch{}
+	for _, p := range pages {
+		pageBatch, err := deleteBatch(p)
+		if err != nil {
+			return err
+		}
+		b.append(pageBatch)
+	}
+	err = deleteFolderAccess(b, domain, strings.Trim(path, "/"))
+	if err != nil {
+		return err
+	}
+	err = store.Apply(b)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for _, p := range pages {
+		names = append(names, p.Name)
+	}
+	return rerenderBacklinks(domain, names...)
+}
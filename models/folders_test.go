@@ -0,0 +1,94 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestPagePathValidation(t *testing.T) {
+	valid := []string{"index.md", "blog/2026/hello-world.md", "a/b/c"}
+	for _, path := range valid {
+		if !ValidPagePath(path) {
+			t.Errorf("Path `%s` should be valid.", path)
+		}
+	}
+
+	invalid := []string{"", "/index.md", "blog/", "blog//hello.md", "../secret.md", "blog/./hello.md", "blog/hello world.md", "a:b"}
+	for _, path := range invalid {
+		if ValidPagePath(path) {
+			t.Errorf("Path `%s` shouldn't be valid.", path)
+		}
+	}
+}
+
+func insertPages(t *testing.T, domain string, names ...string) {
+	for _, name := range names {
+		err := Insert(&Page{Domain: domain, Name: name, Markdown: name})
+		if err != nil {
+			t.Fatalf("Failed to insert page `%s`: %v", name, err)
+		}
+	}
+}
+
+func TestPageTree(t *testing.T) {
+	pages := []*Page{}
+	for _, name := range []string{"index.md", "blog/b.md", "blog/2026/hello.md", "about.md", "blog/a.md"} {
+		pages = append(pages, &Page{Domain: "testdomain", Name: name})
+	}
+
+	root := PageTree(pages)
+	if len(root.Pages) != 2 || root.Pages[0]["name"] != "about.md" || root.Pages[1]["name"] != "index.md" {
+		t.Fatalf("Unexpected pages in root folder: %v", root.Pages)
+	}
+	if len(root.Folders) != 1 || root.Folders[0].Path != "blog" {
+		t.Fatalf("Expected a single blog folder, got %v", root.Folders)
+	}
+	blog := root.Folders[0]
+	if len(blog.Pages) != 2 || blog.Pages[0]["name"] != "blog/a.md" {
+		t.Fatalf("Unexpected pages in blog folder: %v", blog.Pages)
+	}
+	if len(blog.Folders) != 1 || blog.Folders[0].Name != "2026" || blog.Folders[0].Path != "blog/2026" {
+		t.Fatalf("Unexpected folders in blog folder: %v", blog.Folders)
+	}
+}
+
+func TestRenameFolder(t *testing.T) {
+	insertPages(t, "folderdomain", "posts/a.md", "posts/old/b.md", "postscript.md", "archive/a.md")
+
+	// Moving the folder would replace archive/a.md, so nothing should move.
+	err := RenameFolder("folderdomain", "posts", "archive")
+	if err == nil {
+		t.Fatalf("Shouldn't be able to move a folder on top of existing pages.")
+	}
+	moved, _ := PagesInFolder("folderdomain", "archive")
+	if len(moved) != 1 {
+		t.Fatalf("Failed move left pages behind: %v", moved)
+	}
+
+	err = RenameFolder("folderdomain", "posts", "blog/posts")
+	if err != nil {
+		t.Fatalf("Couldn't move folder: %v", err)
+	}
+	left, _ := PagesInFolder("folderdomain", "posts")
+	if len(left) != 0 {
+		t.Fatalf("Pages were left in the old folder: %v", left)
+	}
+
+	p := Page{Domain: "folderdomain", Name: "blog/posts/old/b.md"}
+	err = Load(&p)
+	if err != nil || p.Markdown != "posts/old/b.md" {
+		t.Fatalf("Page wasn't moved properly: %v", err)
+	}
+	p = Page{Domain: "folderdomain", Name: "postscript.md"}
+	if Load(&p) != nil {
+		t.Fatalf("Pages with the same prefix as the folder shouldn't be moved.")
+	}
+
+	err = DeleteFolder("folderdomain", "blog")
+	if err != nil {
+		t.Fatalf("Couldn't delete folder: %v", err)
+	}
+	iterator, _ := GetList(&Page{Domain: "folderdomain"})
+	if iterator.Count() != 2 {
+		t.Fatalf("Expected only the pages outside the folder to be left, got %d", iterator.Count())
+	}
+}
@@ -0,0 +1,104 @@
+/*
+  frontmatter.go
+
+  Pages can carry metadata in a block of YAML front matter at the top of
+  their markdown. Whenever a page is saved, the front matter is parsed
+  into the page's metadata fields, so that it can be queried without
+  parsing the markdown again.
+*/
+
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The fields which can be set in a page's front matter. Anything else
+// in the front matter is ignored.
+type frontMatter struct {
+	Title       string          `yaml:"title"`
+	Description string          `yaml:"description"`
+	Date        string          `yaml:"date"`
+	Draft       bool            `yaml:"draft"`
+	Layout      string          `yaml:"layout"`
+	Tags        frontMatterTags `yaml:"tags"`
+	Weight      int             `yaml:"weight"`
+	NoIndex     bool            `yaml:"noindex"`
+}
+
+// Tags can either be written as a YAML list, or as a single string
+// separated by commas.
+type frontMatterTags []string
+
+func (t *frontMatterTags) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*t = list
+		return nil
+	}
+
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	*t = []string{}
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			*t = append(*t, tag)
+		}
+	}
+	return nil
+}
+
+// The formats that a date in the front matter may be written in.
+var frontMatterDateFormats = []string{
+	"2006-01-02",
+	"2006-01-02 15:04",
+	"2006-01-02 15:04:05",
+	time.RFC3339,
+}
+
+func parseFrontMatterDate(value string) (time.Time, error) {
+	for _, format := range frontMatterDateFormats {
+		date, err := time.Parse(format, value)
+		if err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't understand the date `%s`, try writing it like 2006-01-02", value)
+}
+
+// Parses the front matter and sets the page's metadata fields from it.
+// Fields which aren't in the front matter are reset to their zero value.
+func (p *Page) setFrontMatter(source string) error {
+	f := frontMatter{}
+	err := yaml.Unmarshal([]byte(source), &f)
+	if err != nil {
+		return fmt.Errorf("invalid front matter: %v", err)
+	}
+
+	date := time.Time{}
+	if f.Date != "" {
+		date, err = parseFrontMatterDate(f.Date)
+		if err != nil {
+			return fmt.Errorf("invalid front matter: %v", err)
+		}
+	}
+
+	p.Title = f.Title
+	p.Description = f.Description
+	p.Date = date
+	p.Draft = f.Draft
+	p.Layout = f.Layout
+	p.Tags = f.Tags
+	if p.Tags == nil {
+		p.Tags = []string{}
+	}
+	p.Weight = f.Weight
+	p.NoIndex = f.NoIndex
+	return nil
+}
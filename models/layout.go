@@ -0,0 +1,80 @@
+/*
+  layout.go
+
+  A Layout is an HTML template which a user has written to wrap around
+  their pages, in place of the layout that comes with their style.
+*/
+
+package models
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+)
+
+// A Layout is a user's custom page layout. It's stored in the database
+// under the key:
+//    layouts:[domain]:[name]
+// and a list of those keys are stored under the
+//    layouts:[domain]
+// list. The layout called "default" is used for all of the user's pages,
+// unless a page chooses another one in its front matter.
+type Layout struct {
+	Domain   string `json:"domain"`
+	Name     string `json:"name"`
+	Template string `json:"template"`
+}
+
+// DefaultLayoutName is the name of the layout which is used for pages
+// that don't ask for a particular layout.
+const DefaultLayoutName = "default"
+
+// MakeDefault sets default values for the layout. There aren't any.
+func (l *Layout) MakeDefault() {}
+
+// Export returns the fields which are acceptable to send directly to
+// the client over the web.
+func (l *Layout) Export() map[string]interface{} {
+	return map[string]interface{}{
+		"name":     l.Name,
+		"template": l.Template,
+	}
+}
+
+// RegistrationKey defines the set to which this layout will
+// belong. It'll be of the form:
+//    layouts:[domain]
+func (l *Layout) RegistrationKey() string {
+	return fmt.Sprintf("layouts:%s", l.Domain)
+}
+
+// Key returns a unique key for use in the redis database.
+func (l *Layout) Key() string {
+	return fmt.Sprintf("layouts:%s:%s", l.Domain, l.Name)
+}
+
+var layoutNameValidator = regexp.MustCompile("^[A-Za-z0-9_\\-]+$")
+
+// ValidLayoutName reports whether name can be used as the name of a
+// layout. The same rule applies to the names of styles, since they're
+// also used to find layouts.
+func ValidLayoutName(name string) bool {
+	return layoutNameValidator.MatchString(name)
+}
+
+// Validate checks that the layout has a valid domain and name. The
+// template itself is checked when it's saved by the editor.
+func (l *Layout) Validate() bool {
+	if !domainValidator.MatchString(l.Domain) {
+		log.Printf("Validation failed on layout %s, illegal domain '%s'\n", l.Name, l.Domain)
+		return false
+	}
+
+	if !ValidLayoutName(l.Name) {
+		log.Printf("Validation failed on layout %s, illegal name '%s'\n", l.Name, l.Name)
+		return false
+	}
+
+	return true
+}
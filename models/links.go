@@ -0,0 +1,406 @@
+/*
+  links.go
+
+  Pages link to each other, and to files. The links in each page are
+  recorded whenever it's saved, so that each page knows which pages link
+  to it, and links to pages or files that don't exist can be reported.
+*/
+
+package models
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/colin353/markdown.ninja/render"
+)
+
+// A BrokenLink is a link in a page to a page or file which doesn't exist.
+type BrokenLink struct {
+	Page string `json:"page"`
+	Link string `json:"link"`
+}
+
+// Paths on every site which are generated rather than stored as pages.
+var generatedPaths = map[string]bool{
+	"feed.xml":    true,
+	"atom.xml":    true,
+	"sitemap.xml": true,
+	"robots.txt":  true,
+	"search":      true,
+}
+
+// Returns the target of a link to the given path. Pages can be reached
+// through more than one path, e.g. /blog, /blog/ and /blog/index.md are
+// all the same page, so they're all the same target.
+func linkTarget(path string) string {
+	target := strings.TrimSuffix(strings.Trim(path, "/"), ".md")
+	if target == "index" {
+		return ""
+	}
+	return strings.TrimSuffix(target, "/index")
+}
+
+// Returns the key of the set of pages which link to the target.
+func (p *Page) backlinksKey(target string) string {
+	return fmt.Sprintf("backlinks:%s:%s:%s", p.table(), p.Domain, target)
+}
+
+// Returns the key of the hash which records what the page links to.
+func (p *Page) linksKey() string {
+	return "links:" + p.Key()
+}
+
+// Returns the targets of the links in the page which point to other
+// places on the same site.
+func (p *Page) linkTargets() map[string]bool {
+	base := &url.URL{Path: PageURLPath(p.Name)}
+	targets := map[string]bool{}
+	for _, link := range render.Links(p.HTML) {
+		u, err := url.Parse(link)
+		if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+			continue
+		}
+		targets[linkTarget(base.ResolveReference(u).Path)] = true
+	}
+	return targets
+}
+
+// Adds the writes which record the page's links to the batch that saves
+// it. The links that the page used to have are removed.
+func (p *Page) saveLinks(b *Batch) error {
+	old, err := store.Load(p.linksKey())
+	if err != nil {
+		return err
+	}
+	targets := p.linkTargets()
+	for target := range old {
+		if !targets[target] {
+			b.RemoveFromSet(p.backlinksKey(target), p.Name)
+		}
+	}
+
+	fields := map[string]string{}
+	for target := range targets {
+		b.AddToSet(p.backlinksKey(target), p.Name)
+		fields[target] = "1"
+	}
+	b.Delete(p.linksKey())
+	if len(fields) > 0 {
+		b.Save(p.linksKey(), fields)
+	}
+	return nil
+}
+
+// Adds the writes which forget the page's links to the batch that
+// deletes it.
+func (p *Page) deleteLinks(b *Batch) error {
+	old, err := store.Load(p.linksKey())
+	if err != nil {
+		return err
+	}
+	for target := range old {
+		b.RemoveFromSet(p.backlinksKey(target), p.Name)
+	}
+	b.Delete(p.linksKey())
+	return nil
+}
+
+// Backlinks returns the names of the pages which link to this one.
+func (p *Page) Backlinks() ([]string, error) {
+	names, err := store.Members(p.backlinksKey(linkTarget(p.Name)))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Returns the names of all of the pages with the same domain as the
+// page, and the same draft or published state.
+func (p *Page) siblingNames() ([]string, error) {
+	keys, err := store.Members(p.RegistrationKey())
+	if err != nil {
+		return nil, err
+	}
+	prefix := (&Page{Published: p.Published, Domain: p.Domain}).Key()
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		names = append(names, strings.TrimPrefix(key, prefix))
+	}
+	return names, nil
+}
+
+// Wiki links name pages loosely, so [[My Page]] can refer to my_page.md,
+// My-Page.md or my page/index.md. Returns the form of the name which is
+// compared.
+func wikiLinkName(name string) string {
+	name = strings.ToLower(linkTarget(name))
+	return strings.NewReplacer("_", " ", "-", " ").Replace(name)
+}
+
+// Returns a resolver which turns wiki links in this page into links to
+// the other pages on the site. Links to pages which don't exist point to
+// where the page would be, if it were created.
+func (p *Page) wikiLinkResolver() (render.WikiLinkResolver, error) {
+	names, err := p.siblingNames()
+	if err != nil {
+		return nil, err
+	}
+	pages := map[string]string{}
+	for _, name := range names {
+		pages[wikiLinkName(name)] = name
+	}
+
+	return func(target string) (string, bool) {
+		if name, ok := pages[wikiLinkName(target)]; ok {
+			return PageURLPath(name), true
+		}
+		return "/" + strings.Replace(strings.ToLower(linkTarget(target)), " ", "_", -1), false
+	}, nil
+}
+
+// Returns the link targets which a wiki link to the page could have.
+// A wiki link to a page which doesn't exist points to where the page
+// would be, so when it's created, e.g. [[My Page]] points to my_page
+// whether the page is called My_Page.md or my-page.md.
+func wikiLinkTargets(name string) []string {
+	target := linkTarget(name)
+	lower := strings.ToLower(target)
+	return []string{target, lower, strings.Replace(lower, "-", "_", -1)}
+}
+
+// Re-renders the drafts and published copies of the domain's pages
+// which link to the named pages. The HTML of a wiki link depends on
+// whether the page it names exists, so it has to change whenever a
+// page is created, deleted or renamed.
+func rerenderBacklinks(domain string, names ...string) error {
+	for _, published := range []bool{false, true} {
+		prototype := &Page{Domain: domain, Published: published}
+		linking := map[string]bool{}
+		for _, name := range names {
+			for _, target := range wikiLinkTargets(name) {
+				members, err := store.Members(prototype.backlinksKey(target))
+				if err != nil {
+					return err
+				}
+				for _, member := range members {
+					linking[member] = true
+				}
+			}
+		}
+
+		for name := range linking {
+			p := &Page{Domain: domain, Name: name, Published: published}
+			err := Load(p)
+			if IsStorageError(err) {
+				return err
+			}
+			if err != nil {
+				continue
+			}
+			err = p.rerender()
+			if IsStorageError(err) {
+				return err
+			}
+			if err != nil {
+				log.Printf("Failed to render the wiki links in `%s`: %v", p.Key(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// Renders the page's markdown again, and saves the HTML if it changed.
+// If somebody saves the page in the meantime, it's left alone, since
+// saving it renders it anyway.
+func (p *Page) rerender() error {
+	html, excerpt := p.HTML, p.Excerpt
+	err := p.updateDerivedFields()
+	if err != nil {
+		return err
+	}
+	if p.HTML == html && p.Excerpt == excerpt {
+		return nil
+	}
+
+	b := &Batch{}
+	b.RequireCounter(p.Key(), "revision", p.Revision)
+	b.Save(p.Key(), map[string]string{"html": p.HTML, "excerpt": p.Excerpt})
+	err = p.saveLinks(b)
+	if err != nil {
+		return err
+	}
+	err = store.Apply(b)
+	if _, ok := err.(*PreconditionError); ok {
+		return nil
+	}
+	return err
+}
+
+// Re-renders the pages which link to this one, once it's been inserted
+// or deleted.
+func (p *Page) updateDependents() error {
+	return rerenderBacklinks(p.Domain, p.Name)
+}
+
+// BrokenLinks returns the links in the domain's pages which point to
+// pages or files that don't exist.
+func BrokenLinks(domain string) ([]BrokenLink, error) {
+	iterator, err := GetList(&Page{Domain: domain})
+	if err != nil {
+		return nil, err
+	}
+	pages := []*Page{}
+	targets := map[string]bool{}
+	for iterator.Next() {
+		copied := *iterator.Value().(*Page)
+		pages = append(pages, &copied)
+		targets[linkTarget(copied.Name)] = true
+	}
+	if iterator.Err() != nil {
+		return nil, iterator.Err()
+	}
+
+	broken := []BrokenLink{}
+	for _, p := range pages {
+		links, err := store.Load(p.linksKey())
+		if err != nil {
+			return nil, err
+		}
+		for target := range links {
+			exists := targets[target] || generatedPaths[target]
+			if strings.HasPrefix(target, "files/") {
+				exists, err = store.Exists((&File{Domain: domain, Name: strings.TrimPrefix(target, "files/")}).Key())
+				if err != nil {
+					return nil, err
+				}
+			} else if target == PostsFolder || strings.HasPrefix(target, PostsFolder+"/") {
+				// The listings of blog posts are generated.
+				exists = exists || listingTarget.MatchString(target)
+			}
+			if !exists {
+				broken = append(broken, BrokenLink{Page: p.Name, Link: "/" + target})
+			}
+		}
+	}
+
+	sort.Slice(broken, func(i, j int) bool {
+		if broken[i].Page != broken[j].Page {
+			return broken[i].Page < broken[j].Page
+		}
+		return broken[i].Link < broken[j].Link
+	})
+	return broken, nil
+}
+
+// A LinkRewrite is a link in one of the user's pages which is changed to
+// keep it pointing at something which was renamed.
+type LinkRewrite struct {
+	Page string `json:"page"`
+	render.LinkChange
+}
+
+// Fixes up the links in the domain's pages after things have moved, and
+// re-renders the wiki links to the pages with the given new names. The
+// move has already happened by then, so a failure is only logged; the
+// old links still work, since they follow the redirects.
+func updateReferences(domain string, moves map[string]string, names ...string) {
+	_, err := rewriteReferences(domain, moves, true)
+	if err != nil {
+		log.Printf("Failed to rewrite the links to moved pages in `%s`: %v", domain, err)
+	}
+	err = rerenderBacklinks(domain, names...)
+	if err != nil {
+		log.Printf("Failed to render the wiki links to moved pages in `%s`: %v", domain, err)
+	}
+}
+
+// Rewrites the links in the domain's pages which point at things that
+// have moved. The moves map the old link targets to their new URLs. The
+// pages are only saved if save is set, otherwise the changes which would
+// be made are returned as a preview. Only the drafts are changed, so the
+// published copies keep their links until they're published again, and
+// visitors follow the redirects in the meantime.
+func rewriteReferences(domain string, moves map[string]string, save bool) ([]LinkRewrite, error) {
+	prototype := &Page{Domain: domain}
+	linking := map[string]bool{}
+	for target := range moves {
+		names, err := store.Members(prototype.backlinksKey(target))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			linking[name] = true
+		}
+	}
+	names := make([]string, 0, len(linking))
+	for name := range linking {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Wiki links name pages loosely, so they're matched by the loose form
+	// of the page's name.
+	wikiMoves := map[string]string{}
+	for target, path := range moves {
+		if !strings.HasPrefix(target, "files/") && strings.Trim(path, "/") != "" {
+			wikiMoves[wikiLinkName(target)] = strings.Trim(path, "/")
+		}
+	}
+
+	rewrites := []LinkRewrite{}
+	for _, name := range names {
+		p := &Page{Domain: domain, Name: name}
+		err := Load(p)
+		if IsStorageError(err) {
+			return nil, err
+		}
+		if err != nil {
+			continue
+		}
+
+		base := &url.URL{Path: PageURLPath(p.Name)}
+		rewriteURL := func(link string) (string, bool) {
+			u, err := url.Parse(link)
+			if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+				return link, false
+			}
+			path, ok := moves[linkTarget(base.ResolveReference(u).Path)]
+			if !ok {
+				return link, false
+			}
+			u.Path = path
+			return u.String(), true
+		}
+		rewriteWikiLink := func(target string) (string, bool) {
+			path, ok := wikiMoves[wikiLinkName(target)]
+			return path, ok
+		}
+
+		markdown, changes := render.RewriteLinks(p.Markdown, rewriteURL, rewriteWikiLink)
+		if len(changes) == 0 {
+			continue
+		}
+		for _, change := range changes {
+			rewrites = append(rewrites, LinkRewrite{Page: p.Name, LinkChange: change})
+		}
+		// A page which can't be saved, e.g. because somebody is editing
+		// it, keeps its old links, which follow the redirects. The rest
+		// of the pages are still fixed up.
+		if save {
+			p.Markdown = markdown
+			err = Save(p)
+			if IsStorageError(err) {
+				return nil, err
+			}
+			if err != nil {
+				log.Printf("Failed to rewrite links in `%s`: %v", p.Key(), err)
+			}
+		}
+	}
+	return rewrites, nil
+}
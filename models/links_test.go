@@ -0,0 +1,183 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWikiLinks(t *testing.T) {
+	about := &Page{Domain: "linkdomain", Name: "about_me.md", Markdown: "# About me"}
+	err := Insert(about)
+	if err != nil {
+		t.Fatalf("Failed to insert page: %v", err)
+	}
+
+	home := &Page{Domain: "linkdomain", Name: "index.md", Markdown: "See [[About Me]] and [[missing page|this]]."}
+	err = Insert(home)
+	if err != nil {
+		t.Fatalf("Failed to insert page: %v", err)
+	}
+	if !strings.Contains(home.HTML, `<a href="/about_me" class="wikilink">About Me</a>`) {
+		t.Fatalf("Expected a link to the existing page, got %v", home.HTML)
+	}
+	if !strings.Contains(home.HTML, `<a href="/missing_page" class="wikilink broken">this</a>`) {
+		t.Fatalf("Expected a broken link to the missing page, got %v", home.HTML)
+	}
+
+	names, err := about.Backlinks()
+	if err != nil || !reflect.DeepEqual(names, []string{"index.md"}) {
+		t.Fatalf("Expected the home page to link to about_me.md, got %v (%v)", names, err)
+	}
+
+	// Removing the link removes the backlink.
+	home.Markdown = "Nothing to see here."
+	err = Save(home)
+	if err != nil {
+		t.Fatalf("Failed to save page: %v", err)
+	}
+	if names, _ = about.Backlinks(); len(names) != 0 {
+		t.Fatalf("Expected no backlinks, got %v", names)
+	}
+}
+
+func TestWikiLinksFollowPages(t *testing.T) {
+	home := &Page{Domain: "wikifollow", Name: "index.md", Markdown: "See [[New Page]]."}
+	err := Insert(home)
+	if err != nil {
+		t.Fatalf("Failed to insert page: %v", err)
+	}
+	err = home.Publish()
+	if err != nil {
+		t.Fatalf("Failed to publish page: %v", err)
+	}
+	html := func(published bool) string {
+		p := &Page{Domain: "wikifollow", Name: "index.md", Published: published}
+		err := Load(p)
+		if err != nil {
+			t.Fatalf("Failed to load page: %v", err)
+		}
+		return p.HTML
+	}
+
+	// Creating the page fixes the link to it.
+	page := &Page{Domain: "wikifollow", Name: "new-page.md", Markdown: "New"}
+	err = Insert(page)
+	if err != nil {
+		t.Fatalf("Failed to insert page: %v", err)
+	}
+	if !strings.Contains(html(false), `<a href="/new-page" class="wikilink">New Page</a>`) {
+		t.Fatalf("Expected a link to the new page, got %v", html(false))
+	}
+	if !strings.Contains(html(true), "wikilink broken") {
+		t.Fatalf("Expected the published link to stay broken, got %v", html(true))
+	}
+	err = page.Publish()
+	if err != nil {
+		t.Fatalf("Failed to publish page: %v", err)
+	}
+	if !strings.Contains(html(true), `<a href="/new-page" class="wikilink">New Page</a>`) {
+		t.Fatalf("Expected a published link to the new page, got %v", html(true))
+	}
+
+	// Renaming the page rewrites the draft's link, and the published
+	// link goes through the redirect.
+	err = page.RenamePage("moved.md")
+	if err != nil {
+		t.Fatalf("Failed to rename page: %v", err)
+	}
+	if !strings.Contains(html(false), `<a href="/moved" class="wikilink">New Page</a>`) {
+		t.Fatalf("Expected a link to the moved page, got %v", html(false))
+	}
+	if !strings.Contains(html(true), `<a href="/new-page" class="wikilink">New Page</a>`) {
+		t.Fatalf("Expected the published link to be unchanged, got %v", html(true))
+	}
+
+	// Deleting the page breaks the link again.
+	err = Delete(page)
+	if err != nil {
+		t.Fatalf("Failed to delete page: %v", err)
+	}
+	if !strings.Contains(html(false), `<a href="/moved" class="wikilink broken">New Page</a>`) {
+		t.Fatalf("Expected the link to be broken, got %v", html(false))
+	}
+
+	other := &Page{Domain: "wikifollow", Name: "other.md", Markdown: "Other"}
+	err = Insert(other)
+	if err == nil {
+		err = other.Publish()
+	}
+	if err != nil {
+		t.Fatalf("Failed to publish page: %v", err)
+	}
+	err = Load(home)
+	if err == nil {
+		home.Markdown = "See [[Other]]."
+		err = Save(home)
+	}
+	if err == nil {
+		err = home.Publish()
+	}
+	if err != nil {
+		t.Fatalf("Failed to publish page: %v", err)
+	}
+	err = Delete(other)
+	if err != nil {
+		t.Fatalf("Failed to delete page: %v", err)
+	}
+	for _, published := range []bool{false, true} {
+		if !strings.Contains(html(published), `<a href="/other" class="wikilink broken">Other</a>`) {
+			t.Fatalf("Expected the link to be broken, got %v", html(published))
+		}
+	}
+}
+
+func TestBrokenLinks(t *testing.T) {
+	f := File{Domain: "brokendomain", Name: "photo.png"}
+	err := Insert(&f)
+	if err != nil {
+		t.Fatalf("Failed to insert file: %v", err)
+	}
+	pages := []*Page{
+		{Domain: "brokendomain", Name: "blog/index.md", Markdown: "[Home](/) [Other](other.md) [Gone](../gone)"},
+		{Domain: "brokendomain", Name: "index.md", Markdown: "![Photo](/files/photo.png) ![Lost](/files/lost.png) [Posts](/posts/page/2) [Feed](/feed.xml) [Out](https://example.com/gone)"},
+	}
+	for _, p := range pages {
+		err = Insert(p)
+		if err != nil {
+			t.Fatalf("Failed to insert page: %v", err)
+		}
+	}
+
+	broken, err := BrokenLinks("brokendomain")
+	if err != nil {
+		t.Fatalf("Failed to find broken links: %v", err)
+	}
+	expected := []BrokenLink{
+		{Page: "blog/index.md", Link: "/blog/other"},
+		{Page: "blog/index.md", Link: "/gone"},
+		{Page: "index.md", Link: "/files/lost.png"},
+	}
+	if !reflect.DeepEqual(broken, expected) {
+		t.Fatalf("Expected %v, got %v", expected, broken)
+	}
+
+	// Creating the missing page fixes the link to it. The links from a
+	// deleted page aren't reported any more, but links to it are.
+	err = Insert(&Page{Domain: "brokendomain", Name: "gone.md", Markdown: "Back again."})
+	if err != nil {
+		t.Fatalf("Failed to insert page: %v", err)
+	}
+	err = Delete(pages[1])
+	if err != nil {
+		t.Fatalf("Failed to delete page: %v", err)
+	}
+	expected = []BrokenLink{
+		{Page: "blog/index.md", Link: "/"},
+		{Page: "blog/index.md", Link: "/blog/other"},
+	}
+	broken, _ = BrokenLinks("brokendomain")
+	if !reflect.DeepEqual(broken, expected) {
+		t.Fatalf("Expected %v, got %v", expected, broken)
+	}
+}
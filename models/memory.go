@@ -0,0 +1,260 @@
+/*
+  memory.go
+
+  An implementation of the Store interface which keeps everything in
+  memory. It's handy for running the server or the tests without a redis
+  server, but everything is forgotten when the process exits.
+*/
+
+package models
+
+import (
+	"fmt"
+	"sync"
+)
+
+type memoryStore struct {
+	mutex    sync.Mutex
+	hashes   map[string]map[string]string
+	sets     map[string]map[string]bool
+	counters map[string]int
+}
+
+func newMemoryStore() *memoryStore {
+	s := &memoryStore{}
+	s.Clear()
+	return s
+}
+
+func (s *memoryStore) Exists(key string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.exists(key), nil
+}
+
+func (s *memoryStore) exists(key string) bool {
+	_, isHash := s.hashes[key]
+	_, isSet := s.sets[key]
+	_, isCounter := s.counters[key]
+	return isHash || isSet || isCounter
+}
+
+func (s *memoryStore) Load(key string) (map[string]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Return a copy, so that the caller can't modify the stored hash.
+	return copyHash(s.hashes[key]), nil
+}
+
+func copyHash(hash map[string]string) map[string]string {
+	result := make(map[string]string)
+	for field, value := range hash {
+		result[field] = value
+	}
+	return result
+}
+
+func (s *memoryStore) Save(key string, fields map[string]string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.save(key, fields)
+	return nil
+}
+
+func (s *memoryStore) save(key string, fields map[string]string) {
+	hash, ok := s.hashes[key]
+	if !ok {
+		hash = make(map[string]string)
+		s.hashes[key] = hash
+	}
+	for field, value := range fields {
+		hash[field] = value
+	}
+}
+
+func (s *memoryStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.delete(key)
+	return nil
+}
+
+func (s *memoryStore) delete(key string) {
+	delete(s.hashes, key)
+	delete(s.sets, key)
+	delete(s.counters, key)
+}
+
+func (s *memoryStore) Rename(oldKey, newKey string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rename(oldKey, newKey)
+}
+
+func (s *memoryStore) rename(oldKey, newKey string) error {
+	if !s.exists(oldKey) {
+		return errNoSuchKey
+	}
+
+	hash, isHash := s.hashes[oldKey]
+	set, isSet := s.sets[oldKey]
+	counter, isCounter := s.counters[oldKey]
+
+	s.delete(oldKey)
+	s.delete(newKey)
+
+	switch {
+	case isHash:
+		s.hashes[newKey] = hash
+	case isSet:
+		s.sets[newKey] = set
+	case isCounter:
+		s.counters[newKey] = counter
+	}
+	return nil
+}
+
+func (s *memoryStore) AddToSet(key, member string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.addToSet(key, member)
+	return nil
+}
+
+func (s *memoryStore) addToSet(key, member string) {
+	set, ok := s.sets[key]
+	if !ok {
+		set = make(map[string]bool)
+		s.sets[key] = set
+	}
+	set[member] = true
+}
+
+func (s *memoryStore) RemoveFromSet(key, member string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.removeFromSet(key, member)
+	return nil
+}
+
+func (s *memoryStore) removeFromSet(key, member string) {
+	set, ok := s.sets[key]
+	if !ok {
+		return
+	}
+	delete(set, member)
+
+	// Like redis, we won't keep empty sets around.
+	if len(set) == 0 {
+		delete(s.sets, key)
+	}
+}
+
+func (s *memoryStore) Members(key string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	members := make([]string, 0, len(s.sets[key]))
+	for member := range s.sets[key] {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (s *memoryStore) Increment(key string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.counters[key]++
+	return s.counters[key], nil
+}
+
+func (s *memoryStore) Clear() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.hashes = make(map[string]map[string]string)
+	s.sets = make(map[string]map[string]bool)
+	s.counters = make(map[string]int)
+	return nil
+}
+
+func (s *memoryStore) Apply(b *Batch) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := b.check(memoryReader{s})
+	if err != nil {
+		return err
+	}
+
+	// Take a copy of everything the batch touches, so that it can be
+	// put back if one of the writes fails.
+	backup := newMemoryStore()
+	touched := b.keys()
+	for _, key := range touched {
+		backup.copyKey(s, key)
+	}
+
+	for _, op := range b.ops {
+		err = s.apply(op)
+		if err != nil {
+			for _, key := range touched {
+				s.copyKey(backup, key)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads the store for checking batch preconditions, when the
+// mutex is already held.
+type memoryReader struct {
+	s *memoryStore
+}
+
+func (r memoryReader) exists(key string) (bool, error) {
+	return r.s.exists(key), nil
+}
+
+func (r memoryReader) field(key, field string) (string, error) {
+	return r.s.hashes[key][field], nil
+}
+
+func (s *memoryStore) apply(op batchOp) error {
+	switch op.command {
+	case "HMSET":
+		s.save(op.key, op.fields)
+	case "DEL":
+		s.delete(op.key)
+	case "RENAME":
+		return s.rename(op.key, op.arg)
+	case "SADD":
+		s.addToSet(op.key, op.arg)
+	case "SREM":
+		s.removeFromSet(op.key, op.arg)
+	default:
+		return fmt.Errorf("unknown batch command `%s`", op.command)
+	}
+	return nil
+}
+
+// Replaces whatever is stored at key with a copy of the value stored
+// at the same key in another memory store.
+func (s *memoryStore) copyKey(from *memoryStore, key string) {
+	s.delete(key)
+	if hash, ok := from.hashes[key]; ok {
+		s.hashes[key] = copyHash(hash)
+	}
+	if set, ok := from.sets[key]; ok {
+		s.sets[key] = make(map[string]bool)
+		for member := range set {
+			s.sets[key][member] = true
+		}
+	}
+	if counter, ok := from.counters[key]; ok {
+		s.counters[key] = counter
+	}
+}
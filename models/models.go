@@ -8,15 +8,13 @@ import (
 	"strconv"
 
 	"github.com/colin353/markdown.ninja/config"
-	"github.com/mediocregopher/radix.v2/pool"
-	"github.com/mediocregopher/radix.v2/redis"
 )
 
 // AppConfig is an instance of the application config.
 var AppConfig *config.Config
 
 // Model is the basic interface required for an object to be
-// saved to the redis store. Fundamentally, you need a function
+// saved to the store. Fundamentally, you need a function
 // which generates a unique key for that individual structure
 // (typically prefixed by the table name, for example tablename:identifier)
 // and a validation function to check if the data is correct. Also, you need
@@ -30,118 +28,113 @@ type Model interface {
 	Export() map[string]interface{}
 }
 
-// A ModelIterator is an iterator over a list of models.
-type ModelIterator interface {
-	Next() bool
-	Value() Model
-	Count() int
+// A RevisionedModel is a model which keeps count of how many times it
+// has been saved. When saving, the revision is compared against the one
+// stored in the database, and if they don't match (because somebody else
+// saved the model in the meantime) the save fails with a RevisionConflict.
+// RevisionCounter returns a pointer to the model's revision field, which
+// must be stored under the name "revision".
+type RevisionedModel interface {
+	Model
+	RevisionCounter() *int
 }
 
-var connectionPool *pool.Pool
+// A model which keeps related records (like the revision history of a
+// page) adds the writes for them to the same batch which saves or deletes
+// the model, so that they can't get out of step with each other.
+type relatedRecords interface {
+	saveRelated(b *Batch) error
+	deleteRelated(b *Batch) error
+}
 
-// This function gets and returns a redis client object. If we are
-// currently in test mode, we'll make sure to select the test database,
-// which is redis database 1. Otherwise, we're in production, so we'll
-// use the permanent database 0 (default).
-func getRedisConnection() (*redis.Client, error) {
-	p, err := connectionPool.Get()
-	if err != nil {
-		return nil, err
-	}
-	if AppConfig.Mode == "test" || AppConfig.Mode == "testing" {
-		response := p.Cmd("SELECT", 1)
-		if response.Err != nil {
-			log.Fatalf("Unable to select testing database: %v", response.Err.Error())
-			return nil, response.Err
-		}
-	}
+// A model which derives some of its fields from the others (like the
+// HTML of a page, which is rendered from its markdown) updates them
+// just before it's saved.
+type derivedFields interface {
+	updateDerivedFields() error
+}
 
-	return p, err
+// A model which other records are rendered from (like a page, which
+// other pages' wiki links point at) updates those records after it's
+// inserted or deleted.
+type dependentRecords interface {
+	updateDependents() error
 }
 
-// Connect to the redis database and create a connection pool, which can be used
-// to query the redis database concurrently.
-func Connect() {
-	var err error
-	connectionPool, err = pool.New("tcp", AppConfig.RedisURL, 10)
-	if err != nil {
-		log.Fatal("Unable to connect to redis server.")
-	}
+// A RevisionConflict is returned when trying to save a model which has
+// been changed in the database since it was loaded.
+type RevisionConflict struct {
+	Key      string
+	Expected int
+	Current  int
 }
 
-// ClearDatabase deletes all the keys in the database. As a precautionary
-// measure, it also selects database 1, which is designated as the testing
-// database.
-func ClearDatabase() {
-	p, err := getRedisConnection()
-	if err != nil {
-		log.Fatal("Couldn't connect to the redis database.")
-	}
-	response := p.Cmd("SELECT", 1)
-	if response.Err != nil {
-		log.Fatal("Unable to select testing database, terminating.")
-	}
+func (e *RevisionConflict) Error() string {
+	return fmt.Sprintf("Key `%s` is at revision %d, but expected revision %d", e.Key, e.Current, e.Expected)
+}
+
+// IsRevisionConflict reports whether err was caused by saving a model
+// which had been changed by somebody else.
+func IsRevisionConflict(err error) bool {
+	_, ok := err.(*RevisionConflict)
+	return ok
+}
 
-	// Clear all keys in the database. This command cannot fail,
-	// according to redis docs.
-	p.Cmd("FLUSHDB")
+// A ModelIterator is an iterator over a list of models. If Next
+// returns false, Err reports whether the iteration stopped because
+// the database failed, rather than reaching the end of the list.
+type ModelIterator interface {
+	Next() bool
+	Value() Model
+	Count() int
+	Err() error
+}
+
+// ClearDatabase deletes all the records in the database. It's meant
+// to be used when starting up in test mode.
+func ClearDatabase() error {
+	return store.Clear()
 }
 
-// MakeKeyForTable creates a unique key for a table by using the redis INCR
-// command on the key:tablename field. If you aren't sure what key to give
+// MakeKeyForTable creates a unique key for a table by incrementing the
+// key:tablename counter. If you aren't sure what key to give
 // a new object, use MakeKeyForTable and give a string for the table name,
 // and you'll be guaranteed a unique key.
-func MakeKeyForTable(table string) string {
-	p, err := getRedisConnection()
+func MakeKeyForTable(table string) (string, error) {
+	id, err := store.Increment(fmt.Sprintf("key:%s", table))
 	if err != nil {
-		log.Fatal("Couldn't connect to the redis database.")
-	}
-	response := p.Cmd("INCR", fmt.Sprintf("key:%s", table))
-	return response.String()
-}
-
-// This function takes a reflection value and sets the value based upon
-// its internal type and the associated redis string.
-func setFieldWithRedisString(v *reflect.Value, value string) {
-	switch fieldType := v.Interface().(type) {
-	case bool:
-		result, err := strconv.ParseBool(value)
-		if err != nil {
-			log.Printf("Unable to convert %T while loading from redis model.\n", fieldType)
-			return
-		}
-		v.SetBool(result)
-	case int:
-		result, err := strconv.ParseInt(value, 10, 0)
-		if err != nil {
-			log.Printf("Unable to convert %T while loading from redis model.\n", fieldType)
-			return
-		}
-		v.SetInt(result)
-	case string:
-		v.SetString(value)
-	default:
-		panic(fmt.Sprintf("Unexpected type (%T) received while decoding redis model.", fieldType))
+		return "", err
 	}
+	return strconv.Itoa(id), nil
 }
 
 // Delete removes a model from the database.
 func Delete(m Model) error {
-	p, err := getRedisConnection()
+	b, err := deleteBatch(m)
 	if err != nil {
-		log.Fatal("Couldn't connect to the redis database.")
 		return err
 	}
-
-	// Delete the hash.
-	result := p.Cmd("DEL", m.Key())
-	if result.Err != nil {
-		return result.Err
+	err = store.Apply(b)
+	if err != nil {
+		return err
 	}
+	updateDependents(m)
+	return nil
+}
 
-	// Also, delete the member from the set.
-	result = p.Cmd("SREM", m.RegistrationKey(), m.Key())
-	return result.Err
+// Makes a batch which deletes the model, along with any related records.
+func deleteBatch(m Model) (*Batch, error) {
+	// Delete the hash, and also the member from the set.
+	b := &Batch{}
+	b.Delete(m.Key())
+	b.RemoveFromSet(m.RegistrationKey(), m.Key())
+	if r, ok := m.(relatedRecords); ok {
+		err := r.deleteRelated(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
 }
 
 // UpdateWithChanges for when you only have a limited set of changes to make to the database,
@@ -157,15 +150,24 @@ func UpdateWithChanges(m Model, changes map[string]interface{}) error {
 	for i := 0; i < instanceValue.NumField(); i++ {
 		t := instanceType.Field(i)
 		v := instanceValue.Field(i)
-		fieldName := t.Tag.Get("json")
+		fieldName := storedFieldName(t)
+		if fieldName == "" {
+			continue
+		}
 
 		// Check if the field is in the list of proposed changes.
 		updatedValue, ok := changes[fieldName]
 		if !ok {
 			continue
 		}
-		acceptedChanges[fieldName] = fmt.Sprintf("%v", updatedValue)
-		setFieldWithRedisString(&v, acceptedChanges[fieldName])
+		err := setFieldFromChange(v, t, updatedValue)
+		if err != nil {
+			return err
+		}
+		acceptedChanges[fieldName], err = encodeField(v, t)
+		if err != nil {
+			return err
+		}
 	}
 
 	if !m.Validate() {
@@ -173,15 +175,7 @@ func UpdateWithChanges(m Model, changes map[string]interface{}) error {
 	}
 
 	// Okay, the changes are fine to apply to the database.
-	p, err := getRedisConnection()
-	if err != nil {
-		log.Fatal("couldn't connect to the redis database")
-		return err
-	}
-
-	p.Cmd("HMSET", m.Key(), acceptedChanges)
-
-	return nil
+	return store.Save(m.Key(), acceptedChanges)
 }
 
 // Save takes an instance of a model and saves it to the database.
@@ -190,6 +184,38 @@ func Save(m Model) error {
 	return saveOrInsert(m, true)
 }
 
+// SaveFields saves only the named fields of a model, which must already
+// exist. The rest of the stored model is left alone, so that fields which
+// are kept up to date elsewhere (like the space a user's files take up)
+// aren't overwritten with whatever the model held when it was loaded.
+func SaveFields(m Model, fields ...string) error {
+	if !m.Validate() {
+		return errors.New("model failed to validate")
+	}
+
+	instanceMap, err := encodeModel(m)
+	if err != nil {
+		return err
+	}
+	changes := map[string]string{}
+	for _, field := range fields {
+		value, ok := instanceMap[field]
+		if !ok {
+			return fmt.Errorf("Model `%s` has no field `%s`", m.Key(), field)
+		}
+		changes[field] = value
+	}
+
+	b := &Batch{}
+	b.RequireExists(m.Key())
+	b.Save(m.Key(), changes)
+	err = store.Apply(b)
+	if _, ok := err.(*PreconditionError); ok {
+		return fmt.Errorf("Key `%s` doesn't exist: can't save. Did you mean to insert?", m.Key())
+	}
+	return err
+}
+
 // Insert creates a new instance of a model in the database. It'll
 // return an error if the key already exists.
 func Insert(m Model) error {
@@ -197,16 +223,23 @@ func Insert(m Model) error {
 	if err != nil {
 		return err
 	}
+	updateDependents(m)
+	return nil
+}
 
-	// Now, register the RegistrationKey into the registration set.
-	p, err := getRedisConnection()
+// Updates the records which depend on the model, after it's been
+// inserted or deleted. The model itself has already changed by then, so
+// a failure is only logged; the records are updated again the next time
+// they're saved.
+func updateDependents(m Model) {
+	d, ok := m.(dependentRecords)
+	if !ok {
+		return
+	}
+	err := d.updateDependents()
 	if err != nil {
-		log.Fatal("Couldn't connect to the redis database.")
-		return err
+		log.Printf("Failed to update the records which depend on `%s`: %v", m.Key(), err)
 	}
-	p.Cmd("SADD", m.RegistrationKey(), m.Key())
-
-	return nil
 }
 
 // ModelList is an implementation of a ModelIterator.
@@ -214,24 +247,41 @@ type ModelList struct {
 	Prototype Model
 	Keys      []string
 	Index     int
+	err       error
 }
 
 // Next loads the next value in the iterator, and returns
 // true if it succeeded. To get the value, do m.Value().
 func (m *ModelList) Next() bool {
-	if m.Index >= len(m.Keys) {
+	if m.err != nil || m.Index >= len(m.Keys) {
 		return false
 	}
+
+	// The prototype is reused for every model, so its stored fields
+	// need to be cleared out, or fields which are missing from this
+	// model would keep the values from the last one.
+	clearStoredFields(m.Prototype)
 	err := LoadFromKey(m.Prototype, m.Keys[m.Index])
 	m.Index++
 
-	// If there is an error loading a key, skip ahead.
+	// If the database has failed, there's no point continuing. But
+	// if there is some other error loading a key, skip ahead.
+	if IsStorageError(err) {
+		m.err = err
+		return false
+	}
 	if err != nil {
 		return m.Next()
 	}
 	return true
 }
 
+// Err returns the error which stopped the iteration early, if
+// there was one.
+func (m *ModelList) Err() error {
+	return m.err
+}
+
 // Value returns the currently-pointed-to value for the
 // iterator.
 func (m *ModelList) Value() Model {
@@ -248,20 +298,12 @@ func (m *ModelList) Count() int {
 // Actually it returns a ModelIterator, which you can call "Next()" on
 // any number of times.
 func GetList(m Model) (ModelIterator, error) {
-	p, err := getRedisConnection()
-	if err != nil {
-		log.Fatal("couldn't connect to the redis database")
-		return nil, err
-	}
-
-	result := p.Cmd("SMEMBERS", m.RegistrationKey())
-
-	keys, err := result.List()
+	keys, err := store.Members(m.RegistrationKey())
 	if err != nil {
 		return nil, err
 	}
 
-	return &ModelList{Prototype: m, Keys: keys}, result.Err
+	return &ModelList{Prototype: m, Keys: keys}, nil
 }
 
 func saveOrInsert(m Model, expectKey bool) error {
@@ -270,49 +312,153 @@ func saveOrInsert(m Model, expectKey bool) error {
 		return errors.New("model failed to validate")
 	}
 
-	p, err := getRedisConnection()
+	if d, ok := m.(derivedFields); ok {
+		err := d.updateDerivedFields()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Models with revisions are saved with the next revision number, but
+	// only if nobody else has saved a new revision since this one was
+	// loaded. New models start at revision 1.
+	revision, hasRevision := revisionCounter(m)
+	expectedRevision, originalRevision := 0, 0
+	if hasRevision {
+		originalRevision = *revision
+		if expectKey {
+			expectedRevision = originalRevision
+		}
+		*revision = expectedRevision + 1
+	}
+
+	b := &Batch{}
+	if expectKey && hasRevision {
+		b.RequireCounter(m.Key(), "revision", expectedRevision)
+	} else if expectKey {
+		b.RequireExists(m.Key())
+	} else {
+		b.RequireMissing(m.Key())
+	}
+
+	// New models are also registered into the registration set.
+	if !expectKey {
+		b.AddToSet(m.RegistrationKey(), m.Key())
+	}
+
+	err := saveBatch(b, m)
+	if hasRevision {
+		*revision = originalRevision
+	}
 	if err != nil {
-		log.Fatal("Couldn't connect to the redis database.")
 		return err
 	}
 
-	// Create a map[string]string reperesnting all the data in
-	// the instance.
+	err = store.Apply(b)
+	if err == nil && hasRevision {
+		*revision = expectedRevision + 1
+	}
+	if e, ok := err.(*PreconditionError); ok {
+		if e.Field == "revision" {
+			return &RevisionConflict{Key: m.Key(), Expected: expectedRevision, Current: e.Value}
+		}
+		if expectKey {
+			return fmt.Errorf("Key `%s` doesn't exist: can't save. Did you mean to insert?", m.Key())
+		}
+		return fmt.Errorf("Key `%s` already exists: can't insert. Did you mean to save?", m.Key())
+	}
+	return err
+}
+
+// Adds the writes which save the model, and any related records, to
+// the batch.
+func saveBatch(b *Batch, m Model) error {
+	instanceMap, err := encodeModel(m)
+	if err != nil {
+		return err
+	}
+	b.Save(m.Key(), instanceMap)
+
+	if r, ok := m.(relatedRecords); ok {
+		return r.saveRelated(b)
+	}
+	return nil
+}
+
+func revisionCounter(m Model) (*int, bool) {
+	r, ok := m.(RevisionedModel)
+	if !ok {
+		return nil, false
+	}
+	return r.RevisionCounter(), true
+}
+
+// Makes a batch which moves a model from its old key to its current key.
+// The whole thing has to happen at once, or we might end up with the
+// model registered under both keys, or neither of them.
+func renameBatch(m Model, oldKey string) (*Batch, error) {
+	instanceMap, err := encodeModel(m)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Batch{}
+	b.RequireExists(oldKey)
+	b.RequireMissing(m.Key())
+
+	// Models with revisions can't be renamed if they've been changed
+	// since they were loaded.
+	if revision, ok := revisionCounter(m); ok {
+		b.RequireCounter(oldKey, "revision", *revision)
+	}
+
+	// Step one: rename the old key to the new key.
+	b.Rename(oldKey, m.Key())
+
+	// Take the registration pool and delete the old key
+	// and add a new key.
+	b.RemoveFromSet(m.RegistrationKey(), oldKey)
+	b.AddToSet(m.RegistrationKey(), m.Key())
+
+	// Save the object with the new parameters.
+	b.Save(m.Key(), instanceMap)
+	return b, nil
+}
+
+// Create a map[string]string reperesnting all the data in
+// the instance.
+func encodeModel(m Model) (map[string]string, error) {
 	instanceMap := make(map[string]string)
 	instanceValue := reflect.ValueOf(m).Elem()
 	instanceType := reflect.TypeOf(m).Elem()
 	for i := 0; i < instanceValue.NumField(); i++ {
 		t := instanceType.Field(i)
 		v := instanceValue.Field(i)
-		fieldName := t.Tag.Get("json")
+		fieldName := storedFieldName(t)
 
 		if fieldName == "" {
 			continue
 		}
-		instanceMap[fieldName] = fmt.Sprintf("%v", v.Interface())
-	}
-
-	response := p.Cmd("EXISTS", m.Key())
-	if response.Err != nil {
-		log.Fatal("Error executing redis existence check command.")
-		return err
-	}
-
-	keyAlreadyExists, _ := response.Int()
-	if !expectKey && keyAlreadyExists == 1 {
-		return fmt.Errorf("Key `%s` already exists: can't insert. Did you mean to save?", m.Key())
-	}
-	if expectKey && keyAlreadyExists == 0 {
-		return fmt.Errorf("Key `%s` doesn't exist: can't save. Did you mean to insert?", m.Key())
+		value, err := encodeField(v, t)
+		if err != nil {
+			return nil, err
+		}
+		instanceMap[fieldName] = value
 	}
+	return instanceMap, nil
+}
 
-	response = p.Cmd("HMSET", m.Key(), instanceMap)
-	if response.Err != nil {
-		log.Fatal("Error executing redis save command.")
-		return err
+// Resets all the fields of the model which are stored in the database
+// to their zero values. Other fields are left alone.
+func clearStoredFields(m Model) {
+	instanceValue := reflect.ValueOf(m).Elem()
+	instanceType := reflect.TypeOf(m).Elem()
+	for i := 0; i < instanceValue.NumField(); i++ {
+		if storedFieldName(instanceType.Field(i)) != "" {
+			v := instanceValue.Field(i)
+			v.Set(reflect.Zero(v.Type()))
+		}
 	}
-
-	return nil
 }
 
 // Load takes a partially filled out Model struct, searches for it in the
@@ -322,27 +468,16 @@ func Load(m Model) error {
 }
 
 // LoadFromKey takes a model and a key string,
-// and searches in the redis database for that object, then fills out
+// and searches in the database for that object, then fills out
 // the object fields with whatever is in the database. For any fields
 // which don't exist in the database, it uses m.MakeDefault() to set
 // fields to their default values.
 func LoadFromKey(m Model, key string) error {
 	m.MakeDefault()
 
-	p, err := getRedisConnection()
+	instanceMap, err := store.Load(key)
 	if err != nil {
-		log.Print("couldn't connect to the redis database")
-		return err
-	}
-	response := p.Cmd("HGETALL", key)
-	if err != nil {
-		log.Print("error executing redis load command (HGETALL)")
-		return err
-	}
-
-	instanceMap, err := response.Map()
-	if err != nil {
-		log.Printf("Unable to unwind key '%s' in redis as a map (!)", key)
+		log.Printf("Unable to load key '%s' from the database as a map (!)", key)
 		return err
 	}
 	// Check if there are no keys in the map: that means it doesn't exist.
@@ -356,7 +491,7 @@ func LoadFromKey(m Model, key string) error {
 	for i := 0; i < instanceValue.NumField(); i++ {
 		t := instanceType.Field(i)
 		v := instanceValue.Field(i)
-		fieldName := t.Tag.Get("json")
+		fieldName := storedFieldName(t)
 
 		// Only fields with JSON names will be loaded. Also, we use
 		// the key field in the lookup, so it doesn't need to be loaded.
@@ -371,7 +506,12 @@ func LoadFromKey(m Model, key string) error {
 			continue
 		}
 
-		setFieldWithRedisString(&v, value)
+		// If the stored value can't be decoded (e.g. because the type
+		// of the field changed), we'll leave the default in place.
+		err = decodeField(v, t, value)
+		if err != nil {
+			log.Printf("Unable to decode field `%s` of key '%s': %v", fieldName, key, err)
+		}
 	}
 
 	return nil
@@ -1,15 +1,28 @@
 package models
 
 import (
+	"log"
 	"os"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/colin353/markdown.ninja/config"
 )
 
 func init() {
 	AppConfig = config.LoadConfig("../config")
-	Connect()
+
+	// Unless a particular database backend was requested through the
+	// environment, run the tests in memory so that they don't need a
+	// redis server.
+	if os.Getenv(config.EnvPrefix+"DATABASE") == "" {
+		AppConfig.Database = "memory"
+	}
+	err := Connect()
+	if err != nil {
+		log.Fatalf("Unable to connect to the database: %v", err)
+	}
 
 	// A quirk of the test running software is that it is running
 	// in the CWD. The configuration files always reference things
@@ -19,7 +32,10 @@ func init() {
 
 	// Delete all the records in the database.
 	AppConfig.Mode = "testing"
-	ClearDatabase()
+	err = ClearDatabase()
+	if err != nil {
+		log.Fatalf("Unable to clear the database: %v", err)
+	}
 }
 
 type TestStructure struct {
@@ -52,12 +68,19 @@ func (s *TestStructure) Key() string {
 	if s.KeyStr != "" {
 		return s.KeyStr
 	}
-	return "test:" + MakeKeyForTable("test")
+	key, _ := MakeKeyForTable("test")
+	return "test:" + key
 }
 
 func TestKeyCreation(t *testing.T) {
-	a := MakeKeyForTable("teststructure")
-	b := MakeKeyForTable("teststructure")
+	a, err := MakeKeyForTable("teststructure")
+	if err != nil {
+		t.Fatalf("Couldn't make key: %v", err)
+	}
+	b, err := MakeKeyForTable("teststructure")
+	if err != nil {
+		t.Fatalf("Couldn't make key: %v", err)
+	}
 
 	if a == b {
 		t.Fatalf(
@@ -232,3 +255,111 @@ func TestSaving(t *testing.T) {
 		t.Fatalf("Should have raised a validation error, but didn't.")
 	}
 }
+
+type Metadata struct {
+	Author string `json:"author"`
+	Pages  int    `json:"pages"`
+}
+
+type RichStructure struct {
+	KeyStr   string            `json:"key"`
+	Created  time.Time         `json:"created"`
+	Bytes    int64             `json:"bytes"`
+	Visits   uint              `json:"visits"`
+	Score    float64           `json:"score"`
+	Tags     []string          `json:"tags"`
+	Headers  map[string]string `json:"headers"`
+	Metadata Metadata          `json:"metadata" model:"json"`
+	Ignored  string            `json:"-"`
+}
+
+func (s *RichStructure) MakeDefault()                   {}
+func (s *RichStructure) Export() map[string]interface{} { return nil }
+func (s *RichStructure) RegistrationKey() string        { return "richtests" }
+func (s *RichStructure) Validate() bool                 { return true }
+func (s *RichStructure) Key() string                    { return s.KeyStr }
+
+func TestRichFieldTypes(t *testing.T) {
+	created := time.Date(2017, 3, 14, 15, 9, 26, 535897932, time.FixedZone("EST", -5*60*60))
+	s := RichStructure{
+		KeyStr:   "rich:001",
+		Created:  created,
+		Bytes:    1 << 40,
+		Visits:   42,
+		Score:    0.1,
+		Tags:     []string{"go", "comma, separated", ""},
+		Headers:  map[string]string{"X-Test": "yes"},
+		Metadata: Metadata{Author: "Johnny", Pages: 3},
+		Ignored:  "not stored",
+	}
+	Delete(&s)
+	err := Insert(&s)
+	if err != nil {
+		t.Fatalf("Failed to insert structure with rich types: %v", err)
+	}
+
+	g := RichStructure{KeyStr: "rich:001"}
+	err = Load(&g)
+	if err != nil {
+		t.Fatalf("Failed to load structure with rich types: %v", err)
+	}
+
+	if !g.Created.Equal(created) {
+		t.Errorf("Time didn't round-trip: got %v, expected %v", g.Created, created)
+	}
+	if g.Bytes != 1<<40 || g.Visits != 42 || g.Score != 0.1 {
+		t.Errorf("Numbers didn't round-trip: got %v, %v, %v", g.Bytes, g.Visits, g.Score)
+	}
+	if !reflect.DeepEqual(g.Tags, s.Tags) {
+		t.Errorf("Slice didn't round-trip: got %#v", g.Tags)
+	}
+	if !reflect.DeepEqual(g.Headers, s.Headers) {
+		t.Errorf("Map didn't round-trip: got %#v", g.Headers)
+	}
+	if g.Metadata != s.Metadata {
+		t.Errorf("Nested struct didn't round-trip: got %#v", g.Metadata)
+	}
+	if g.Ignored != "" {
+		t.Errorf("Fields tagged with json:\"-\" shouldn't be stored.")
+	}
+
+	// Changes usually come straight from decoded JSON, so numbers will
+	// be float64s and lists will be []interface{}.
+	err = UpdateWithChanges(&g, map[string]interface{}{
+		"bytes":    float64(2048),
+		"tags":     []interface{}{"updated"},
+		"created":  "2018-01-01T00:00:00Z",
+		"metadata": map[string]interface{}{"author": "Jane", "pages": 5},
+	})
+	if err != nil {
+		t.Fatalf("Failed to update rich types: %v", err)
+	}
+
+	h := RichStructure{KeyStr: "rich:001"}
+	Load(&h)
+	if h.Bytes != 2048 || len(h.Tags) != 1 || h.Tags[0] != "updated" {
+		t.Errorf("Updates didn't get saved: got %v, %v", h.Bytes, h.Tags)
+	}
+	if h.Created.Year() != 2018 || h.Metadata.Author != "Jane" || h.Metadata.Pages != 5 {
+		t.Errorf("Updates didn't get saved: got %v, %#v", h.Created, h.Metadata)
+	}
+	if h.Score != 0.1 {
+		t.Errorf("Fields that weren't changed shouldn't be touched, got score %v", h.Score)
+	}
+
+	err = UpdateWithChanges(&h, map[string]interface{}{"visits": "lots"})
+	if err == nil {
+		t.Errorf("Should not be able to set a uint field to a word.")
+	}
+}
+
+func TestUnsupportedFieldType(t *testing.T) {
+	type Unsupported struct {
+		RichStructure
+		Nested Metadata `json:"nested"`
+	}
+	_, err := encodeModel(&Unsupported{})
+	if err == nil {
+		t.Errorf("Structs without the json model tag shouldn't be stored.")
+	}
+}
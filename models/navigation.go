@@ -0,0 +1,168 @@
+/*
+  navigation.go
+
+  A site can show a navigation menu, listing its published pages. The
+  user decides whether the menu is shown, the order of the pages in it,
+  and which pages are left out.
+*/
+
+package models
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Navigation stores a user's settings for their site's menu. It's
+// stored in the database under the key:
+//    navigation:[domain]
+// Pages which aren't mentioned in Order come after the ones that are,
+// ordered by their weight and then by name.
+type Navigation struct {
+	Domain  string   `json:"domain"`
+	Enabled bool     `json:"enabled"`
+	Order   []string `json:"order"`
+	Hidden  []string `json:"hidden"`
+}
+
+// A MenuItem is a link to one of the pages in the navigation menu.
+type MenuItem struct {
+	Title string
+	Path  string
+}
+
+// MakeDefault sets default values for the navigation settings.
+func (n *Navigation) MakeDefault() {
+	if n.Order == nil {
+		n.Order = []string{}
+	}
+	if n.Hidden == nil {
+		n.Hidden = []string{}
+	}
+}
+
+// Export returns the fields which are acceptable to send directly to
+// the client over the web.
+func (n *Navigation) Export() map[string]interface{} {
+	return map[string]interface{}{
+		"enabled": n.Enabled,
+		"order":   n.Order,
+		"hidden":  n.Hidden,
+	}
+}
+
+// RegistrationKey defines the set to which the navigation settings
+// will belong. All users' settings are siblings.
+func (n *Navigation) RegistrationKey() string {
+	return "navigation"
+}
+
+// Key returns a unique key for use in the redis database.
+func (n *Navigation) Key() string {
+	return fmt.Sprintf("navigation:%s", n.Domain)
+}
+
+// Validate checks that the settings only refer to valid page names.
+func (n *Navigation) Validate() bool {
+	if !domainValidator.MatchString(n.Domain) {
+		log.Printf("Validation failed on navigation, illegal domain '%s'\n", n.Domain)
+		return false
+	}
+
+	for _, name := range append(append([]string{}, n.Order...), n.Hidden...) {
+		if !ValidPagePath(name) {
+			log.Printf("Validation failed on navigation for %s, illegal page '%s'\n", n.Domain, name)
+			return false
+		}
+	}
+
+	return true
+}
+
+// PageURLPath returns the path at which a page is served, e.g. the page
+// blog/hello.md is at /blog/hello and blog/index.md is at /blog/.
+func PageURLPath(name string) string {
+	if name == "index.md" {
+		return "/"
+	}
+	if strings.HasSuffix(name, "/index.md") {
+		return "/" + strings.TrimSuffix(name, "index.md")
+	}
+	return "/" + strings.TrimSuffix(name, ".md")
+}
+
+// DisplayTitle returns the title of the page to show in menus and
+// listings. Pages without a title in their front matter are named after
+// their file or folder.
+func (p *Page) DisplayTitle() string {
+	if p.Title != "" {
+		return p.Title
+	}
+	if p.Name == "index.md" {
+		return "Home"
+	}
+	return path.Base(strings.TrimSuffix(PageURLPath(p.Name), "/"))
+}
+
+// Menu returns the items of the navigation menu for the given pages,
+// in order, leaving out the hidden ones.
+func (n *Navigation) Menu(pages []*Page) []MenuItem {
+	position := map[string]int{}
+	for i, name := range n.Order {
+		position[name] = i
+	}
+	hidden := map[string]bool{}
+	for _, name := range n.Hidden {
+		hidden[name] = true
+	}
+
+	shown := []*Page{}
+	for _, p := range pages {
+		if !hidden[p.Name] {
+			shown = append(shown, p)
+		}
+	}
+	sort.Slice(shown, func(i, j int) bool {
+		a, aOrdered := position[shown[i].Name]
+		b, bOrdered := position[shown[j].Name]
+		if aOrdered || bOrdered {
+			return aOrdered && (!bOrdered || a < b)
+		}
+		if shown[i].Weight != shown[j].Weight {
+			return shown[i].Weight < shown[j].Weight
+		}
+		return shown[i].Name < shown[j].Name
+	})
+
+	items := make([]MenuItem, 0, len(shown))
+	for _, p := range shown {
+		items = append(items, MenuItem{Title: p.DisplayTitle(), Path: PageURLPath(p.Name)})
+	}
+	return items
+}
+
+// PublishedPages returns all of the pages that are listed on the site.
+// Pages which are unlisted, protected by a password or private are left
+// out.
+func PublishedPages(domain string) ([]*Page, error) {
+	rules, err := LoadAccessRules(domain)
+	if err != nil {
+		return nil, err
+	}
+	iterator, err := GetList(&Page{Published: true, Domain: domain})
+	if err != nil {
+		return nil, err
+	}
+
+	pages := []*Page{}
+	for iterator.Next() {
+		copied := *iterator.Value().(*Page)
+		if rules.For(domain, copied.Name).Listed() {
+			pages = append(pages, &copied)
+		}
+	}
+	return pages, iterator.Err()
+}
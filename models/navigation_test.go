@@ -0,0 +1,48 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPageURLPath(t *testing.T) {
+	paths := map[string]string{
+		"index.md":        "/",
+		"about.md":        "/about",
+		"blog/index.md":   "/blog/",
+		"blog/hello.md":   "/blog/hello",
+		"blog/2026/notes": "/blog/2026/notes",
+		"blog/myindex.md": "/blog/myindex",
+	}
+	for name, expected := range paths {
+		if path := PageURLPath(name); path != expected {
+			t.Errorf("Expected %s to be served at %s, got %s", name, expected, path)
+		}
+	}
+}
+
+func TestNavigationMenu(t *testing.T) {
+	pages := []*Page{
+		{Name: "index.md"},
+		{Name: "about.md", Title: "About me"},
+		{Name: "blog/index.md"},
+		{Name: "contact.md", Weight: -1},
+		{Name: "secret.md"},
+		{Name: "zebra.md"},
+	}
+	n := &Navigation{
+		Order:  []string{"about.md", "index.md", "deleted.md"},
+		Hidden: []string{"secret.md"},
+	}
+
+	expected := []MenuItem{
+		{"About me", "/about"},
+		{"Home", "/"},
+		{"contact", "/contact"},
+		{"blog", "/blog/"},
+		{"zebra", "/zebra"},
+	}
+	if menu := n.Menu(pages); !reflect.DeepEqual(menu, expected) {
+		t.Fatalf("Unexpected menu: %v", menu)
+	}
+}
@@ -4,20 +4,57 @@ import (
 	"fmt"
 	"log"
 	"regexp"
+	"strings"
+	"time"
+
+	"github.com/colin353/markdown.ninja/render"
 )
 
 // A Page is an HTML/markdown file. The HTML is used for
-// rendering, and the markdown is used for editing. It's
+// rendering, and the markdown is used for editing. The HTML is
+// always rendered from the markdown when the page is saved. It's
 // stored in the database under the key:
 //    pages:[domain]:page_name
 // and a list of those keys are stored under the
 //    pages:[domain]
-// list.
+// list. Each time the page is saved, a copy of it is kept as a
+// PageRevision, recording who it was edited by.
+//
+// Saving a page only changes its draft. When the page is published, a
+// copy of the draft is stored under the key:
+//    published:[domain]:page_name
+// which is the only version that visitors to the site can see.
 type Page struct {
+	// Published selects the published copy of the page, rather than
+	// the draft. It isn't stored, since it's part of the key.
+	Published bool `json:"-"`
+
 	Domain   string `json:"domain"`
 	Name     string `json:"name"`
 	Markdown string `json:"markdown"`
 	HTML     string `json:"html"`
+	Revision int    `json:"revision"`
+	EditedBy string `json:"edited_by"`
+	// Excerpt is the HTML of the start of the page, which is shown
+	// when the page is listed as a blog post.
+	Excerpt string `json:"excerpt"`
+
+	// These fields are parsed from the front matter of the markdown
+	// whenever the page is saved.
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Date        time.Time `json:"date"`
+	Draft       bool      `json:"draft"`
+	Layout      string    `json:"layout"`
+	Tags        []string  `json:"tags"`
+	Weight      int       `json:"weight"`
+	NoIndex     bool      `json:"noindex"`
+	// If PublishAt is set, the draft will be published automatically
+	// at that time.
+	PublishAt time.Time `json:"publish_at"`
+	// PublishedAt is the last time the page was published. It's only
+	// set on published copies.
+	PublishedAt time.Time `json:"published_at"`
 }
 
 // MakeDefault returns the default initialized page.
@@ -31,31 +68,111 @@ func (p *Page) MakeDefault() {
 	if p.HTML == "" {
 		p.HTML = "<h1>Default new page</h1><p>This is an example page.</p>"
 	}
+	if p.Tags == nil {
+		p.Tags = []string{}
+	}
 }
 
 // Export returns the fields which are acceptable to send directly to the
 // client over the web.
 func (p *Page) Export() map[string]interface{} {
+	var date, publishAt interface{}
+	if !p.Date.IsZero() {
+		date = p.Date
+	}
+	if !p.PublishAt.IsZero() {
+		publishAt = p.PublishAt
+	}
 	return map[string]interface{}{
-		"name":     p.Name,
-		"markdown": p.Markdown,
+		"name":        p.Name,
+		"markdown":    p.Markdown,
+		"revision":    p.Revision,
+		"title":       p.Title,
+		"description": p.Description,
+		"date":        date,
+		"draft":       p.Draft,
+		"layout":      p.Layout,
+		"tags":        p.Tags,
+		"weight":      p.Weight,
+		"noindex":     p.NoIndex,
+		"publish_at":  publishAt,
 	}
 }
 
+// RevisionCounter returns the page's revision, which is incremented
+// every time the page is saved, so that edits to an out of date copy
+// of the page can be detected.
+func (p *Page) RevisionCounter() *int {
+	return &p.Revision
+}
+
+// Parses the front matter and renders the markdown, so that the stored
+// metadata and HTML always match it. The markdown can contain raw HTML,
+// so the result is sanitized.
+func (p *Page) updateDerivedFields() error {
+	frontMatter, markdown := render.SplitFrontMatter(p.Markdown)
+	err := p.setFrontMatter(frontMatter)
+	if err != nil {
+		return err
+	}
+
+	resolve, err := p.wikiLinkResolver()
+	if err != nil {
+		return err
+	}
+	html, err := render.MarkdownWithWikiLinks(markdown, resolve)
+	if err != nil {
+		return err
+	}
+	p.HTML = render.Sanitize(html)
+
+	excerpt, err := render.MarkdownWithWikiLinks(render.Excerpt(markdown), resolve)
+	if err != nil {
+		return err
+	}
+	p.Excerpt = render.Sanitize(excerpt)
+	return nil
+}
+
 // RegistrationKey defines the set to which this page will
 // belong. It'll be of the form:
 //    pages:[domain]
+// or for published copies:
+//    published:[domain]
 func (p *Page) RegistrationKey() string {
-	return fmt.Sprintf("pages:%s", p.Domain)
+	return fmt.Sprintf("%s:%s", p.table(), p.Domain)
 }
 
 // Key returns a unique key for use in the redis database.
 func (p *Page) Key() string {
-	return fmt.Sprintf("pages:%s:%s", p.Domain, p.Name)
+	return fmt.Sprintf("%s:%s:%s", p.table(), p.Domain, p.Name)
+}
+
+func (p *Page) table() string {
+	if p.Published {
+		return "published"
+	}
+	return "pages"
 }
 
 var filenameValidator = regexp.MustCompile("^[A-Za-z0-9_\\.]+$")
 
+// Pages can be nested in folders, so their names are paths like
+// blog/2026/hello.md. Each segment of the path is checked separately.
+var pathSegmentValidator = regexp.MustCompile("^[A-Za-z0-9_\\.\\-]+$")
+
+// ValidPagePath reports whether the path is acceptable as the name of a
+// page or a folder. Segments can't be empty, or refer to the current or
+// parent folder.
+func ValidPagePath(path string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "." || segment == ".." || !pathSegmentValidator.MatchString(segment) {
+			return false
+		}
+	}
+	return true
+}
+
 // Validate checks the fields of the page to make sure they are
 // acceptable to be inserted into the database.
 func (p *Page) Validate() bool {
@@ -64,8 +181,8 @@ func (p *Page) Validate() bool {
 		return false
 	}
 
-	if !filenameValidator.MatchString(p.Name) {
-		log.Printf("Validation failed on page %s, illegal filename '%s'\n", p.Name, p.Name)
+	if !ValidPagePath(p.Name) {
+		log.Printf("Validation failed on page %s, illegal path '%s'\n", p.Name, p.Name)
 		return false
 	}
 
@@ -76,22 +193,17 @@ func (p *Page) Validate() bool {
 // for the page. This function finds a unique key (or returns err if it can't
 // do that in a reasonable time) and attaches it to the page.
 func (p *Page) GenerateName() error {
-	pool, err := getRedisConnection()
-	if err != nil {
-		log.Fatal("Couldn't connect to the redis database.")
-	}
 	for i := 0; i < 10; i++ {
 		if i == 0 {
 			p.Name = "untitled.md"
 		} else {
 			p.Name = fmt.Sprintf("untitled_%d.md", i)
 		}
-		result := pool.Cmd("EXISTS", p.Key())
-		exists, err := result.Int()
+		exists, err := store.Exists(p.Key())
 		if err != nil {
 			return err
 		}
-		if exists == 0 {
+		if !exists {
 			return nil
 		}
 	}
@@ -99,35 +211,186 @@ func (p *Page) GenerateName() error {
 }
 
 // RenamePage takes an existing page and rename it. It's a bit tricky to rename the
-// page, because the page create sthe key, which prevents lookups.
+// page, because the page create sthe key, which prevents lookups. The new name
+// can be in a different folder, which moves the page. Links to the page in the
+// user's other pages are changed to match.
 func (p *Page) RenamePage(newName string) error {
-	pool, err := getRedisConnection()
+	oldKey := p.Key()
+	oldName := p.Name
+	b, err := p.renameBatch(newName)
 	if err != nil {
-		log.Fatal("Couldn't connect to the redis database.")
 		return err
 	}
+	if oldKey == p.Key() {
+		return nil
+	}
 
+	err = store.Apply(b)
+	if err != nil {
+		log.Printf("Tried to rename page to `%v`, but failed: %v", newName, err)
+		return err
+	}
+
+	// Fix up the links to the page from the user's other pages. Links to
+	// the old name follow its redirect, but there might be broken links
+	// to the new name.
+	updateReferences(p.Domain, map[string]string{linkTarget(oldName): PageURLPath(p.Name)}, p.Name)
+	return nil
+}
+
+// RenamePreview returns the changes which renaming the page would make
+// to the links in the user's other pages, without renaming it.
+func (p *Page) RenamePreview(newName string) ([]LinkRewrite, error) {
+	renamed := *p
+	renamed.Name = newName
+	if !renamed.Validate() {
+		return nil, fmt.Errorf("Tried to rename to invalid name `%s`", newName)
+	}
+	if renamed.Key() == p.Key() {
+		return []LinkRewrite{}, nil
+	}
+	return rewriteReferences(p.Domain, map[string]string{linkTarget(p.Name): PageURLPath(newName)}, false)
+}
+
+// Renames the page, and returns the batch which moves it (and its
+// related records) to the new name in the database.
+func (p *Page) renameBatch(newName string) (*Batch, error) {
 	oldKey := p.Key()
+	oldName := p.Name
 	p.Name = newName
 
 	// Need to check key validation, in case the new name is not valid.
 	if !p.Validate() {
-		return fmt.Errorf("Tried to rename to invalid name `%s`", newName)
+		return nil, fmt.Errorf("Tried to rename to invalid name `%s`", newName)
+	}
+	if oldKey == p.Key() {
+		return &Batch{}, nil
 	}
 
-	// Step one: rename the old key to the new key.
-	pool.Cmd("RENAME", oldKey, p.Key())
+	b, err := renameBatch(p, oldKey)
+	if err != nil {
+		return nil, err
+	}
+	err = p.renameRelated(b, oldKey, oldName)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
 
-	// Take the registration pool and delete the old key
-	// and add a new key.
-	pool.Cmd("SREM", p.RegistrationKey(), oldKey)
-	pool.Cmd("SADD", p.RegistrationKey(), p.Key())
+// Adds the writes which keep the page's indexes, for searching and for
+// finding the pages which link to it, up to date to the batch which
+// saves it.
+func (p *Page) saveIndexes(b *Batch) error {
+	err := p.saveSearchIndex(b)
+	if err != nil {
+		return err
+	}
+	return p.saveLinks(b)
+}
 
-	// Save the object with the new parameters.
-	err = Save(p)
+// Adds the writes which remove the page from its indexes to the batch
+// which deletes it.
+func (p *Page) deleteIndexes(b *Batch) error {
+	err := p.deleteSearchIndex(b)
 	if err != nil {
-		log.Printf("Tried to rename page to `%v`, but couldn't save at the end.", newName)
+		return err
+	}
+	return p.deleteLinks(b)
+}
+
+// Adds the writes which record a new revision of the draft and index it
+// to the batch which saves it. Published copies don't have revisions of
+// their own.
+func (p *Page) saveRelated(b *Batch) error {
+	err := p.saveIndexes(b)
+	if err != nil || p.Published {
+		return err
 	}
+	return p.saveRevision(b)
+}
 
-	return nil
+// Adds the writes which delete the page's revisions, indexes, access rule,
+// preview links and published copy to the batch which deletes the draft.
+func (p *Page) deleteRelated(b *Batch) error {
+	err := p.deleteIndexes(b)
+	if err != nil || p.Published {
+		return err
+	}
+	err = p.deleteRevisions(b)
+	if err != nil {
+		return err
+	}
+
+	published := p.publishedCopy()
+	err = published.deleteIndexes(b)
+	if err != nil {
+		return err
+	}
+	b.Delete(published.Key())
+	b.RemoveFromSet(published.RegistrationKey(), published.Key())
+	b.RemoveFromSet(publishScheduleKey, p.Key())
+	p.deleteAccess(b)
+	return p.deletePreviews(b)
+}
+
+// Adds the writes which move the page's revisions, indexes, access rule,
+// preview links and published copy to its new name, to the batch which
+// renames the draft. If the page has been published, its old URL
+// redirects to the new one.
+func (p *Page) renameRelated(b *Batch, oldKey, oldName string) error {
+	err := p.renameRevisions(b, oldName)
+	if err != nil {
+		return err
+	}
+
+	err = (&Page{Domain: p.Domain, Name: oldName}).deleteIndexes(b)
+	if err != nil {
+		return err
+	}
+	err = p.saveIndexes(b)
+	if err != nil {
+		return err
+	}
+	err = p.renameAccess(b, oldName)
+	if err != nil {
+		return err
+	}
+	err = p.renamePreviews(b, oldName)
+	if err != nil {
+		return err
+	}
+
+	if !p.PublishAt.IsZero() {
+		b.RemoveFromSet(publishScheduleKey, oldKey)
+		b.AddToSet(publishScheduleKey, p.Key())
+	}
+
+	old := &Page{Published: true, Domain: p.Domain, Name: oldName}
+	err = Load(old)
+	if IsStorageError(err) {
+		return err
+	}
+	if err != nil {
+		// The page hasn't been published.
+		return nil
+	}
+	err = old.deleteIndexes(b)
+	if err != nil {
+		return err
+	}
+	published := *old
+	published.Name = p.Name
+	err = published.saveIndexes(b)
+	if err != nil {
+		return err
+	}
+	b.RequireExists(old.Key())
+	b.Rename(old.Key(), published.Key())
+	b.Save(published.Key(), map[string]string{"name": published.Name})
+	b.RemoveFromSet(old.RegistrationKey(), old.Key())
+	b.AddToSet(published.RegistrationKey(), published.Key())
+
+	// Visitors might still have the old URL.
+	return addRedirect(b, p.Domain, PageURLPath(oldName), PageURLPath(p.Name))
 }
@@ -3,6 +3,7 @@ package models
 import (
 	"fmt"
 	"testing"
+	"time"
 )
 
 func TestSiteValidation(t *testing.T) {
@@ -112,3 +113,117 @@ func TestSiteInsertion(t *testing.T) {
 		}
 	}
 }
+
+func TestPageRevisionConflict(t *testing.T) {
+	p := Page{}
+	p.Domain = "testdomain"
+	p.Name = "revisions.md"
+	p.Markdown = "first"
+	err := Insert(&p)
+	if err != nil {
+		t.Fatalf("Failed to insert page: %v", err)
+	}
+	if p.Revision != 1 {
+		t.Fatalf("New pages should start at revision 1, got %d", p.Revision)
+	}
+
+	// Two copies of the page are loaded, as if they were open in two
+	// different browser tabs.
+	a := Page{Domain: "testdomain", Name: "revisions.md"}
+	b := Page{Domain: "testdomain", Name: "revisions.md"}
+	Load(&a)
+	Load(&b)
+
+	a.Markdown = "second"
+	err = Save(&a)
+	if err != nil {
+		t.Fatalf("Failed to save page: %v", err)
+	}
+	if a.Revision != 2 {
+		t.Fatalf("Saving should increment the revision, got %d", a.Revision)
+	}
+
+	b.Markdown = "clobbered"
+	err = Save(&b)
+	if !IsRevisionConflict(err) {
+		t.Fatalf("Saving an out of date page should conflict, got %v", err)
+	}
+	if err.(*RevisionConflict).Current != 2 {
+		t.Fatalf("Conflict should report the current revision, got %v", err)
+	}
+	if b.Revision != 1 {
+		t.Fatalf("Failed save shouldn't change the revision, got %d", b.Revision)
+	}
+
+	g := Page{Domain: "testdomain", Name: "revisions.md"}
+	Load(&g)
+	if g.Markdown != "second" || g.Revision != 2 {
+		t.Fatalf("Conflicting save overwrote the page: %v at revision %d", g.Markdown, g.Revision)
+	}
+
+	// Pages saved before revisions existed have no revision stored,
+	// which counts as revision 0.
+	store.Save(g.Key(), map[string]string{"revision": ""})
+	legacy := Page{Domain: "testdomain", Name: "revisions.md"}
+	Load(&legacy)
+	legacy.Markdown = "migrated"
+	err = Save(&legacy)
+	if err != nil || legacy.Revision != 1 {
+		t.Fatalf("Couldn't save page without a stored revision: %v", err)
+	}
+}
+
+func TestPageHTMLIsRendered(t *testing.T) {
+	p := Page{Domain: "testdomain", Name: "rendered.md"}
+	p.Markdown = "## Hello"
+	p.HTML = "<script>alert('not from the markdown')</script>"
+	err := Insert(&p)
+	if err != nil {
+		t.Fatalf("Failed to insert page: %v", err)
+	}
+
+	g := Page{Domain: "testdomain", Name: "rendered.md"}
+	Load(&g)
+	if g.HTML != "<h2 id=\"hello\">Hello</h2>\n" {
+		t.Fatalf("Expected HTML to be rendered from the markdown, got %q", g.HTML)
+	}
+}
+
+func TestPageFrontMatter(t *testing.T) {
+	p := Page{Domain: "testdomain", Name: "frontmatter.md"}
+	p.Markdown = "---\ntitle: Hello world\ndescription: A first post\ndate: 2026-03-04\ndraft: true\nlayout: post\ntags: news, intro\nweight: 3\nunknown: ignored\n---\n## Hello"
+	err := Insert(&p)
+	if err != nil {
+		t.Fatalf("Failed to insert page: %v", err)
+	}
+
+	g := Page{Domain: "testdomain", Name: "frontmatter.md"}
+	Load(&g)
+	if g.Title != "Hello world" || g.Description != "A first post" || !g.Draft || g.Layout != "post" || g.Weight != 3 {
+		t.Fatalf("Front matter wasn't parsed: %+v", g)
+	}
+	if !g.Date.Equal(time.Date(2026, 3, 4, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Expected date 2026-03-04, got %v", g.Date)
+	}
+	if len(g.Tags) != 2 || g.Tags[0] != "news" || g.Tags[1] != "intro" {
+		t.Fatalf("Expected tags [news intro], got %v", g.Tags)
+	}
+	if g.HTML != "<h2 id=\"hello\">Hello</h2>\n" {
+		t.Fatalf("Front matter shouldn't be rendered, got %q", g.HTML)
+	}
+
+	// Removing the front matter clears the metadata.
+	g.Markdown = "## Hello"
+	Save(&g)
+	Load(&g)
+	if g.Title != "" || g.Draft || len(g.Tags) != 0 {
+		t.Fatalf("Metadata should be cleared along with the front matter: %+v", g)
+	}
+
+	for _, invalid := range []string{"---\ntitle: [unclosed\n---\n", "---\ndate: next tuesday\n---\n"} {
+		g.Markdown = invalid
+		if Save(&g) == nil {
+			t.Errorf("Saving with invalid front matter %q should fail.", invalid)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+/*
+  preview.go
+
+  Users can share their drafts before they're published, by giving
+  someone a preview link. Each link has a secret token, which stops
+  working when it expires or when the user revokes it.
+*/
+
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+)
+
+// A PreviewToken lets whoever has it see the drafts of a user's pages.
+// It's stored in the database under the key:
+//    previews:[domain]:[token]
+// and a list of those keys are stored under the
+//    previews:[domain]
+// list. If Page is set, only that page can be previewed, otherwise the
+// whole site can be.
+type PreviewToken struct {
+	Domain    string    `json:"domain"`
+	Token     string    `json:"token"`
+	Page      string    `json:"page"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// MaxPreviewDuration is the longest that a preview link can last.
+const MaxPreviewDuration = 30 * 24 * time.Hour
+
+var previewTokenValidator = regexp.MustCompile("^[0-9a-f]{32}$")
+
+// MakeDefault sets default values for the token. There aren't any.
+func (t *PreviewToken) MakeDefault() {}
+
+// Export returns the fields which are acceptable to send directly to
+// the client over the web. The path is where the preview link goes,
+// relative to the root of the site.
+func (t *PreviewToken) Export() map[string]interface{} {
+	return map[string]interface{}{
+		"token":      t.Token,
+		"page":       t.Page,
+		"created_at": t.CreatedAt,
+		"expires_at": t.ExpiresAt,
+		"path":       PageURLPath(t.Page) + "?preview=" + t.Token,
+	}
+}
+
+// RegistrationKey defines the set to which this token will belong. It'll
+// be of the form:
+//    previews:[domain]
+func (t *PreviewToken) RegistrationKey() string {
+	return fmt.Sprintf("previews:%s", t.Domain)
+}
+
+// Key returns a unique key for use in the redis database.
+func (t *PreviewToken) Key() string {
+	return fmt.Sprintf("previews:%s:%s", t.Domain, t.Token)
+}
+
+// Validate checks that the token belongs to a valid domain, and that it
+// previews a valid page, if it's only for one page.
+func (t *PreviewToken) Validate() bool {
+	if !domainValidator.MatchString(t.Domain) {
+		log.Printf("Validation failed on preview token, illegal domain '%s'\n", t.Domain)
+		return false
+	}
+
+	if !previewTokenValidator.MatchString(t.Token) {
+		log.Printf("Validation failed on preview token for %s, illegal token\n", t.Domain)
+		return false
+	}
+
+	if t.Page != "" && !ValidPagePath(t.Page) {
+		log.Printf("Validation failed on preview token for %s, illegal page '%s'\n", t.Domain, t.Page)
+		return false
+	}
+
+	return true
+}
+
+// Expired reports whether the token has stopped working.
+func (t *PreviewToken) Expired() bool {
+	return !time.Now().Before(t.ExpiresAt)
+}
+
+// Allows reports whether the token lets its holder preview the page.
+func (t *PreviewToken) Allows(name string) bool {
+	return t.Page == "" || t.Page == name
+}
+
+// NewPreviewToken creates a token which previews the page, or the whole
+// site if the page is empty, until the duration has passed.
+func NewPreviewToken(domain, page string, duration time.Duration) (*PreviewToken, error) {
+	if duration <= 0 || duration > MaxPreviewDuration {
+		return nil, fmt.Errorf("Preview links can't last for %v", duration)
+	}
+
+	secret := make([]byte, 16)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	t := &PreviewToken{
+		Domain:    domain,
+		Token:     hex.EncodeToString(secret),
+		Page:      page,
+		CreatedAt: now,
+		ExpiresAt: now.Add(duration),
+	}
+	err = Insert(t)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// FindPreviewToken returns the token for the domain, if it exists and
+// hasn't expired. Otherwise, it returns nil.
+func FindPreviewToken(domain, token string) (*PreviewToken, error) {
+	if !previewTokenValidator.MatchString(token) {
+		return nil, nil
+	}
+	t := &PreviewToken{Domain: domain, Token: token}
+	err := Load(t)
+	if IsStorageError(err) {
+		return nil, err
+	}
+	if err != nil || t.Expired() {
+		return nil, nil
+	}
+	return t, nil
+}
+
+// PreviewTokens returns the domain's tokens which haven't expired yet.
+// The expired ones are deleted.
+func PreviewTokens(domain string) ([]*PreviewToken, error) {
+	iterator, err := GetList(&PreviewToken{Domain: domain})
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []*PreviewToken{}
+	expired := &Batch{}
+	for iterator.Next() {
+		copied := *iterator.Value().(*PreviewToken)
+		if copied.Expired() {
+			expired.Delete(copied.Key())
+			expired.RemoveFromSet(copied.RegistrationKey(), copied.Key())
+			continue
+		}
+		tokens = append(tokens, &copied)
+	}
+	if iterator.Err() != nil {
+		return nil, iterator.Err()
+	}
+	return tokens, store.Apply(expired)
+}
+
+// Adds the writes which point the preview links for the page at its new
+// name to the batch which renames it, so that they keep working.
+func (p *Page) renamePreviews(b *Batch, oldName string) error {
+	iterator, err := GetList(&PreviewToken{Domain: p.Domain})
+	if err != nil {
+		return err
+	}
+	for iterator.Next() {
+		t := iterator.Value().(*PreviewToken)
+		if t.Page == oldName {
+			b.Save(t.Key(), map[string]string{"page": p.Name})
+		}
+	}
+	return iterator.Err()
+}
+
+// Adds the writes which revoke the preview links for the page to the
+// batch which deletes it.
+func (p *Page) deletePreviews(b *Batch) error {
+	iterator, err := GetList(&PreviewToken{Domain: p.Domain})
+	if err != nil {
+		return err
+	}
+	for iterator.Next() {
+		t := iterator.Value().(*PreviewToken)
+		if t.Page == p.Name {
+			b.Delete(t.Key())
+			b.RemoveFromSet(t.RegistrationKey(), t.Key())
+		}
+	}
+	return iterator.Err()
+}
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPreviewTokens(t *testing.T) {
+	p := &Page{Domain: "previewdomain", Name: "drafts/post.md", Markdown: "Draft"}
+	err := Insert(p)
+	if err != nil {
+		t.Fatalf("Failed to insert page: %v", err)
+	}
+
+	_, err = NewPreviewToken("previewdomain", "", MaxPreviewDuration+time.Hour)
+	if err == nil {
+		t.Fatalf("Preview links shouldn't last that long")
+	}
+	site, err := NewPreviewToken("previewdomain", "", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create preview token: %v", err)
+	}
+	page, err := NewPreviewToken("previewdomain", p.Name, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create preview token: %v", err)
+	}
+	if site.Token == page.Token || !site.Allows("index.md") || page.Allows("index.md") || !page.Allows(p.Name) {
+		t.Fatalf("Preview tokens allowed the wrong pages")
+	}
+
+	found, err := FindPreviewToken("previewdomain", page.Token)
+	if err != nil || found == nil || found.Page != p.Name {
+		t.Fatalf("Expected to find the preview token, got %v, %v", found, err)
+	}
+	found, err = FindPreviewToken("otherdomain", page.Token)
+	if err != nil || found != nil {
+		t.Fatalf("Preview tokens shouldn't work on other sites")
+	}
+
+	// Expired tokens don't work, and aren't listed.
+	expired := &PreviewToken{Domain: "previewdomain", Token: "0123456789abcdef0123456789abcdef", ExpiresAt: time.Now().Add(-time.Minute)}
+	err = Insert(expired)
+	if err != nil {
+		t.Fatalf("Failed to insert preview token: %v", err)
+	}
+	found, err = FindPreviewToken("previewdomain", expired.Token)
+	if err != nil || found != nil {
+		t.Fatalf("Expired preview tokens shouldn't work")
+	}
+	tokens, err := PreviewTokens("previewdomain")
+	if err != nil || len(tokens) != 2 {
+		t.Fatalf("Expected two preview tokens, got %v, %v", tokens, err)
+	}
+
+	// The token follows the page when it's renamed, and is revoked when
+	// it's deleted.
+	err = p.RenamePage("posts/post.md")
+	if err != nil {
+		t.Fatalf("Failed to rename page: %v", err)
+	}
+	found, err = FindPreviewToken("previewdomain", page.Token)
+	if err != nil || found == nil || found.Page != "posts/post.md" {
+		t.Fatalf("Expected the preview token to follow the page, got %v, %v", found, err)
+	}
+	err = Delete(p)
+	if err != nil {
+		t.Fatalf("Failed to delete page: %v", err)
+	}
+	found, err = FindPreviewToken("previewdomain", page.Token)
+	if err != nil || found != nil {
+		t.Fatalf("Expected the preview token to be revoked with the page")
+	}
+	tokens, err = PreviewTokens("previewdomain")
+	if err != nil || len(tokens) != 1 || tokens[0].Token != site.Token {
+		t.Fatalf("Expected only the site's preview token, got %v, %v", tokens, err)
+	}
+}
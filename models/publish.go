@@ -0,0 +1,214 @@
+/*
+  publish.go
+
+  Editing a page only changes its draft, and visitors only ever see the
+  published copy. A draft can be published straight away, or scheduled
+  to be published later by the scheduler in PublishScheduledPages.
+*/
+
+package models
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// The set of drafts which are scheduled to be published. The
+// scheduler checks each of them to see if it's time yet.
+const publishScheduleKey = "publish_schedule"
+
+// The hash used to record which data migrations have been run.
+const migrationsKey = "migrations"
+
+// Returns a copy of the page which refers to its published version.
+func (p *Page) publishedCopy() *Page {
+	published := *p
+	published.Published = true
+	published.PublishAt = time.Time{}
+	published.PublishedAt = time.Time{}
+	return &published
+}
+
+// Publish makes the current draft of the page visible on the site,
+// replacing whatever was published before. The draft must be the one
+// that's stored in the database, i.e. it must not have been saved by
+// somebody else since it was loaded.
+func (p *Page) Publish() error {
+	if p.Published {
+		return fmt.Errorf("Page `%s` is already a published copy", p.Name)
+	}
+
+	published := p.publishedCopy()
+	published.PublishedAt = time.Now()
+	fields, err := encodeModel(published)
+	if err != nil {
+		return err
+	}
+
+	b := &Batch{}
+	b.RequireCounter(p.Key(), "revision", p.Revision)
+	b.Delete(published.Key())
+	b.Save(published.Key(), fields)
+	b.AddToSet(published.RegistrationKey(), published.Key())
+	err = published.saveIndexes(b)
+	if err != nil {
+		return err
+	}
+
+	// Publishing replaces any schedule for the draft.
+	draft := *p
+	draft.PublishAt = time.Time{}
+	draftFields, err := encodeModel(&draft)
+	if err != nil {
+		return err
+	}
+	b.Save(p.Key(), map[string]string{"publish_at": draftFields["publish_at"]})
+	b.RemoveFromSet(publishScheduleKey, p.Key())
+
+	err = store.Apply(b)
+	if e, ok := err.(*PreconditionError); ok {
+		if e.Field == "revision" {
+			return &RevisionConflict{Key: p.Key(), Expected: p.Revision, Current: e.Value}
+		}
+		return fmt.Errorf("Key `%s` doesn't exist: can't publish it", p.Key())
+	}
+	if err != nil {
+		return err
+	}
+	p.PublishAt = time.Time{}
+
+	// The page might not have been published before, so the wiki links
+	// to it from the published copies of other pages can work now.
+	return rerenderBacklinks(p.Domain, p.Name)
+}
+
+// SchedulePublish arranges for the draft to be published automatically
+// at the given time. Whatever the draft contains at that time will be
+// published. Scheduling a zero time cancels the schedule.
+func (p *Page) SchedulePublish(at time.Time) error {
+	p.PublishAt = at
+	fields, err := encodeModel(p)
+	if err != nil {
+		return err
+	}
+
+	b := &Batch{}
+	b.RequireCounter(p.Key(), "revision", p.Revision)
+	b.Save(p.Key(), map[string]string{"publish_at": fields["publish_at"]})
+	if at.IsZero() {
+		b.RemoveFromSet(publishScheduleKey, p.Key())
+	} else {
+		b.AddToSet(publishScheduleKey, p.Key())
+	}
+	err = store.Apply(b)
+	if e, ok := err.(*PreconditionError); ok && e.Field == "revision" {
+		return &RevisionConflict{Key: p.Key(), Expected: p.Revision, Current: e.Value}
+	}
+	return err
+}
+
+// IsPublished reports whether the page has a published copy.
+func (p *Page) IsPublished() (bool, error) {
+	return store.Exists(p.publishedCopy().Key())
+}
+
+// PublishScheduledPages publishes every draft whose scheduled publishing
+// time is before now. It's meant to be called periodically by the server.
+func PublishScheduledPages(now time.Time) error {
+	keys, err := store.Members(publishScheduleKey)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		p := &Page{}
+		err = LoadFromKey(p, key)
+		if IsStorageError(err) {
+			return err
+		}
+
+		// If the page was deleted, there's nothing left to publish.
+		if err != nil || p.PublishAt.IsZero() {
+			err = store.RemoveFromSet(publishScheduleKey, key)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if p.PublishAt.After(now) {
+			continue
+		}
+
+		// If the draft changes while we're publishing it, we'll get it
+		// on the next pass instead.
+		err = p.Publish()
+		if IsStorageError(err) {
+			return err
+		}
+		if err != nil {
+			log.Printf("Unable to publish scheduled page `%s`: %v", key, err)
+			continue
+		}
+		log.Printf("Published scheduled page `%s`", key)
+	}
+	return nil
+}
+
+// PublishExistingPages publishes every page which was created before
+// pages had separate drafts, so that they stay visible. It only does
+// anything the first time it's run.
+func PublishExistingPages() error {
+	migrations, err := store.Load(migrationsKey)
+	if err != nil || migrations["published_pages"] != "" {
+		return err
+	}
+
+	users, err := GetList(&User{})
+	if err != nil {
+		return err
+	}
+	domains := []string{}
+	for users.Next() {
+		domains = append(domains, users.Value().(*User).Domain)
+	}
+	if users.Err() != nil {
+		return users.Err()
+	}
+
+	for _, domain := range domains {
+		pages, err := GetList(&Page{Domain: domain})
+		if err != nil {
+			return err
+		}
+		for pages.Next() {
+			p := *pages.Value().(*Page)
+			published, err := p.IsPublished()
+			if err != nil {
+				return err
+			}
+			if published {
+				continue
+			}
+
+			// Pages from before then were stored without their front
+			// matter, excerpt or up to date HTML, so they're saved again
+			// to fill those in, and that revision is published.
+			err = Save(&p)
+			if err == nil {
+				err = p.Publish()
+			}
+			if IsStorageError(err) {
+				return err
+			}
+			if err != nil {
+				log.Printf("Unable to publish existing page `%s`: %v", p.Key(), err)
+			}
+		}
+		if pages.Err() != nil {
+			return pages.Err()
+		}
+	}
+
+	return store.Save(migrationsKey, map[string]string{"published_pages": time.Now().Format(time.RFC3339)})
+}
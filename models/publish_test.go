@@ -0,0 +1,162 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func loadPublished(domain, name string) (*Page, error) {
+	p := &Page{Published: true, Domain: domain, Name: name}
+	err := Load(p)
+	return p, err
+}
+
+func TestPublishPage(t *testing.T) {
+	p := &Page{Domain: "publishdomain", Name: "post.md", Markdown: "first draft"}
+	err := Insert(p)
+	if err != nil {
+		t.Fatalf("Failed to insert page: %v", err)
+	}
+	if _, err = loadPublished(p.Domain, p.Name); err == nil {
+		t.Fatalf("New pages shouldn't be published.")
+	}
+
+	err = p.Publish()
+	if err != nil {
+		t.Fatalf("Couldn't publish page: %v", err)
+	}
+	p.Markdown = "second draft"
+	err = Save(p)
+	if err != nil {
+		t.Fatalf("Couldn't save page: %v", err)
+	}
+
+	published, err := loadPublished(p.Domain, p.Name)
+	if err != nil || published.Markdown != "first draft" || published.Revision != 1 {
+		t.Fatalf("Saving the draft shouldn't change the published copy: %+v %v", published, err)
+	}
+
+	// Publishing an out of date copy of the draft isn't allowed.
+	stale := *p
+	stale.Revision = 1
+	if !IsRevisionConflict(stale.Publish()) {
+		t.Fatalf("Publishing an out of date draft should conflict.")
+	}
+
+	// Renaming the draft moves the published copy too, and deleting it
+	// deletes the published copy.
+	err = p.RenamePage("renamed_post.md")
+	if err != nil {
+		t.Fatalf("Couldn't rename page: %v", err)
+	}
+	published, err = loadPublished(p.Domain, "renamed_post.md")
+	if err != nil || published.Name != "renamed_post.md" {
+		t.Fatalf("Published copy wasn't renamed: %+v %v", published, err)
+	}
+	iterator, _ := GetList(&Page{Published: true, Domain: p.Domain})
+	if iterator.Count() != 1 {
+		t.Fatalf("Expected one published page, got %d", iterator.Count())
+	}
+
+	err = Delete(p)
+	if err != nil {
+		t.Fatalf("Couldn't delete page: %v", err)
+	}
+	if _, err = loadPublished(p.Domain, p.Name); err == nil {
+		t.Fatalf("Published copy should be deleted along with the draft.")
+	}
+}
+
+func TestScheduledPublishing(t *testing.T) {
+	now := time.Now()
+	soon := &Page{Domain: "scheduledomain", Name: "soon.md", Markdown: "soon"}
+	later := &Page{Domain: "scheduledomain", Name: "later.md", Markdown: "later"}
+	for _, p := range []*Page{soon, later} {
+		err := Insert(p)
+		if err != nil {
+			t.Fatalf("Failed to insert page: %v", err)
+		}
+	}
+	soon.SchedulePublish(now.Add(time.Minute))
+	later.SchedulePublish(now.Add(time.Hour))
+
+	// The draft which is published is the one at the scheduled time,
+	// not the one when it was scheduled.
+	soon.Markdown = "edited"
+	err := Save(soon)
+	if err != nil {
+		t.Fatalf("Saving a scheduled page shouldn't fail: %v", err)
+	}
+
+	err = PublishScheduledPages(now.Add(2 * time.Minute))
+	if err != nil {
+		t.Fatalf("Couldn't publish scheduled pages: %v", err)
+	}
+	published, err := loadPublished(soon.Domain, soon.Name)
+	if err != nil || published.Markdown != "edited" {
+		t.Fatalf("Scheduled page wasn't published: %+v %v", published, err)
+	}
+	if _, err = loadPublished(later.Domain, later.Name); err == nil {
+		t.Fatalf("Page scheduled for later shouldn't be published yet.")
+	}
+
+	draft := &Page{Domain: soon.Domain, Name: soon.Name}
+	Load(draft)
+	if !draft.PublishAt.IsZero() {
+		t.Fatalf("Schedule should be cleared after publishing, got %v", draft.PublishAt)
+	}
+	scheduled, _ := store.Members(publishScheduleKey)
+	if len(scheduled) != 1 || scheduled[0] != later.Key() {
+		t.Fatalf("Only the later page should still be scheduled, got %v", scheduled)
+	}
+}
+
+func TestPublishExistingPages(t *testing.T) {
+	working := store
+	defer func() { store = working }()
+	store = newMemoryStore()
+
+	u := NewUser()
+	u.Name = "Legacy User"
+	u.Domain = "legacydomain"
+	u.SetPassword("legacy password")
+	u.Email = "legacy@test.com"
+	err := Insert(u)
+	if err != nil {
+		t.Fatalf("Failed to insert user: %v", err)
+	}
+	Insert(&Page{Domain: u.Domain, Name: "index.md", Markdown: "legacy"})
+
+	// Older pages were stored as they were sent, without anything parsed
+	// from their markdown.
+	store.Save("pages:legacydomain:post.md", map[string]string{
+		"domain":   u.Domain,
+		"name":     "post.md",
+		"markdown": "---\ntitle: Old post\ndate: 2015-06-01\n---\nThe start.\n\nThe rest.",
+		"html":     "<p>old html</p>",
+	})
+	store.AddToSet("pages:legacydomain", "pages:legacydomain:post.md")
+
+	err = PublishExistingPages()
+	if err != nil {
+		t.Fatalf("Couldn't publish existing pages: %v", err)
+	}
+	published, err := loadPublished(u.Domain, "index.md")
+	if err != nil || published.Markdown != "legacy" {
+		t.Fatalf("Existing page wasn't published: %v", err)
+	}
+	published, err = loadPublished(u.Domain, "post.md")
+	if err != nil {
+		t.Fatalf("Existing post wasn't published: %v", err)
+	}
+	if published.Title != "Old post" || published.Date.Year() != 2015 || published.Excerpt != "<p>The start.</p>\n" || published.HTML == "<p>old html</p>" {
+		t.Fatalf("Existing post wasn't rendered before it was published: %+v", published)
+	}
+
+	// The migration only runs once, so new drafts aren't published.
+	Insert(&Page{Domain: u.Domain, Name: "new.md"})
+	PublishExistingPages()
+	if _, err = loadPublished(u.Domain, "new.md"); err == nil {
+		t.Fatalf("Pages shouldn't be published by the migration after it has run.")
+	}
+}
@@ -0,0 +1,119 @@
+/*
+  redirect.go
+
+  When a published page or a file is renamed, visitors (and search
+  engines) might still have its old URL. A permanent redirect from the
+  old URL to the new one is recorded, so those links keep working.
+*/
+
+package models
+
+import (
+	"fmt"
+	"log"
+)
+
+// A Redirect sends visitors from the old URL of something which was
+// renamed to its new URL. It's stored in the database under the key:
+//    redirects:[domain]:[target]
+// where the target is the old URL without slashes or extensions, so
+// /blog/, /blog and /blog/index.md all share the same redirect. A list
+// of those keys are stored under the
+//    redirects:[domain]
+// list.
+type Redirect struct {
+	Domain string `json:"domain"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
+
+// MakeDefault sets default values for the redirect. There aren't any.
+func (r *Redirect) MakeDefault() {}
+
+// Export returns the fields which are acceptable to send directly to
+// the client over the web.
+func (r *Redirect) Export() map[string]interface{} {
+	return map[string]interface{}{
+		"from": r.From,
+		"to":   r.To,
+	}
+}
+
+// RegistrationKey defines the set to which this redirect will
+// belong. It'll be of the form:
+//    redirects:[domain]
+func (r *Redirect) RegistrationKey() string {
+	return fmt.Sprintf("redirects:%s", r.Domain)
+}
+
+// Key returns a unique key for use in the redis database.
+func (r *Redirect) Key() string {
+	return fmt.Sprintf("redirects:%s:%s", r.Domain, linkTarget(r.From))
+}
+
+// Validate checks that the redirect has a valid domain, and goes from
+// somewhere to somewhere else.
+func (r *Redirect) Validate() bool {
+	if !domainValidator.MatchString(r.Domain) {
+		log.Printf("Validation failed on redirect %s, illegal domain '%s'\n", r.From, r.Domain)
+		return false
+	}
+
+	if r.From == "" || r.To == "" || linkTarget(r.From) == linkTarget(r.To) {
+		log.Printf("Validation failed on redirect %s, illegal destination '%s'\n", r.From, r.To)
+		return false
+	}
+
+	return true
+}
+
+// FindRedirect returns the redirect away from the path on the domain.
+// If there isn't one, it returns nil.
+func FindRedirect(domain, path string) (*Redirect, error) {
+	r := &Redirect{Domain: domain, From: path}
+	err := Load(r)
+	if IsStorageError(err) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// Adds the writes which redirect visitors from one path on the domain to
+// another to the batch. Older redirects to the first path are sent
+// straight to the second one, so visitors are only ever redirected once,
+// and redirects away from the second path are removed, since there's
+// something there now.
+func addRedirect(b *Batch, domain, from, to string) error {
+	redirect := &Redirect{Domain: domain, From: from, To: to}
+	if !redirect.Validate() {
+		return fmt.Errorf("Tried to redirect `%s` to `%s`", from, to)
+	}
+
+	iterator, err := GetList(&Redirect{Domain: domain})
+	if err != nil {
+		return err
+	}
+	for iterator.Next() {
+		r := iterator.Value().(*Redirect)
+		if linkTarget(r.From) == linkTarget(to) {
+			b.Delete(r.Key())
+			b.RemoveFromSet(r.RegistrationKey(), r.Key())
+		} else if linkTarget(r.To) == linkTarget(from) {
+			b.Save(r.Key(), map[string]string{"to": to})
+		}
+	}
+	if iterator.Err() != nil {
+		return iterator.Err()
+	}
+
+	fields, err := encodeModel(redirect)
+	if err != nil {
+		return err
+	}
+	b.Save(redirect.Key(), fields)
+	b.AddToSet(redirect.RegistrationKey(), redirect.Key())
+	return nil
+}
@@ -0,0 +1,163 @@
+package models
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// An editingStore saves a new revision of a page just before a batch
+// which expects its old revision is applied, like somebody editing the
+// page at the same moment.
+type editingStore struct {
+	Store
+	key string
+}
+
+func (s editingStore) Apply(b *Batch) error {
+	for _, c := range b.conditions {
+		if c.key == s.key && c.field == "revision" {
+			s.Store.Save(s.key, map[string]string{"revision": "100"})
+		}
+	}
+	return s.Store.Apply(b)
+}
+
+func TestRenameWithPageBeingEdited(t *testing.T) {
+	target := &Page{Domain: "editingdomain", Name: "target.md", Markdown: "Target"}
+	busy := &Page{Domain: "editingdomain", Name: "busy.md", Markdown: "[Target](/target)"}
+	quiet := &Page{Domain: "editingdomain", Name: "quiet.md", Markdown: "[Target](/target)"}
+	for _, p := range []*Page{target, busy, quiet} {
+		err := Insert(p)
+		if err != nil {
+			t.Fatalf("Failed to insert page: %v", err)
+		}
+	}
+
+	working := store
+	store = editingStore{working, busy.Key()}
+	err := target.RenamePage("moved.md")
+	store = working
+	if err != nil {
+		t.Fatalf("The rename happened, but it returned an error: %v", err)
+	}
+
+	// The page being edited keeps its old link, but the rest are fixed.
+	for _, p := range []*Page{busy, quiet} {
+		err = Load(p)
+		if err != nil {
+			t.Fatalf("Failed to load page: %v", err)
+		}
+	}
+	if busy.Markdown != "[Target](/target)" {
+		t.Fatalf("Expected the busy page to be left alone, got %v", busy.Markdown)
+	}
+	if quiet.Markdown != "[Target](/moved)" {
+		t.Fatalf("Expected the link to be rewritten, got %v", quiet.Markdown)
+	}
+}
+
+func TestRenameRewritesLinks(t *testing.T) {
+	about := &Page{Domain: "renamedomain", Name: "about.md", Markdown: "# About"}
+	home := &Page{Domain: "renamedomain", Name: "index.md", Markdown: "[About](/about.md) and [[About]], but not `[this](/about)`."}
+	for _, p := range []*Page{about, home} {
+		err := Insert(p)
+		if err != nil {
+			t.Fatalf("Failed to insert page: %v", err)
+		}
+	}
+	about.Publish()
+
+	// The preview doesn't change anything.
+	rewrites, err := about.RenamePreview("team/index.md")
+	if err != nil {
+		t.Fatalf("Failed to preview rename: %v", err)
+	}
+	if len(rewrites) != 2 || rewrites[0].Page != "index.md" || rewrites[1].Page != "index.md" {
+		t.Fatalf("Unexpected preview: %+v", rewrites)
+	}
+
+	err = about.RenamePage("team/index.md")
+	if err != nil {
+		t.Fatalf("Failed to rename page: %v", err)
+	}
+	err = Load(home)
+	if err != nil {
+		t.Fatalf("Failed to load page: %v", err)
+	}
+	if home.Markdown != "[About](/team/) and [[team|About]], but not `[this](/about)`." {
+		t.Fatalf("Links weren't rewritten: %v", home.Markdown)
+	}
+	if !strings.Contains(home.HTML, `<a href="/team/" class="wikilink">About</a>`) {
+		t.Fatalf("Wiki link should still work: %v", home.HTML)
+	}
+
+	// The old URL of the published page redirects to the new one, however
+	// it's written.
+	for _, path := range []string{"/about", "/about/", "/about.md"} {
+		r, err := FindRedirect("renamedomain", path)
+		if err != nil || r == nil || r.To != "/team/" {
+			t.Fatalf("Expected a redirect from %s to /team/, got %+v (%v)", path, r, err)
+		}
+	}
+
+	// Renaming the page again updates the old redirect, and renaming it
+	// back removes the redirect away from its original name.
+	err = about.RenamePage("people.md")
+	if err != nil {
+		t.Fatalf("Failed to rename page: %v", err)
+	}
+	if r, _ := FindRedirect("renamedomain", "/about"); r == nil || r.To != "/people" {
+		t.Fatalf("Expected the old redirect to be updated, got %+v", r)
+	}
+	err = about.RenamePage("about.md")
+	if err != nil {
+		t.Fatalf("Failed to rename page: %v", err)
+	}
+	if r, _ := FindRedirect("renamedomain", "/about"); r != nil {
+		t.Fatalf("Expected no redirect away from the page, got %+v", r)
+	}
+	if r, _ := FindRedirect("renamedomain", "/team/"); r == nil || r.To != "/about" {
+		t.Fatalf("Expected a redirect to the page, got %+v", r)
+	}
+	Load(home)
+	if home.Markdown != "[About](/about) and [[about|About]], but not `[this](/about)`." {
+		t.Fatalf("Links weren't rewritten: %v", home.Markdown)
+	}
+
+	// Drafts which were never published don't leave redirects behind.
+	draft := &Page{Domain: "renamedomain", Name: "draft.md", Markdown: "Draft"}
+	Insert(draft)
+	draft.RenamePage("other.md")
+	if r, _ := FindRedirect("renamedomain", "/draft"); r != nil {
+		t.Fatalf("Unpublished pages shouldn't be redirected, got %+v", r)
+	}
+}
+
+func TestRenameFileRewritesLinks(t *testing.T) {
+	f := File{Domain: "renamefiles", Name: "old.pdf", Hash: "abc"}
+	err := Insert(&f)
+	if err != nil {
+		t.Fatalf("Failed to insert file: %v", err)
+	}
+	ioutil.WriteFile(f.GetPath(), []byte("pdf"), 0644)
+	p := &Page{Domain: "renamefiles", Name: "docs/index.md", Markdown: "[Download](../files/old.pdf?v=2) <img src=\"/files/old.pdf\">"}
+	err = Insert(p)
+	if err != nil {
+		t.Fatalf("Failed to insert page: %v", err)
+	}
+
+	err = f.RenameFile("new.pdf")
+	if err != nil {
+		t.Fatalf("Failed to rename file: %v", err)
+	}
+	Load(p)
+	if p.Markdown != "[Download](/files/new.pdf?v=2) <img src=\"/files/new.pdf\">" {
+		t.Fatalf("Links weren't rewritten: %v", p.Markdown)
+	}
+	r, err := FindRedirect("renamefiles", "/files/old.pdf")
+	if err != nil || !reflect.DeepEqual(r, &Redirect{Domain: "renamefiles", From: "/files/old.pdf", To: "/files/new.pdf"}) {
+		t.Fatalf("Expected a redirect to the new file, got %+v (%v)", r, err)
+	}
+}
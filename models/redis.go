@@ -0,0 +1,275 @@
+/*
+  redis.go
+
+  The redis implementation of the Store interface. This is the
+  backend used in production.
+*/
+
+package models
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/mediocregopher/radix.v2/pool"
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+type redisStore struct {
+	pool *pool.Pool
+}
+
+// Connect to the redis database and create a connection pool, which can be used
+// to query the redis database concurrently.
+func newRedisStore(url string) (*redisStore, error) {
+	p, err := pool.New("tcp", url, 10)
+	if err != nil {
+		return nil, err
+	}
+	return &redisStore{pool: p}, nil
+}
+
+// This function gets and returns a redis client object. If we are
+// currently in test mode, we'll make sure to select the test database,
+// which is redis database 1. Otherwise, we're in production, so we'll
+// use the permanent database 0 (default). The client must be returned
+// to the pool with s.pool.Put once the caller is finished with it.
+func (s *redisStore) getRedisConnection() (*redis.Client, error) {
+	p, err := s.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	if AppConfig.Mode == "test" || AppConfig.Mode == "testing" {
+		response := p.Cmd("SELECT", 1)
+		if response.Err != nil {
+			log.Printf("Unable to select testing database: %v", response.Err.Error())
+			p.Close()
+			return nil, response.Err
+		}
+	}
+
+	return p, nil
+}
+
+// Runs a single command on a connection borrowed from the pool, and
+// returns the connection afterwards. Failures to talk to redis are
+// reported as StorageErrors, but errors returned by the command itself
+// (like renaming a missing key) are returned as they are.
+func (s *redisStore) cmd(command string, args ...interface{}) (*redis.Resp, error) {
+	p, err := s.getRedisConnection()
+	if err != nil {
+		return nil, &StorageError{err}
+	}
+	// If the command hits a network error, the pool will close the
+	// connection rather than handing it out again.
+	defer s.pool.Put(p)
+
+	response := p.Cmd(command, args...)
+	if response.IsType(redis.IOErr) {
+		return nil, &StorageError{response.Err}
+	}
+	return response, response.Err
+}
+
+func (s *redisStore) Exists(key string) (bool, error) {
+	response, err := s.cmd("EXISTS", key)
+	if err != nil {
+		return false, err
+	}
+	exists, err := response.Int()
+	return exists == 1, err
+}
+
+func (s *redisStore) Load(key string) (map[string]string, error) {
+	response, err := s.cmd("HGETALL", key)
+	if err != nil {
+		return nil, err
+	}
+	return response.Map()
+}
+
+func (s *redisStore) Save(key string, fields map[string]string) error {
+	_, err := s.cmd("HMSET", key, fields)
+	return err
+}
+
+func (s *redisStore) Delete(key string) error {
+	_, err := s.cmd("DEL", key)
+	return err
+}
+
+func (s *redisStore) Rename(oldKey, newKey string) error {
+	_, err := s.cmd("RENAME", oldKey, newKey)
+	return err
+}
+
+func (s *redisStore) AddToSet(key, member string) error {
+	_, err := s.cmd("SADD", key, member)
+	return err
+}
+
+func (s *redisStore) RemoveFromSet(key, member string) error {
+	_, err := s.cmd("SREM", key, member)
+	return err
+}
+
+func (s *redisStore) Members(key string) ([]string, error) {
+	response, err := s.cmd("SMEMBERS", key)
+	if err != nil {
+		return nil, err
+	}
+	return response.List()
+}
+
+func (s *redisStore) Increment(key string) (int, error) {
+	response, err := s.cmd("INCR", key)
+	if err != nil {
+		return 0, err
+	}
+	return response.Int()
+}
+
+// Clear deletes all the keys in the database. As a precautionary
+// measure, it also selects database 1, which is designated as the testing
+// database.
+func (s *redisStore) Clear() error {
+	p, err := s.getRedisConnection()
+	if err != nil {
+		return &StorageError{err}
+	}
+	// Since we're changing the selected database, this connection
+	// shouldn't go back into the pool.
+	defer p.Close()
+
+	response := p.Cmd("SELECT", 1)
+	if response.Err != nil {
+		return &StorageError{response.Err}
+	}
+
+	// Clear all keys in the database. This command cannot fail,
+	// according to redis docs.
+	return p.Cmd("FLUSHDB").Err
+}
+
+// If a watched key changes while a batch is being applied, we'll
+// start again from scratch, but only this many times.
+const maxBatchAttempts = 5
+
+// Apply uses a redis transaction (MULTI/EXEC) to apply all of the writes
+// in the batch at once. Redis transactions don't roll back if a command
+// fails, so the preconditions are checked beforehand, and the keys are
+// WATCHed so that the transaction is abandoned if anyone else changes
+// them in the meantime.
+func (s *redisStore) Apply(b *Batch) error {
+	p, err := s.getRedisConnection()
+	if err != nil {
+		return &StorageError{err}
+	}
+	defer s.pool.Put(p)
+
+	for attempt := 0; attempt < maxBatchAttempts; attempt++ {
+		applied, err := redisApply(p, b)
+		if err != nil {
+			// Make sure the connection goes back to the pool without
+			// any leftover state.
+			p.Cmd("UNWATCH")
+			return err
+		}
+		if applied {
+			return nil
+		}
+	}
+	return fmt.Errorf("gave up applying batch after %d attempts", maxBatchAttempts)
+}
+
+// Reads from redis for checking batch preconditions. Since the keys are
+// WATCHed first, the transaction will be abandoned if they change after
+// they've been read.
+type redisReader struct {
+	p *redis.Client
+}
+
+func (r redisReader) exists(key string) (bool, error) {
+	response := r.p.Cmd("EXISTS", key)
+	if response.IsType(redis.IOErr) {
+		return false, &StorageError{response.Err}
+	}
+	exists, err := response.Int()
+	return exists == 1, err
+}
+
+func (r redisReader) field(key, field string) (string, error) {
+	response := r.p.Cmd("HGET", key, field)
+	if response.IsType(redis.IOErr) {
+		return "", &StorageError{response.Err}
+	}
+	if response.IsType(redis.Nil) {
+		return "", nil
+	}
+	return response.Str()
+}
+
+// Tries to apply the batch once. It returns false if the transaction was
+// abandoned because one of the watched keys changed.
+func redisApply(p *redis.Client, b *Batch) (bool, error) {
+	result := func(response *redis.Resp) error {
+		if response.IsType(redis.IOErr) {
+			return &StorageError{response.Err}
+		}
+		return response.Err
+	}
+
+	if keys := b.keys(); len(keys) > 0 {
+		err := result(p.Cmd("WATCH", keys))
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err := b.check(redisReader{p})
+	if err != nil {
+		return false, err
+	}
+
+	err = result(p.Cmd("MULTI"))
+	if err != nil {
+		return false, err
+	}
+	for _, op := range b.ops {
+		var response *redis.Resp
+		switch op.command {
+		case "HMSET":
+			response = p.Cmd(op.command, op.key, op.fields)
+		case "DEL":
+			response = p.Cmd(op.command, op.key)
+		default:
+			response = p.Cmd(op.command, op.key, op.arg)
+		}
+		if err := result(response); err != nil {
+			p.Cmd("DISCARD")
+			return false, err
+		}
+	}
+
+	response := p.Cmd("EXEC")
+	if err := result(response); err != nil {
+		return false, err
+	}
+	if response.IsType(redis.Nil) {
+		return false, nil
+	}
+
+	// The preconditions should stop any of the commands failing, but
+	// if one does, the others will have been applied anyway.
+	responses, err := response.Array()
+	if err != nil {
+		return false, err
+	}
+	for _, r := range responses {
+		if r.Err != nil {
+			log.Printf("Command in redis transaction failed: %v", r.Err)
+			return true, r.Err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,169 @@
+/*
+  revisions.go
+
+  Every time a page is saved, a copy of it is kept as a PageRevision, so
+  that accidental overwrites can be undone. Only the most recent revisions
+  are kept, according to AppConfig.RevisionLimit.
+*/
+
+package models
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// A PageRevision is a copy of a page as it was at one of its revisions.
+// It's stored in the database under the key:
+//    revisions:[domain]:[page_name]:[revision]
+// and a list of those keys are stored under the
+//    revisions:[domain]:[page_name]
+// list.
+type PageRevision struct {
+	Domain   string    `json:"domain"`
+	PageName string    `json:"page_name"`
+	Revision int       `json:"revision"`
+	Author   string    `json:"author"`
+	Created  time.Time `json:"created"`
+	Markdown string    `json:"markdown"`
+}
+
+// MakeDefault sets default values for the revision. There aren't any.
+func (r *PageRevision) MakeDefault() {}
+
+// Export returns the fields which are acceptable to send directly to
+// the client over the web. The contents of the revision are left out,
+// since they're usually fetched as a diff.
+func (r *PageRevision) Export() map[string]interface{} {
+	return map[string]interface{}{
+		"revision": r.Revision,
+		"author":   r.Author,
+		"created":  r.Created,
+	}
+}
+
+// RegistrationKey defines the set to which this revision will
+// belong. It'll be of the form:
+//    revisions:[domain]:[page_name]
+func (r *PageRevision) RegistrationKey() string {
+	return fmt.Sprintf("revisions:%s:%s", r.Domain, r.PageName)
+}
+
+// Key returns a unique key for use in the redis database.
+func (r *PageRevision) Key() string {
+	return fmt.Sprintf("revisions:%s:%s:%d", r.Domain, r.PageName, r.Revision)
+}
+
+// Validate checks that the revision belongs to a valid page.
+func (r *PageRevision) Validate() bool {
+	if !domainValidator.MatchString(r.Domain) {
+		log.Printf("Validation failed on revision of %s, illegal domain '%s'\n", r.PageName, r.Domain)
+		return false
+	}
+
+	if !ValidPagePath(r.PageName) {
+		log.Printf("Validation failed on revision of %s, illegal path '%s'\n", r.PageName, r.PageName)
+		return false
+	}
+
+	return r.Revision > 0
+}
+
+// Diff returns a unified diff which turns the markdown of this revision
+// into the markdown of the other one.
+func (r *PageRevision) Diff(other *PageRevision) (string, error) {
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(r.Markdown),
+		B:        difflib.SplitLines(other.Markdown),
+		FromFile: fmt.Sprintf("%s@%d", r.PageName, r.Revision),
+		ToFile:   fmt.Sprintf("%s@%d", other.PageName, other.Revision),
+		Context:  3,
+	})
+}
+
+// Returns the revision number at the end of a revision's key, or
+// zero if the key doesn't end in one.
+func revisionFromKey(key string) int {
+	revision, err := strconv.Atoi(key[strings.LastIndex(key, ":")+1:])
+	if err != nil {
+		return 0
+	}
+	return revision
+}
+
+// Adds the writes which record the page's new revision to the batch that
+// saves the page. Revisions which are too old to keep are deleted, as
+// are any left over from a deleted page which had the same name.
+func (p *Page) saveRevision(b *Batch) error {
+	r := &PageRevision{
+		Domain:   p.Domain,
+		PageName: p.Name,
+		Revision: p.Revision,
+		Author:   p.EditedBy,
+		Created:  time.Now(),
+		Markdown: p.Markdown,
+	}
+	fields, err := encodeModel(r)
+	if err != nil {
+		return err
+	}
+	b.Save(r.Key(), fields)
+	b.AddToSet(r.RegistrationKey(), r.Key())
+
+	// The batch only succeeds if nobody else saved the page after we
+	// loaded it, so the list of revisions can't change underneath us.
+	keys, err := store.Members(r.RegistrationKey())
+	if err != nil {
+		return err
+	}
+	oldest := 1
+	if AppConfig.RevisionLimit > 0 {
+		oldest = p.Revision - AppConfig.RevisionLimit + 1
+	}
+	for _, key := range keys {
+		revision := revisionFromKey(key)
+		if revision < oldest || revision > p.Revision {
+			b.Delete(key)
+			b.RemoveFromSet(r.RegistrationKey(), key)
+		}
+	}
+	return nil
+}
+
+// Adds the writes which delete all of the page's revisions to the batch
+// that deletes the page.
+func (p *Page) deleteRevisions(b *Batch) error {
+	r := &PageRevision{Domain: p.Domain, PageName: p.Name}
+	keys, err := store.Members(r.RegistrationKey())
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		b.Delete(key)
+	}
+	b.Delete(r.RegistrationKey())
+	return nil
+}
+
+// Adds the writes which move the page's revisions from its old name to
+// its current name to the batch that renames the page.
+func (p *Page) renameRevisions(b *Batch, oldName string) error {
+	old := &PageRevision{Domain: p.Domain, PageName: oldName}
+	keys, err := store.Members(old.RegistrationKey())
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		r := &PageRevision{Domain: p.Domain, PageName: p.Name, Revision: revisionFromKey(key)}
+		b.Rename(key, r.Key())
+		b.Save(r.Key(), map[string]string{"page_name": p.Name})
+		b.AddToSet(r.RegistrationKey(), r.Key())
+	}
+	b.Delete(old.RegistrationKey())
+	return nil
+}
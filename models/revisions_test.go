@@ -0,0 +1,94 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Returns the revision numbers stored for the page, in order.
+func storedRevisions(t *testing.T, p *Page) []int {
+	r := &PageRevision{Domain: p.Domain, PageName: p.Name}
+	keys, err := store.Members(r.RegistrationKey())
+	if err != nil {
+		t.Fatalf("Couldn't list revisions: %v", err)
+	}
+	revisions := []int{}
+	for _, key := range keys {
+		revisions = append(revisions, revisionFromKey(key))
+	}
+	sort.Ints(revisions)
+	return revisions
+}
+
+func TestPageRevisionHistory(t *testing.T) {
+	limit := AppConfig.RevisionLimit
+	AppConfig.RevisionLimit = 3
+	defer func() { AppConfig.RevisionLimit = limit }()
+
+	p := &Page{Domain: "testdomain", Name: "history.md", Markdown: "one", EditedBy: "alice"}
+	err := Insert(p)
+	if err != nil {
+		t.Fatalf("Failed to insert page: %v", err)
+	}
+	for _, markdown := range []string{"two", "three", "four"} {
+		p.Markdown = markdown
+		p.EditedBy = "bob"
+		err = Save(p)
+		if err != nil {
+			t.Fatalf("Failed to save page: %v", err)
+		}
+	}
+
+	revisions := storedRevisions(t, p)
+	if len(revisions) != 3 || revisions[0] != 2 || revisions[2] != 4 {
+		t.Fatalf("Expected only the last 3 revisions to be kept, got %v", revisions)
+	}
+
+	r := &PageRevision{Domain: p.Domain, PageName: p.Name, Revision: 2}
+	err = Load(r)
+	if err != nil {
+		t.Fatalf("Couldn't load revision: %v", err)
+	}
+	if r.Markdown != "two" || r.Author != "bob" || r.Created.IsZero() {
+		t.Fatalf("Revision wasn't recorded properly: %v", r)
+	}
+
+	latest := &PageRevision{Domain: p.Domain, PageName: p.Name, Revision: 4}
+	Load(latest)
+	diff, err := r.Diff(latest)
+	if err != nil {
+		t.Fatalf("Couldn't diff revisions: %v", err)
+	}
+	if !strings.Contains(diff, "-two") || !strings.Contains(diff, "+four") {
+		t.Fatalf("Unexpected diff:\n%s", diff)
+	}
+
+	// Renaming the page takes its history with it.
+	err = p.RenamePage("renamed_history.md")
+	if err != nil {
+		t.Fatalf("Couldn't rename page: %v", err)
+	}
+	if len(storedRevisions(t, &Page{Domain: "testdomain", Name: "history.md"})) != 0 {
+		t.Fatalf("Revisions were left behind under the old name.")
+	}
+	revisions = storedRevisions(t, p)
+	if len(revisions) != 3 {
+		t.Fatalf("Revisions weren't moved to the new name, got %v", revisions)
+	}
+	r = &PageRevision{Domain: p.Domain, PageName: p.Name, Revision: 3}
+	err = Load(r)
+	if err != nil || r.PageName != "renamed_history.md" || r.Markdown != "three" {
+		t.Fatalf("Revision wasn't moved properly: %v %v", r, err)
+	}
+
+	// Deleting the page deletes its history too, so a new page with
+	// the same name starts from scratch.
+	err = Delete(p)
+	if err != nil {
+		t.Fatalf("Couldn't delete page: %v", err)
+	}
+	if len(storedRevisions(t, p)) != 0 {
+		t.Fatalf("Revisions were left behind after deleting the page.")
+	}
+}
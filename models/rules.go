@@ -0,0 +1,202 @@
+/*
+  rules.go
+
+  Each site can have a rules file, which redirects or rewrites some of
+  its URLs and adds headers to its responses. It's mostly useful for
+  keeping old URLs working after moving a site from somewhere else.
+*/
+
+package models
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// SiteRules is a site's rules file. It's stored in the database under
+// the key:
+//    rules:[domain]
+// Each line of the file is either a redirect, like:
+//    /old/page    /new/page    301
+//    /blog/*      /posts/:splat
+//    /app/*       /app/index.md    200
+// or the start of a list of headers for the paths matching a pattern,
+// with one indented header on each of the lines after it:
+//    /files/*
+//      Cache-Control: public, max-age=86400
+// A pattern ending in * matches every path that starts with the rest of
+// it, and whatever the * matched replaces :splat in the destination.
+// Redirects are permanent unless they give another status, and a status
+// of 200 serves the destination in place of the original path rather than
+// redirecting to it. Lines starting with # are comments.
+type SiteRules struct {
+	Domain string `json:"domain"`
+	Text   string `json:"text"`
+}
+
+// A RedirectRule sends visitors from the paths matching a pattern to
+// another URL, or serves another path in their place.
+type RedirectRule struct {
+	From   string
+	To     string
+	Status int
+}
+
+// A HeaderRule adds headers to the responses for the paths matching a
+// pattern.
+type HeaderRule struct {
+	Path    string
+	Headers http.Header
+}
+
+// The statuses which redirects can use. A rewrite is written as 200,
+// since that's what the visitor gets.
+var redirectStatuses = map[int]bool{
+	http.StatusOK:                true,
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusSeeOther:          true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+// Headers which sites aren't allowed to set. Cookies would be visible to
+// the rest of the service, and the others are managed by the server.
+var forbiddenHeaders = map[string]bool{
+	"Set-Cookie":        true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+}
+
+// MakeDefault sets default values for the rules. There aren't any.
+func (s *SiteRules) MakeDefault() {}
+
+// Export returns the fields which are acceptable to send directly to
+// the client over the web.
+func (s *SiteRules) Export() map[string]interface{} {
+	return map[string]interface{}{
+		"text": s.Text,
+	}
+}
+
+// RegistrationKey defines the set to which the rules will belong. All
+// users' rules are siblings.
+func (s *SiteRules) RegistrationKey() string {
+	return "rules"
+}
+
+// Key returns a unique key for use in the redis database.
+func (s *SiteRules) Key() string {
+	return fmt.Sprintf("rules:%s", s.Domain)
+}
+
+// Validate checks that the rules belong to a valid domain, and that they
+// can be parsed.
+func (s *SiteRules) Validate() bool {
+	if !domainValidator.MatchString(s.Domain) {
+		log.Printf("Validation failed on rules, illegal domain '%s'\n", s.Domain)
+		return false
+	}
+
+	_, _, err := s.Parse()
+	if err != nil {
+		log.Printf("Validation failed on rules for %s: %v\n", s.Domain, err)
+		return false
+	}
+
+	return true
+}
+
+// Parse reads the redirects and headers from the rules file. The error
+// says which line is wrong, so that the user can fix it.
+func (s *SiteRules) Parse() ([]RedirectRule, []HeaderRule, error) {
+	redirects := []RedirectRule{}
+	headers := []HeaderRule{}
+	for i, line := range strings.Split(s.Text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		// Indented lines are headers for the last pattern.
+		if line[0] == ' ' || line[0] == '\t' {
+			colon := strings.Index(line, ":")
+			if len(headers) == 0 || colon == -1 {
+				return nil, nil, fmt.Errorf("line %d: expected a header after a path", i+1)
+			}
+			name := http.CanonicalHeaderKey(strings.TrimSpace(line[:colon]))
+			if name == "" || strings.ContainsAny(name, " \t") || forbiddenHeaders[name] {
+				return nil, nil, fmt.Errorf("line %d: can't set the header `%s`", i+1, name)
+			}
+			headers[len(headers)-1].Headers.Add(name, strings.TrimSpace(line[colon+1:]))
+			continue
+		}
+
+		if !validRulePattern(fields[0]) {
+			return nil, nil, fmt.Errorf("line %d: `%s` isn't a path", i+1, fields[0])
+		}
+		switch len(fields) {
+		case 1:
+			headers = append(headers, HeaderRule{Path: fields[0], Headers: http.Header{}})
+		case 2, 3:
+			rule := RedirectRule{From: fields[0], To: fields[1], Status: http.StatusMovedPermanently}
+			if len(fields) == 3 {
+				status, err := strconv.Atoi(fields[2])
+				if err != nil || !redirectStatuses[status] {
+					return nil, nil, fmt.Errorf("line %d: `%s` isn't a redirect status", i+1, fields[2])
+				}
+				rule.Status = status
+			}
+			to, err := url.Parse(rule.To)
+			if err != nil || (to.Host == "" && !strings.HasPrefix(to.Path, "/")) {
+				return nil, nil, fmt.Errorf("line %d: `%s` isn't a path or URL", i+1, rule.To)
+			}
+			if rule.Status == http.StatusOK && to.Host != "" {
+				return nil, nil, fmt.Errorf("line %d: only paths on the site can be rewritten", i+1)
+			}
+			redirects = append(redirects, rule)
+		default:
+			return nil, nil, fmt.Errorf("line %d: expected a path, a destination and a status", i+1)
+		}
+	}
+	return redirects, headers, nil
+}
+
+// Patterns are paths, which can end in a wildcard.
+func validRulePattern(pattern string) bool {
+	return strings.HasPrefix(pattern, "/") && !strings.Contains(strings.TrimSuffix(pattern, "*"), "*")
+}
+
+// Reports whether the path matches the pattern, and if so, what the
+// wildcard at the end of the pattern matched.
+func matchRulePattern(pattern, path string) (string, bool) {
+	if !strings.HasSuffix(pattern, "*") {
+		return "", path == pattern
+	}
+	prefix := strings.TrimSuffix(pattern, "*")
+	if !strings.HasPrefix(path, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(path, prefix), true
+}
+
+// Match reports whether the redirect applies to the path, and if so,
+// where it goes.
+func (r RedirectRule) Match(path string) (string, bool) {
+	splat, ok := matchRulePattern(r.From, path)
+	if !ok {
+		return "", false
+	}
+	return strings.Replace(r.To, ":splat", splat, -1), true
+}
+
+// Match reports whether the headers apply to the path.
+func (h HeaderRule) Match(path string) bool {
+	_, ok := matchRulePattern(h.Path, path)
+	return ok
+}
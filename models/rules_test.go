@@ -0,0 +1,56 @@
+package models
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	s := SiteRules{Domain: "rulesdomain", Text: "# Moved from the old host\n" +
+		"/old    /new\n" +
+		"/blog/*    https://blog.example.com/:splat    302\n" +
+		"/app/*    /app/index.md    200\n" +
+		"\n" +
+		"/files/*\n" +
+		"  Cache-Control: public, max-age=60\n" +
+		"  X-Robots-Tag: noindex\n"}
+	redirects, headers, err := s.Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	if len(redirects) != 3 || len(headers) != 1 {
+		t.Fatalf("Expected 3 redirects and 1 header rule, got %v and %v", redirects, headers)
+	}
+
+	if to, ok := redirects[0].Match("/old"); !ok || to != "/new" || redirects[0].Status != http.StatusMovedPermanently {
+		t.Fatalf("Expected a permanent redirect to /new, got %v %v", to, redirects[0])
+	}
+	if _, ok := redirects[0].Match("/older"); ok {
+		t.Fatalf("Exact rules shouldn't match other paths")
+	}
+	if to, ok := redirects[1].Match("/blog/2020/hello"); !ok || to != "https://blog.example.com/2020/hello" {
+		t.Fatalf("Expected the wildcard to be substituted, got %v", to)
+	}
+	if !headers[0].Match("/files/photo.png") || headers[0].Headers.Get("X-Robots-Tag") != "noindex" {
+		t.Fatalf("Unexpected header rule: %v", headers[0])
+	}
+	if !s.Validate() {
+		t.Fatalf("Valid rules failed to validate")
+	}
+
+	for _, text := range []string{
+		"  Cache-Control: none",
+		"old /new",
+		"/old /new 404",
+		"/old new",
+		"/old https://example.com/ 200",
+		"/*/old /new",
+		"/files/*\n  Set-Cookie: session=1",
+		"/old /new 301 extra",
+	} {
+		s.Text = text
+		if _, _, err := s.Parse(); err == nil {
+			t.Fatalf("Expected an error parsing `%s`", text)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+/*
+  search.go
+
+  Pages are kept in an inverted index, so that they can be searched. The
+  index is updated in the same batch as the page whenever it's saved,
+  renamed, published or deleted, so it always matches the pages.
+*/
+
+package models
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/colin353/markdown.ninja/render"
+)
+
+// A SearchResult is a page which matched a search. The snippet is HTML,
+// with the matching words highlighted.
+type SearchResult struct {
+	Name    string  `json:"name"`
+	Title   string  `json:"title"`
+	Path    string  `json:"path"`
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"`
+}
+
+// Words which appear in these parts of the page count for more than
+// words in the body.
+const (
+	titleWeight       = 5
+	nameWeight        = 3
+	descriptionWeight = 2
+)
+
+// The number of characters of text around the first match shown in
+// the snippet.
+const snippetLength = 160
+
+var wordPattern = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// Splits text into the lowercase words which are indexed. Single
+// characters aren't worth indexing.
+func searchTerms(text string) []string {
+	terms := []string{}
+	for _, word := range wordPattern.FindAllString(strings.ToLower(text), -1) {
+		if len(word) > 1 {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// Returns the key of the set of pages which contain the term.
+func (p *Page) searchTermKey(term string) string {
+	return fmt.Sprintf("search:%s:%s:%s", p.table(), p.Domain, term)
+}
+
+// Returns the key of the hash which records how often each term
+// appears in the page.
+func (p *Page) searchIndexKey() string {
+	return "searchterms:" + p.Key()
+}
+
+// Counts the terms in the page, giving extra weight to the ones in its
+// title, name and description.
+func (p *Page) termCounts() map[string]int {
+	counts := map[string]int{}
+	add := func(text string, weight int) {
+		for _, term := range searchTerms(text) {
+			counts[term] += weight
+		}
+	}
+	_, markdown := render.SplitFrontMatter(p.Markdown)
+	add(markdown, 1)
+	add(p.Title, titleWeight)
+	add(strings.TrimSuffix(p.Name, ".md"), nameWeight)
+	add(p.Description, descriptionWeight)
+	return counts
+}
+
+// Adds the writes which index the page to the batch that saves it. The
+// terms which the page used to contain are removed from the index.
+func (p *Page) saveSearchIndex(b *Batch) error {
+	old, err := store.Load(p.searchIndexKey())
+	if err != nil {
+		return err
+	}
+	counts := p.termCounts()
+	for term := range old {
+		if _, ok := counts[term]; !ok {
+			b.RemoveFromSet(p.searchTermKey(term), p.Name)
+		}
+	}
+
+	fields := map[string]string{}
+	for term, count := range counts {
+		b.AddToSet(p.searchTermKey(term), p.Name)
+		fields[term] = strconv.Itoa(count)
+	}
+	b.Delete(p.searchIndexKey())
+	if len(fields) > 0 {
+		b.Save(p.searchIndexKey(), fields)
+	}
+	return nil
+}
+
+// Adds the writes which remove the page from the index to the batch
+// that deletes it.
+func (p *Page) deleteSearchIndex(b *Batch) error {
+	old, err := store.Load(p.searchIndexKey())
+	if err != nil {
+		return err
+	}
+	for term := range old {
+		b.RemoveFromSet(p.searchTermKey(term), p.Name)
+	}
+	b.Delete(p.searchIndexKey())
+	return nil
+}
+
+// Search returns the pages in the domain which contain every word in
+// the query, best matches first. If published is set, only the published
+// copies of pages which are listed on the site are searched, otherwise
+// the drafts are. Pages are ranked by how often they use each word, with
+// rare words counting for more.
+func Search(domain string, published bool, query string, limit int) ([]SearchResult, error) {
+	prototype := &Page{Published: published, Domain: domain}
+	terms := []string{}
+	seen := map[string]bool{}
+	for _, term := range searchTerms(query) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	if len(terms) == 0 {
+		return []SearchResult{}, nil
+	}
+
+	allPages, err := store.Members(prototype.RegistrationKey())
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the pages which contain every term, and how rare each one is.
+	var candidates map[string]bool
+	rarity := map[string]float64{}
+	for _, term := range terms {
+		names, err := store.Members(prototype.searchTermKey(term))
+		if err != nil {
+			return nil, err
+		}
+		rarity[term] = 1 + math.Log(float64(len(allPages)+1)/float64(len(names)+1))
+
+		matches := map[string]bool{}
+		for _, name := range names {
+			if candidates == nil || candidates[name] {
+				matches[name] = true
+			}
+		}
+		candidates = matches
+	}
+
+	results := []SearchResult{}
+	for name := range candidates {
+		p := &Page{Published: published, Domain: domain, Name: name}
+		counts, err := store.Load(p.searchIndexKey())
+		if err != nil {
+			return nil, err
+		}
+		score := 0.0
+		for _, term := range terms {
+			count, _ := strconv.Atoi(counts[term])
+			score += float64(count) * rarity[term]
+		}
+		results = append(results, SearchResult{Name: name, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Name < results[j].Name
+	})
+
+	// Only the pages which are returned need to be loaded. Visitors only
+	// find the pages which are listed on the site.
+	rules, err := LoadAccessRules(domain)
+	if err != nil {
+		return nil, err
+	}
+	shown := []SearchResult{}
+	for _, result := range results {
+		if len(shown) == limit {
+			break
+		}
+		if published && !rules.For(domain, result.Name).Listed() {
+			continue
+		}
+		p := &Page{Published: published, Domain: domain, Name: result.Name}
+		err = Load(p)
+		if IsStorageError(err) {
+			return nil, err
+		}
+		if err != nil || (published && p.Draft) {
+			continue
+		}
+		result.Title = p.DisplayTitle()
+		result.Path = PageURLPath(p.Name)
+		result.Snippet = searchSnippet(render.PlainText(p.HTML), seen)
+		shown = append(shown, result)
+	}
+	return shown, nil
+}
+
+// Returns an HTML snippet of the text around the first word that matches
+// one of the terms, with the matching words highlighted.
+func searchSnippet(text string, terms map[string]bool) string {
+	words := wordPattern.FindAllStringIndex(text, -1)
+	start := 0
+	for _, word := range words {
+		if terms[strings.ToLower(text[word[0]:word[1]])] {
+			start = word[0] - snippetLength/4
+			break
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetLength
+	if end > len(text) {
+		end = len(text)
+	}
+
+	// The offsets are in bytes, so they could be in the middle of a
+	// character which isn't part of a word, like a dash.
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end--
+	}
+
+	// Only break the text between words.
+	for _, word := range words {
+		if word[0] < start && word[1] > start {
+			start = word[1]
+		}
+		if word[0] < end && word[1] > end {
+			end = word[0]
+		}
+	}
+	for start < end && text[start] == ' ' {
+		start++
+	}
+	for end > start && text[end-1] == ' ' {
+		end--
+	}
+
+	snippet := ""
+	if start > 0 {
+		snippet = "…"
+	}
+	position := start
+	for _, word := range words {
+		if word[0] < start || word[1] > end {
+			continue
+		}
+		if terms[strings.ToLower(text[word[0]:word[1]])] {
+			snippet += html.EscapeString(text[position:word[0]])
+			snippet += "<mark>" + html.EscapeString(text[word[0]:word[1]]) + "</mark>"
+			position = word[1]
+		}
+	}
+	snippet += html.EscapeString(text[position:end])
+	if end < len(text) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+// IndexExistingPages adds every page which was saved before pages were
+// indexed to the search index and the index of links. Each index is only
+// built the first time this is run.
+func IndexExistingPages() error {
+	err := indexExistingPages("search_index", (*Page).saveSearchIndex)
+	if err != nil {
+		return err
+	}
+	return indexExistingPages("links_index", (*Page).saveLinks)
+}
+
+// Runs the migration with the given name, which adds each existing page
+// to an index.
+func indexExistingPages(migration string, index func(*Page, *Batch) error) error {
+	migrations, err := store.Load(migrationsKey)
+	if err != nil || migrations[migration] != "" {
+		return err
+	}
+
+	users, err := GetList(&User{})
+	if err != nil {
+		return err
+	}
+	domains := []string{}
+	for users.Next() {
+		domains = append(domains, users.Value().(*User).Domain)
+	}
+	if users.Err() != nil {
+		return users.Err()
+	}
+
+	for _, domain := range domains {
+		for _, published := range []bool{false, true} {
+			pages, err := GetList(&Page{Published: published, Domain: domain})
+			if err != nil {
+				return err
+			}
+			for pages.Next() {
+				b := &Batch{}
+				err = index(pages.Value().(*Page), b)
+				if err == nil {
+					err = store.Apply(b)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			if pages.Err() != nil {
+				return pages.Err()
+			}
+		}
+	}
+
+	return store.Save(migrationsKey, map[string]string{migration: time.Now().Format(time.RFC3339)})
+}
@@ -0,0 +1,111 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func searchNames(t *testing.T, domain string, published bool, query string) []string {
+	results, err := Search(domain, published, query, 10)
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	names := []string{}
+	for _, result := range results {
+		names = append(names, result.Name)
+	}
+	return names
+}
+
+func TestSearchIndex(t *testing.T) {
+	fox := &Page{Domain: "searchdomain", Name: "fox.md", Markdown: "The quick brown fox jumps over the lazy dog."}
+	dogs := &Page{Domain: "searchdomain", Name: "dogs.md", Markdown: "---\ntitle: All about dogs\n---\nA dog is a good friend."}
+	for _, p := range []*Page{fox, dogs} {
+		err := Insert(p)
+		if err != nil {
+			t.Fatalf("Failed to insert page: %v", err)
+		}
+	}
+
+	// Words in the title count for more. Every word has to match.
+	names := searchNames(t, "searchdomain", false, "Dog")
+	if len(names) != 2 || names[0] != "dogs.md" {
+		t.Fatalf("Expected both pages, dogs first, got %v", names)
+	}
+	names = searchNames(t, "searchdomain", false, "lazy DOG")
+	if len(names) != 1 || names[0] != "fox.md" {
+		t.Fatalf("Expected only the fox page, got %v", names)
+	}
+
+	results, _ := Search("searchdomain", false, "lazy", 10)
+	if results[0].Snippet != "The quick brown fox jumps over the <mark>lazy</mark> dog." || results[0].Path != "/fox" {
+		t.Fatalf("Unexpected result: %+v", results[0])
+	}
+
+	// Words which are removed from the page are removed from the index.
+	fox.Markdown = "The quick brown fox sleeps."
+	err := Save(fox)
+	if err != nil {
+		t.Fatalf("Failed to save page: %v", err)
+	}
+	if names = searchNames(t, "searchdomain", false, "lazy"); len(names) != 0 {
+		t.Fatalf("Expected no results after the word was removed, got %v", names)
+	}
+
+	// Only published pages are found when searching the published site.
+	if names = searchNames(t, "searchdomain", true, "fox"); len(names) != 0 {
+		t.Fatalf("Unpublished pages shouldn't be found, got %v", names)
+	}
+	fox.Publish()
+	if names = searchNames(t, "searchdomain", true, "fox"); len(names) != 1 {
+		t.Fatalf("Published page should be found, got %v", names)
+	}
+
+	// Renaming and deleting the page update the index, including for the
+	// published copy.
+	err = fox.RenamePage("renamed_fox.md")
+	if err != nil {
+		t.Fatalf("Failed to rename page: %v", err)
+	}
+	for _, published := range []bool{false, true} {
+		names = searchNames(t, "searchdomain", published, "sleeps")
+		if len(names) != 1 || names[0] != "renamed_fox.md" {
+			t.Fatalf("Expected the renamed page, got %v", names)
+		}
+	}
+	err = Delete(fox)
+	if err != nil {
+		t.Fatalf("Failed to delete page: %v", err)
+	}
+	for _, published := range []bool{false, true} {
+		if names = searchNames(t, "searchdomain", published, "fox"); len(names) != 0 {
+			t.Fatalf("Deleted page shouldn't be found, got %v", names)
+		}
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	text := "Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua. Ut enim ad minim veniam, quis nostrud exercitation ullamco laboris nisi ut aliquip ex ea commodo consequat. <Duis> aute irure dolor."
+	snippet := searchSnippet(text, map[string]bool{"duis": true, "dolor": true})
+	if snippet != "Lorem ipsum <mark>dolor</mark> sit amet, consectetur adipiscing elit, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua. Ut enim ad minim veniam, quis…" {
+		t.Fatalf("Unexpected snippet: %s", snippet)
+	}
+
+	snippet = searchSnippet(text, map[string]bool{"duis": true})
+	if snippet != "…ut aliquip ex ea commodo consequat. &lt;<mark>Duis</mark>&gt; aute irure dolor." {
+		t.Fatalf("Unexpected snippet: %s", snippet)
+	}
+}
+
+func TestSearchSnippetPunctuation(t *testing.T) {
+	// Dashes and ellipses take up more than one byte, and the snippet
+	// shouldn't cut them in half, wherever they fall.
+	for offset := 0; offset < 4; offset++ {
+		text := strings.Repeat("x", offset) + strings.Repeat("ab—cd…", 40) + "target" + strings.Repeat("—ef…", 60)
+		snippet := searchSnippet(text, map[string]bool{"target": true})
+		if !utf8.ValidString(snippet) || !strings.Contains(snippet, "<mark>target</mark>") {
+			t.Fatalf("Unexpected snippet: %q", snippet)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+/*
+  store.go
+
+  The Store interface describes the backend that models are persisted
+  to. Models are always stored as flat hashes of strings, and each model
+  registers its key in a set so that its siblings can be listed later.
+  Redis implements this natively, and the other backends emulate it.
+*/
+
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// A Store is a key-value backend which can hold models. Every method
+// mirrors a simple redis command, which keeps the redis implementation
+// thin and gives the other implementations a clear reference for how
+// they should behave.
+type Store interface {
+	// Exists reports whether anything is stored under the key.
+	Exists(key string) (bool, error)
+	// Load returns all the fields of the hash stored at key. If
+	// the key doesn't exist, it returns an empty map.
+	Load(key string) (map[string]string, error)
+	// Save merges the fields into the hash stored at key, creating
+	// the hash if it doesn't already exist.
+	Save(key string, fields map[string]string) error
+	// Delete removes the key. Deleting a missing key isn't an error.
+	Delete(key string) error
+	// Rename moves the value stored at oldKey to newKey, replacing
+	// anything that was stored at newKey.
+	Rename(oldKey, newKey string) error
+	// AddToSet adds a member to the set stored at key.
+	AddToSet(key, member string) error
+	// RemoveFromSet removes a member from the set stored at key.
+	RemoveFromSet(key, member string) error
+	// Members lists all the members of the set stored at key.
+	Members(key string) ([]string, error)
+	// Increment atomically increments the counter at key and
+	// returns the new value.
+	Increment(key string) (int, error)
+	// Clear deletes everything in the store.
+	Clear() error
+	// Apply checks the preconditions of the batch, and then applies
+	// all of its writes. Either all of the writes happen, or none of
+	// them do.
+	Apply(b *Batch) error
+}
+
+// A Batch is a list of writes which must be applied to the store all
+// at once, so that a crash halfway through can't leave a model saved
+// without being registered (or registered without being saved). A batch
+// can also require that keys exist (or don't exist) before it's applied.
+type Batch struct {
+	conditions []batchCondition
+	ops        []batchOp
+}
+
+// A condition either checks whether a key exists, or if field is set,
+// checks that the integer stored in that field of the hash has the
+// expected value.
+type batchCondition struct {
+	key    string
+	exists bool
+	field  string
+	value  int
+}
+
+// Each write is named after the equivalent redis command. Depending on
+// the command, arg is either a set member or the new name of the key.
+type batchOp struct {
+	command string
+	key     string
+	arg     string
+	fields  map[string]string
+}
+
+// RequireExists makes the batch fail unless the key exists.
+func (b *Batch) RequireExists(key string) {
+	b.conditions = append(b.conditions, batchCondition{key: key, exists: true})
+}
+
+// RequireMissing makes the batch fail if the key exists.
+func (b *Batch) RequireMissing(key string) {
+	b.conditions = append(b.conditions, batchCondition{key: key, exists: false})
+}
+
+// RequireCounter makes the batch fail unless the hash at key exists, and
+// its field holds the given integer. A missing field counts as zero. This
+// is used to check that a model hasn't changed since it was loaded.
+func (b *Batch) RequireCounter(key, field string, value int) {
+	b.conditions = append(b.conditions, batchCondition{key: key, exists: true, field: field, value: value})
+}
+
+// Save adds a write which merges the fields into the hash at key.
+func (b *Batch) Save(key string, fields map[string]string) {
+	b.ops = append(b.ops, batchOp{command: "HMSET", key: key, fields: fields})
+}
+
+// Delete adds a write which deletes the key.
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{command: "DEL", key: key})
+}
+
+// Rename adds a write which moves the value at oldKey to newKey.
+func (b *Batch) Rename(oldKey, newKey string) {
+	b.ops = append(b.ops, batchOp{command: "RENAME", key: oldKey, arg: newKey})
+}
+
+// AddToSet adds a write which adds a member to the set at key.
+func (b *Batch) AddToSet(key, member string) {
+	b.ops = append(b.ops, batchOp{command: "SADD", key: key, arg: member})
+}
+
+// RemoveFromSet adds a write which removes a member from the set at key.
+func (b *Batch) RemoveFromSet(key, member string) {
+	b.ops = append(b.ops, batchOp{command: "SREM", key: key, arg: member})
+}
+
+// Adds all of the preconditions and writes of the other batch to this
+// one, so that they're applied together.
+func (b *Batch) append(other *Batch) {
+	b.conditions = append(b.conditions, other.conditions...)
+	b.ops = append(b.ops, other.ops...)
+}
+
+// Returns every key which the batch reads or writes.
+func (b *Batch) keys() []string {
+	seen := make(map[string]bool)
+	keys := []string{}
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for _, c := range b.conditions {
+		add(c.key)
+	}
+	for _, op := range b.ops {
+		add(op.key)
+		if op.command == "RENAME" {
+			add(op.arg)
+		}
+	}
+	return keys
+}
+
+// A PreconditionError is returned when a batch isn't applied because
+// one of its preconditions didn't hold. If the problem was the value of
+// a counter, Field and Value describe what was actually stored.
+type PreconditionError struct {
+	Key    string
+	Exists bool
+	Field  string
+	Value  int
+}
+
+func (e *PreconditionError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("field `%s` of key `%s` is %d", e.Field, e.Key, e.Value)
+	}
+	if e.Exists {
+		return fmt.Sprintf("key `%s` already exists", e.Key)
+	}
+	return fmt.Sprintf("key `%s` doesn't exist", e.Key)
+}
+
+// The stores check preconditions by reading from the database in
+// whatever way makes sense for them, but the logic is shared.
+type batchReader interface {
+	exists(key string) (bool, error)
+	field(key, field string) (string, error)
+}
+
+// Checks the batch's preconditions using the given reader, returning
+// a PreconditionError for the first one that fails.
+func (b *Batch) check(r batchReader) error {
+	for _, c := range b.conditions {
+		e, err := r.exists(c.key)
+		if err != nil {
+			return err
+		}
+		if e != c.exists {
+			return &PreconditionError{Key: c.key, Exists: e}
+		}
+		if c.field == "" {
+			continue
+		}
+
+		value, err := r.field(c.key, c.field)
+		if err != nil {
+			return err
+		}
+		counter := 0
+		if value != "" {
+			counter, err = strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+		}
+		if counter != c.value {
+			return &PreconditionError{Key: c.key, Exists: true, Field: c.field, Value: counter}
+		}
+	}
+	return nil
+}
+
+// A StorageError means that the store itself failed, for example
+// because the redis server couldn't be reached. It's distinct from the
+// errors caused by invalid or missing models, since the same request
+// might succeed if it is retried later.
+type StorageError struct {
+	Err error
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("storage error: %v", e.Err)
+}
+
+// IsStorageError reports whether err was caused by a failure of the
+// store, rather than by the request itself.
+func IsStorageError(err error) bool {
+	_, ok := err.(*StorageError)
+	return ok
+}
+
+// Returned by the stores when trying to rename a key that doesn't exist.
+var errNoSuchKey = errors.New("no such key")
+
+// The store that all of the model functions dispatch through. It
+// is set up by Connect.
+var store Store
+
+// Connect sets up the storage backend selected by AppConfig.Database.
+// The options are "redis" (the default), "memory", which keeps everything
+// in memory and forgets it when the server stops, and "disk", which
+// keeps an embedded database in the file at AppConfig.DatabaseFile.
+func Connect() error {
+	var err error
+	store, err = newStore(AppConfig.Database)
+	if err != nil {
+		return fmt.Errorf("unable to connect to the %s database: %v", AppConfig.Database, err)
+	}
+	return nil
+}
+
+func newStore(backend string) (Store, error) {
+	switch backend {
+	case "", "redis":
+		return newRedisStore(AppConfig.RedisURL)
+	case "memory":
+		return newMemoryStore(), nil
+	case "disk":
+		return newDiskStore(AppConfig.DatabaseFile)
+	default:
+		return nil, fmt.Errorf("unknown database backend `%s`", backend)
+	}
+}
@@ -0,0 +1,336 @@
+package models
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Each of the backends that can run without any external services
+// are checked against the same behaviour.
+func testStores(t *testing.T, test func(*testing.T, Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryStore())
+	})
+
+	t.Run("disk", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "markdown-ninja")
+		if err != nil {
+			t.Fatalf("Couldn't create temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		s, err := newDiskStore(filepath.Join(dir, "test.db"))
+		if err != nil {
+			t.Fatalf("Couldn't open disk store: %v", err)
+		}
+		defer s.db.Close()
+		test(t, s)
+	})
+}
+
+func TestStoreHashes(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		exists, err := s.Exists("hash")
+		if err != nil || exists {
+			t.Fatalf("Hash shouldn't exist before it is saved.")
+		}
+
+		s.Save("hash", map[string]string{"a": "1", "b": "2"})
+		s.Save("hash", map[string]string{"b": "3"})
+
+		exists, _ = s.Exists("hash")
+		if !exists {
+			t.Fatalf("Hash should exist after it is saved.")
+		}
+
+		hash, err := s.Load("hash")
+		if err != nil {
+			t.Fatalf("Couldn't load hash: %v", err)
+		}
+		if hash["a"] != "1" || hash["b"] != "3" {
+			t.Fatalf("Saving should merge fields into the hash, got %v", hash)
+		}
+
+		err = s.Rename("hash", "renamed")
+		if err != nil {
+			t.Fatalf("Couldn't rename hash: %v", err)
+		}
+		hash, _ = s.Load("hash")
+		if len(hash) != 0 {
+			t.Fatalf("Old key should be empty after renaming, got %v", hash)
+		}
+		hash, _ = s.Load("renamed")
+		if hash["a"] != "1" {
+			t.Fatalf("New key should contain the hash after renaming, got %v", hash)
+		}
+
+		if s.Rename("missing", "other") == nil {
+			t.Fatalf("Shouldn't be able to rename a missing key.")
+		}
+
+		s.Delete("renamed")
+		exists, _ = s.Exists("renamed")
+		if exists {
+			t.Fatalf("Hash shouldn't exist after it is deleted.")
+		}
+	})
+}
+
+func TestStoreSets(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		s.AddToSet("set", "x")
+		s.AddToSet("set", "y")
+		s.AddToSet("set", "y")
+
+		members, err := s.Members("set")
+		if err != nil {
+			t.Fatalf("Couldn't list members: %v", err)
+		}
+		sort.Strings(members)
+		if len(members) != 2 || members[0] != "x" || members[1] != "y" {
+			t.Fatalf("Expected members [x y], got %v", members)
+		}
+
+		s.RemoveFromSet("set", "x")
+		s.RemoveFromSet("set", "y")
+		members, _ = s.Members("set")
+		if len(members) != 0 {
+			t.Fatalf("Expected no members, got %v", members)
+		}
+		exists, _ := s.Exists("set")
+		if exists {
+			t.Fatalf("Empty sets shouldn't exist.")
+		}
+	})
+}
+
+func TestStoreCounters(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		a, _ := s.Increment("counter")
+		b, _ := s.Increment("counter")
+		if a != 1 || b != 2 {
+			t.Fatalf("Expected counter to go 1, 2, got %v, %v", a, b)
+		}
+
+		s.Clear()
+		exists, _ := s.Exists("counter")
+		if exists {
+			t.Fatalf("Counter should be gone after clearing the store.")
+		}
+	})
+}
+
+// A brokenStore fails every operation, like a redis server which
+// has gone away.
+type brokenStore struct{}
+
+var errBroken = &StorageError{errors.New("connection refused")}
+
+func (brokenStore) Exists(string) (bool, error)            { return false, errBroken }
+func (brokenStore) Load(string) (map[string]string, error) { return nil, errBroken }
+func (brokenStore) Save(string, map[string]string) error   { return errBroken }
+func (brokenStore) Delete(string) error                    { return errBroken }
+func (brokenStore) Rename(string, string) error            { return errBroken }
+func (brokenStore) AddToSet(string, string) error          { return errBroken }
+func (brokenStore) RemoveFromSet(string, string) error     { return errBroken }
+func (brokenStore) Members(string) ([]string, error)       { return nil, errBroken }
+func (brokenStore) Increment(string) (int, error)          { return 0, errBroken }
+func (brokenStore) Clear() error                           { return errBroken }
+func (brokenStore) Apply(*Batch) error                     { return errBroken }
+
+func TestStorageErrorsPropagate(t *testing.T) {
+	working := store
+	store = brokenStore{}
+	defer func() { store = working }()
+
+	p := &Page{Domain: "testdomain", Name: "broken.md"}
+	checks := map[string]error{
+		"Insert": Insert(p),
+		"Save":   Save(p),
+		"Load":   Load(p),
+		"Delete": Delete(p),
+		"Rename": p.RenamePage("other.md"),
+		"Name":   p.GenerateName(),
+	}
+	_, err := GetList(p)
+	checks["GetList"] = err
+	_, err = MakeKeyForTable("test")
+	checks["MakeKeyForTable"] = err
+
+	for name, err := range checks {
+		if !IsStorageError(err) {
+			t.Errorf("%s should have returned a storage error, got %v", name, err)
+		}
+	}
+
+	if IsStorageError(errors.New("model failed to validate")) {
+		t.Errorf("Ordinary errors shouldn't be storage errors.")
+	}
+}
+
+func TestIteratorStopsOnStorageError(t *testing.T) {
+	working := store
+	defer func() { store = working }()
+
+	store = newMemoryStore()
+	Insert(&Page{Domain: "testdomain", Name: "a.md"})
+	Insert(&Page{Domain: "testdomain", Name: "b.md"})
+	iterator, err := GetList(&Page{Domain: "testdomain"})
+	if err != nil {
+		t.Fatalf("Couldn't list pages: %v", err)
+	}
+
+	store = brokenStore{}
+	if iterator.Next() {
+		t.Fatalf("Iterator shouldn't continue after a storage error.")
+	}
+	if !IsStorageError(iterator.Err()) {
+		t.Fatalf("Iterator should report the storage error, got %v", iterator.Err())
+	}
+}
+
+func TestBatchRollsBack(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		s.Save("a", map[string]string{"name": "a"})
+		s.AddToSet("set", "a")
+
+		// The last write in the batch fails, since there's nothing to
+		// rename. None of the writes before it should be kept.
+		b := &Batch{}
+		b.Save("b", map[string]string{"name": "b"})
+		b.AddToSet("set", "b")
+		b.Delete("a")
+		b.RemoveFromSet("set", "a")
+		b.Rename("missing", "c")
+		err := s.Apply(b)
+		if err == nil {
+			t.Fatalf("Batch should have failed.")
+		}
+
+		exists, _ := s.Exists("b")
+		if exists {
+			t.Errorf("Write from failed batch was kept.")
+		}
+		hash, _ := s.Load("a")
+		if hash["name"] != "a" {
+			t.Errorf("Delete from failed batch was kept.")
+		}
+		members, _ := s.Members("set")
+		if len(members) != 1 || members[0] != "a" {
+			t.Errorf("Set changes from failed batch were kept: %v", members)
+		}
+	})
+}
+
+func TestBatchPreconditions(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		s.Save("a", map[string]string{"name": "a"})
+
+		b := &Batch{}
+		b.RequireMissing("a")
+		b.Save("b", map[string]string{"name": "b"})
+		err := s.Apply(b)
+		if _, ok := err.(*PreconditionError); !ok {
+			t.Fatalf("Expected precondition error, got %v", err)
+		}
+		exists, _ := s.Exists("b")
+		if exists {
+			t.Errorf("Batch shouldn't be applied if its preconditions fail.")
+		}
+
+		b = &Batch{}
+		b.RequireExists("a")
+		b.RequireMissing("b")
+		b.Rename("a", "b")
+		err = s.Apply(b)
+		if err != nil {
+			t.Fatalf("Couldn't apply batch: %v", err)
+		}
+		hash, _ := s.Load("b")
+		if hash["name"] != "a" {
+			t.Errorf("Batch wasn't applied: %v", hash)
+		}
+
+		// A missing counter field counts as zero.
+		b = &Batch{}
+		b.RequireCounter("b", "revision", 0)
+		b.Save("b", map[string]string{"revision": "1"})
+		err = s.Apply(b)
+		if err != nil {
+			t.Fatalf("Couldn't apply batch: %v", err)
+		}
+
+		b = &Batch{}
+		b.RequireCounter("b", "revision", 0)
+		b.Save("b", map[string]string{"revision": "1"})
+		err = s.Apply(b)
+		if e, ok := err.(*PreconditionError); !ok || e.Field != "revision" || e.Value != 1 {
+			t.Fatalf("Expected counter precondition error, got %v", err)
+		}
+	})
+}
+
+// A crashingStore works normally, except that it fails every batch, as
+// if the server crashed before finishing the writes.
+type crashingStore struct {
+	*memoryStore
+}
+
+func (s crashingStore) Apply(b *Batch) error {
+	return &StorageError{errors.New("crashed")}
+}
+
+func TestModelOperationsAreAtomic(t *testing.T) {
+	working := store
+	defer func() { store = working }()
+
+	memory := newMemoryStore()
+	store = memory
+
+	existing := &Page{Domain: "testdomain", Name: "existing.md", Markdown: "hello"}
+	Insert(existing)
+	f := &File{Domain: "testdomain", Name: "atomic.txt", Hash: "atomic"}
+	Insert(f)
+	ioutil.WriteFile(f.GetPath(), []byte("contents"), 0644)
+	defer os.Remove(f.GetPath())
+
+	// Take a copy of the database, so we can check that the failed
+	// operations didn't change anything.
+	before := newMemoryStore()
+	for key := range memory.hashes {
+		before.copyKey(memory, key)
+	}
+	for key := range memory.sets {
+		before.copyKey(memory, key)
+	}
+
+	store = crashingStore{memory}
+	if Insert(&Page{Domain: "testdomain", Name: "new.md"}) == nil {
+		t.Errorf("Insert should have failed.")
+	}
+	if Delete(existing) == nil {
+		t.Errorf("Delete should have failed.")
+	}
+	renamed := *existing
+	if renamed.RenamePage("renamed.md") == nil {
+		t.Errorf("RenamePage should have failed.")
+	}
+	renamedFile := *f
+	if renamedFile.RenameFile("renamed.txt") == nil {
+		t.Errorf("RenameFile should have failed.")
+	}
+
+	if !reflect.DeepEqual(before.hashes, memory.hashes) || !reflect.DeepEqual(before.sets, memory.sets) {
+		t.Fatalf("Failed operations left partial state:\n%v\n%v", memory.hashes, memory.sets)
+	}
+
+	contents, err := ioutil.ReadFile(f.GetPath())
+	if err != nil || string(contents) != "contents" {
+		t.Fatalf("Failed rename should have left the file in place.")
+	}
+}
@@ -24,8 +24,19 @@ type User struct {
 	ExternalDomain string `json:"external_domain"`
 	Style          string `json:"style"`
 	SpaceUsage     int    `json:"space_usage"`
+	// Robots replaces the robots.txt of the user's site, if it's set.
+	Robots string `json:"robots"`
+	// PublicSearch lets visitors search the user's site at /search.
+	PublicSearch bool `json:"public_search"`
+	// NotFoundPage is the name of the page which is shown when visitors
+	// ask for something that doesn't exist. If it's empty, 404.md is.
+	NotFoundPage string `json:"not_found_page"`
 }
 
+// DefaultNotFoundPage is the page which is shown when visitors ask for
+// something that doesn't exist, unless the user has chosen another one.
+const DefaultNotFoundPage = "404.md"
+
 // Export converts a user into fields which are "safe" to export to
 // the web (i.e. excluding sensitive fields like password hashes).
 func (u *User) Export() map[string]interface{} {
@@ -37,6 +48,8 @@ func (u *User) Export() map[string]interface{} {
 		"style":           u.Style,
 		"space_usage":     u.SpaceUsage,
 		"external_domain": u.ExternalDomain,
+		"public_search":   u.PublicSearch,
+		"not_found_page":  u.NotFoundPageName(),
 	}
 }
 
@@ -46,12 +59,7 @@ func NewUser() *User {
 	u := new(User)
 
 	// Create the password salt.
-	const saltLetters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	b := make([]byte, 32)
-	for i := range b {
-		b[i] = saltLetters[rand.Int63()%int64(len(saltLetters))]
-	}
-	u.PasswordSalt = string(b)
+	u.PasswordSalt = newSalt()
 
 	// Set the default style
 	u.Style = "default"
@@ -59,22 +67,42 @@ func NewUser() *User {
 	return u
 }
 
-// SetPassword sets the password for a user, using scrypt.
-func (u *User) SetPassword(password string) {
-	dk, err := scrypt.Key([]byte(password), []byte(u.PasswordSalt), 16384, 8, 1, 32)
+// NotFoundPageName returns the name of the page which is shown when
+// visitors ask for something on the user's site that doesn't exist.
+func (u *User) NotFoundPageName() string {
+	if u.NotFoundPage == "" {
+		return DefaultNotFoundPage
+	}
+	return u.NotFoundPage
+}
+
+// Returns a random salt for hashing a password with.
+func newSalt() string {
+	const saltLetters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	b := make([]byte, 32)
+	for i := range b {
+		b[i] = saltLetters[rand.Int63()%int64(len(saltLetters))]
+	}
+	return string(b)
+}
+
+// Hashes a password with the salt, using scrypt.
+func hashPassword(password, salt string) string {
+	dk, err := scrypt.Key([]byte(password), []byte(salt), 16384, 8, 1, 32)
 	if err != nil {
 		log.Fatal("Unexpected error setting password.")
 	}
-	u.PasswordHash = string(dk)
+	return string(dk)
+}
+
+// SetPassword sets the password for a user, using scrypt.
+func (u *User) SetPassword(password string) {
+	u.PasswordHash = hashPassword(password, u.PasswordSalt)
 }
 
 // CheckPassword takes a string and checks if that matches the hashed password.
 func (u *User) CheckPassword(password string) bool {
-	dk, err := scrypt.Key([]byte(password), []byte(u.PasswordSalt), 16384, 8, 1, 32)
-	if err != nil {
-		log.Fatal("Unexpected error setting password.")
-	}
-	return string(dk) == u.PasswordHash
+	return hashPassword(password, u.PasswordSalt) == u.PasswordHash
 }
 
 // MakeDefault sets the default fields for the user. If it has some
@@ -125,6 +153,11 @@ func (u *User) Validate() bool {
 		return false
 	}
 
+	if u.NotFoundPage != "" && !ValidPagePath(u.NotFoundPage) {
+		log.Printf("Validation failed on user %s, illegal not found page '%s'\n", u.Name, u.NotFoundPage)
+		return false
+	}
+
 	if len(u.PasswordSalt) < 32 {
 		log.Printf("Validation failed: insufficiently long salt.")
 		return false
@@ -87,3 +87,40 @@ func TestUserCreation(t *testing.T) {
 		t.Fatal("Authentication succeeded, even with the wrong password.")
 	}
 }
+
+func TestSaveFields(t *testing.T) {
+	insertBlobUser(t, "savefields")
+	stale := User{Domain: "savefields"}
+	err := Load(&stale)
+	if err != nil {
+		t.Fatalf("Couldn't load user: %v", err)
+	}
+
+	// Uploading a file changes the user's space usage behind the back of
+	// the copy which was loaded before.
+	err = SaveFile(&File{Domain: "savefields", Name: "photo.png"}, []byte("photo"), 100)
+	if err != nil {
+		t.Fatalf("Failed to save file: %v", err)
+	}
+
+	stale.Style = "dark"
+	err = SaveFields(&stale, "style")
+	if err != nil {
+		t.Fatalf("Failed to save fields: %v", err)
+	}
+	g := User{Domain: "savefields"}
+	err = Load(&g)
+	if err != nil {
+		t.Fatalf("Couldn't load user: %v", err)
+	}
+	if g.Style != "dark" || g.SpaceUsage != len("photo") {
+		t.Fatalf("Expected style `dark` and %d bytes used, got `%s` and %d", len("photo"), g.Style, g.SpaceUsage)
+	}
+
+	if SaveFields(&stale, "nonexistent") == nil {
+		t.Fatal("Saved a field which doesn't exist.")
+	}
+	if SaveFields(&User{Domain: "nosuchuser", Email: "a@b.com"}, "style") == nil {
+		t.Fatal("Saved fields of a user which doesn't exist.")
+	}
+}
@@ -0,0 +1,114 @@
+/*
+  previews.go
+
+  Routes for sharing drafts with preview links. A link can show a single
+  page or the whole site, and it works until it expires or is revoked.
+  They're part of the edit handler.
+*/
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/colin353/markdown.ninja/requesthandler"
+)
+
+// How long preview links last, in hours, unless the user says otherwise.
+const defaultPreviewHours = 72
+
+// Return the user's preview links which haven't expired yet.
+func previews(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	tokens, err := models.PreviewTokens(u.Domain)
+	if err != nil {
+		log.Printf("Tried to load preview links for `%s`, but it failed.", u.Domain)
+		return requesthandler.Unavailable(w)
+	}
+
+	tokenList := make([]map[string]interface{}, 0, len(tokens))
+	for _, t := range tokens {
+		tokenList = append(tokenList, t.Export())
+	}
+	return tokenList
+}
+
+// Create a preview link for a page, or for the whole site if no name is
+// given. The page has to exist, but it doesn't need to be published.
+func createPreview(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type previewArgs struct {
+		Name  string `json:"name"`
+		Hours int    `json:"hours"`
+	}
+	args := previewArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+	if args.Hours == 0 {
+		args.Hours = defaultPreviewHours
+	}
+
+	if args.Name != "" {
+		p := models.Page{}
+		p.Domain = u.Domain
+		p.Name = args.Name
+		err = models.Load(&p)
+		if models.IsStorageError(err) {
+			return requesthandler.Unavailable(w)
+		}
+		if err != nil {
+			http.Error(w, "", http.StatusNotFound)
+			return requesthandler.ResponseError
+		}
+	}
+
+	t, err := models.NewPreviewToken(u.Domain, args.Name, time.Duration(args.Hours)*time.Hour)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+	return t.Export()
+}
+
+// Revoke a preview link, so that it stops working straight away.
+func revokePreview(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type revokeArgs struct {
+		Token string `json:"token"`
+	}
+	args := revokeArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	t := models.PreviewToken{}
+	t.Domain = u.Domain
+	t.Token = args.Token
+	err = models.Load(&t)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		http.Error(w, "", http.StatusNotFound)
+		return requesthandler.ResponseError
+	}
+
+	err = models.Delete(&t)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		log.Printf("Failed to delete preview link `%s`: %v", t.Key(), err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return requesthandler.ResponseError
+	}
+	return requesthandler.ResponseOK
+}
@@ -0,0 +1,75 @@
+/*
+  excerpt.go
+
+  Listings of blog posts show a short excerpt of each post. Authors can
+  choose where the excerpt ends by writing <!--more--> in their post.
+  Otherwise, the excerpt is the post's first paragraph.
+*/
+
+package render
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+// ExcerptMarker separates the excerpt of a post from the rest of it.
+const ExcerptMarker = "<!--more-->"
+
+// Excerpt returns the markdown of the excerpt of a document, which
+// shouldn't include its front matter.
+func Excerpt(source string) string {
+	document := renderer.Parser().Parse(text.NewReader([]byte(source)))
+	if i := excerptMarker(document, []byte(source)); i != -1 {
+		return strings.TrimSpace(source[:i])
+	}
+
+	for node := document.FirstChild(); node != nil; node = node.NextSibling() {
+		if node.Kind() != ast.KindParagraph || node.Lines().Len() == 0 {
+			continue
+		}
+		lines := node.Lines()
+		start := lines.At(0).Start
+		stop := lines.At(lines.Len() - 1).Stop
+		return strings.TrimSpace(source[start:stop])
+	}
+	return ""
+}
+
+// Returns the offset of the first marker in the document, or -1 if there
+// isn't one. Only HTML comments count, so a marker inside a code block
+// or a code span is left alone.
+func excerptMarker(document ast.Node, source []byte) int {
+	offset := -1
+	ast.Walk(document, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		var segments []text.Segment
+		switch n := node.(type) {
+		case *ast.HTMLBlock:
+			for i := 0; i < n.Lines().Len(); i++ {
+				segments = append(segments, n.Lines().At(i))
+			}
+		case *ast.RawHTML:
+			for i := 0; i < n.Segments.Len(); i++ {
+				segments = append(segments, n.Segments.At(i))
+			}
+		default:
+			return ast.WalkContinue, nil
+		}
+		if len(segments) == 0 {
+			return ast.WalkSkipChildren, nil
+		}
+		start, stop := segments[0].Start, segments[len(segments)-1].Stop
+		if string(bytes.TrimSpace(source[start:stop])) == ExcerptMarker {
+			offset = start
+			return ast.WalkStop, nil
+		}
+		return ast.WalkSkipChildren, nil
+	})
+	return offset
+}
@@ -0,0 +1,40 @@
+/*
+  frontmatter.go
+
+  A page can start with a block of YAML metadata, called front matter,
+  between two lines of three dashes:
+
+    ---
+    title: Hello
+    tags: [intro, news]
+    ---
+    The rest of the page is markdown.
+*/
+
+package render
+
+import (
+	"strings"
+)
+
+const frontMatterDelimiter = "---"
+
+// SplitFrontMatter separates the front matter from the rest of the
+// markdown. If the markdown doesn't start with front matter, or the front
+// matter is never closed, the front matter is empty and the markdown is
+// returned unchanged.
+func SplitFrontMatter(source string) (frontMatter, markdown string) {
+	// Windows line endings are common when people paste text in.
+	normalized := strings.Replace(source, "\r\n", "\n", -1)
+	lines := strings.SplitAfter(normalized, "\n")
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != frontMatterDelimiter {
+		return "", source
+	}
+
+	for i := 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == frontMatterDelimiter {
+			return strings.Join(lines[1:i], ""), strings.Join(lines[i+1:], "")
+		}
+	}
+	return "", source
+}
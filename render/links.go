@@ -0,0 +1,87 @@
+/*
+  links.go
+
+  Finds the links in a page, so that we can keep track of which pages
+  link to each other and notice links that are broken. Links can also
+  be made absolute, for when the page is shown somewhere else.
+*/
+
+package render
+
+import (
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// The attributes which contain links, for each tag.
+var linkAttributes = map[string]string{
+	"a":      "href",
+	"img":    "src",
+	"source": "src",
+	"video":  "src",
+	"audio":  "src",
+}
+
+// Links returns the destinations of every link and embedded image or
+// media in an HTML document, in the order they appear.
+func Links(document string) []string {
+	tokenizer := html.NewTokenizer(strings.NewReader(document))
+	links := []string{}
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return links
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttributes := tokenizer.TagName()
+			attribute, ok := linkAttributes[string(name)]
+			for ok && hasAttributes {
+				var key, value []byte
+				key, value, hasAttributes = tokenizer.TagAttr()
+				if string(key) == attribute {
+					links = append(links, string(value))
+				}
+			}
+		}
+	}
+}
+
+// AbsoluteLinks resolves the destinations of the links and embedded
+// images or media in an HTML document against the base URL, so that
+// they still work when the document is shown somewhere else, like in a
+// feed reader. Destinations which don't parse are left alone.
+func AbsoluteLinks(document string, base *url.URL) string {
+	tokenizer := html.NewTokenizer(strings.NewReader(document))
+	var b strings.Builder
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			return b.String()
+		}
+		raw := string(tokenizer.Raw())
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			b.WriteString(raw)
+			continue
+		}
+
+		token := tokenizer.Token()
+		attribute, ok := linkAttributes[token.Data]
+		changed := false
+		for i := range token.Attr {
+			if !ok || token.Attr[i].Key != attribute {
+				continue
+			}
+			destination, err := url.Parse(token.Attr[i].Val)
+			if err != nil || destination.IsAbs() {
+				continue
+			}
+			token.Attr[i].Val = base.ResolveReference(destination).String()
+			changed = true
+		}
+		if changed {
+			raw = token.String()
+		}
+		b.WriteString(raw)
+	}
+}
@@ -0,0 +1,44 @@
+/*
+  render.go
+
+  Pages are written in markdown, and rendered into HTML on the server
+  whenever they're saved. That way the HTML we serve always matches the
+  markdown, no matter what the client sent us.
+*/
+
+package render
+
+import (
+	"bytes"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer/html"
+)
+
+// The markdown renderer supports CommonMark, plus the GitHub extensions
+// (tables, task lists, strikethrough and autolinks), footnotes, tables
+// of contents and wiki links, if they're asked for. Headings get ids, so
+// that they can be linked to. Raw HTML is passed through, since people
+// use it for things like images with a particular width.
+var renderer = goldmark.New(
+	goldmark.WithExtensions(
+		extension.GFM,
+		extension.Footnote,
+		&wikiLinks{},
+		&tableOfContentsExtension{},
+	),
+	goldmark.WithRendererOptions(
+		html.WithUnsafe(),
+	),
+)
+
+// Markdown renders a markdown document into HTML.
+func Markdown(source string) (string, error) {
+	var buf bytes.Buffer
+	err := renderer.Convert([]byte(source), &buf)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
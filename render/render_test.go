@@ -0,0 +1,233 @@
+package render
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// Each of the default pages that new users get is rendered, and checked
+// against the HTML in testdata. If the rendering is meant to change, run
+// the tests with -update to rewrite the golden files.
+func TestDefaultPages(t *testing.T) {
+	files, err := filepath.Glob("../web/default/*.md")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("Couldn't find the default pages: %v", err)
+	}
+
+	for _, file := range files {
+		markdown, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Couldn't read `%s`: %v", file, err)
+		}
+		html, err := Markdown(string(markdown))
+		if err != nil {
+			t.Fatalf("Couldn't render `%s`: %v", file, err)
+		}
+
+		golden := filepath.Join("testdata", filepath.Base(file)+".html")
+		if *update {
+			err = ioutil.WriteFile(golden, []byte(html), 0644)
+			if err != nil {
+				t.Fatalf("Couldn't update `%s`: %v", golden, err)
+			}
+		}
+		expected, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("Couldn't read `%s`: %v", golden, err)
+		}
+		if html != string(expected) {
+			t.Errorf("Rendering `%s` didn't match `%s`. Got:\n%s", file, golden, html)
+		}
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	tests := map[string]string{
+		"| a | b |\n|---|---|\n| 1 | 2 |":  "<td>1</td>",
+		"- [x] done\n- [ ] todo":           `<input checked="" disabled="" type="checkbox">`,
+		"text[^1]\n\n[^1]: the footnote":   `<div class="footnotes" role="doc-endnotes">`,
+		"```go\nfunc main() {}\n```":       `<pre><code class="language-go">func main() {}`,
+		"~~gone~~":                         "<del>gone</del>",
+		"<img width=64 src=\"a.png\" />":   `<img width=64 src="a.png" />`,
+		"See https://markdown.ninja today": `<a href="https://markdown.ninja">`,
+	}
+
+	for markdown, expected := range tests {
+		html, err := Markdown(markdown)
+		if err != nil {
+			t.Fatalf("Couldn't render %q: %v", markdown, err)
+		}
+		if !strings.Contains(html, expected) {
+			t.Errorf("Expected %q to render with %q, got:\n%s", markdown, expected, html)
+		}
+	}
+}
+
+func TestSplitFrontMatter(t *testing.T) {
+	tests := []struct {
+		source      string
+		frontMatter string
+		markdown    string
+	}{
+		{"---\ntitle: Hello\n---\n# Hello\n", "title: Hello\n", "# Hello\n"},
+		{"---\r\ntitle: Hello\r\n---\r\nbody", "title: Hello\n", "body"},
+		{"---\n---\nbody", "", "body"},
+		{"# No front matter\n---\n", "", "# No front matter\n---\n"},
+		{"---\ntitle: never closed\n", "", "---\ntitle: never closed\n"},
+		{"", "", ""},
+	}
+
+	for _, test := range tests {
+		frontMatter, markdown := SplitFrontMatter(test.source)
+		if frontMatter != test.frontMatter || markdown != test.markdown {
+			t.Errorf("Splitting %q gave %q and %q", test.source, frontMatter, markdown)
+		}
+	}
+}
+
+func TestExcerpt(t *testing.T) {
+	excerpts := map[string]string{
+		"# Title\n\nFirst *paragraph*\ncontinues.\n\nSecond.": "First *paragraph*\ncontinues.",
+		"Intro\n\nMore intro\n<!--more-->\nThe rest.":         "Intro\n\nMore intro",
+		"# Only a heading":                           "",
+		"> quoted\n\n- list\n\nplain":                "plain",
+		"Inline <!--more--> marker":                  "Inline",
+		"```\n<!--more-->\n```\n\nhello":             "hello",
+		"Use `<!--more-->` to\nend it.\n\nThe rest.": "Use `<!--more-->` to\nend it.",
+	}
+	for source, expected := range excerpts {
+		if excerpt := Excerpt(source); excerpt != expected {
+			t.Errorf("Expected excerpt of %q to be %q, got %q", source, expected, excerpt)
+		}
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	text := PlainText("<h1>Title</h1><p>Some <em>emphasized</em>\n text &amp; <b>more</b>.</p><p>Next</p>")
+	if text != "Title Some emphasized text & more. Next" {
+		t.Fatalf("Unexpected text: %q", text)
+	}
+}
+
+func TestWikiLinks(t *testing.T) {
+	resolve := func(target string) (string, bool) {
+		return "/" + strings.ToLower(strings.Replace(target, " ", "_", -1)), target != "Missing"
+	}
+	rendered, err := MarkdownWithWikiLinks("See [[Page Name]], [[Missing|this <one>]] and `[[code]]`.\n\n[normal](/link) [[]] [[ |x]]", resolve)
+	if err != nil {
+		t.Fatalf("Failed to render: %v", err)
+	}
+	expected := `<p>See <a href="/page_name" class="wikilink">Page Name</a>, <a href="/missing" class="wikilink broken">this &lt;one&gt;</a> and <code>[[code]]</code>.</p>` + "\n" +
+		`<p><a href="/link">normal</a> [[]] [[ |x]]</p>` + "\n"
+	if rendered != expected {
+		t.Fatalf("Unexpected HTML:\n%s", rendered)
+	}
+
+	// Without a resolver, wiki links are left alone.
+	rendered, _ = Markdown("[[Page Name]]")
+	if rendered != "<p>[[Page Name]]</p>\n" {
+		t.Fatalf("Unexpected HTML:\n%s", rendered)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	links := Links(`<p><a href="/about">About</a> <img src="/files/me.png"><a name="top">x</a><a href="https://example.com">y</a></p>`)
+	if strings.Join(links, " ") != "/about /files/me.png https://example.com" {
+		t.Fatalf("Unexpected links: %v", links)
+	}
+}
+
+func TestAbsoluteLinks(t *testing.T) {
+	base, _ := url.Parse("https://site.example.com/blog/post")
+	document := AbsoluteLinks(`<p><a href="/about" title="x">About</a> <img src="files/me.png"/> <a href="#top">top</a> <a href="https://example.com">y</a> /plain</p>`, base)
+	expected := `<p><a href="https://site.example.com/about" title="x">About</a> <img src="https://site.example.com/blog/files/me.png"/> ` +
+		`<a href="https://site.example.com/blog/post#top">top</a> <a href="https://example.com">y</a> /plain</p>`
+	if document != expected {
+		t.Fatalf("Unexpected document: %q", document)
+	}
+}
+
+func TestRewriteLinks(t *testing.T) {
+	source := "[Old](/old.md) ![pic](</files/old.png> \"title\") [[Old]] [[old|the old page]]\n" +
+		"[ref]: /old\n" +
+		"<a href=\"/old#top\">x</a> [Other](/other) `[code](/old)`\n" +
+		"```\n[fenced](/old)\n```"
+	rewriteURL := func(url string) (string, bool) {
+		switch url {
+		case "/old.md", "/old":
+			return "/new", true
+		case "/files/old.png":
+			return "/files/new.png", true
+		case "/old#top":
+			return "/new#top", true
+		}
+		return url, false
+	}
+	rewriteWikiLink := func(target string) (string, bool) {
+		if strings.ToLower(target) == "old" {
+			return "new", true
+		}
+		return target, false
+	}
+
+	rewritten, changes := RewriteLinks(source, rewriteURL, rewriteWikiLink)
+	expected := "[Old](/new) ![pic](</files/new.png> \"title\") [[new|Old]] [[new|the old page]]\n" +
+		"[ref]: /new\n" +
+		"<a href=\"/new#top\">x</a> [Other](/other) `[code](/old)`\n" +
+		"```\n[fenced](/old)\n```"
+	if rewritten != expected {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", expected, rewritten)
+	}
+	if len(changes) != 6 {
+		t.Fatalf("Expected 6 changes, got %v", changes)
+	}
+}
+
+func TestTableOfContents(t *testing.T) {
+	rendered, err := Markdown("# Guide\n\n[TOC]\n\n## Setup\n\n### *First* `step`\n\n## Setup\n\n#### Deep\n\n### Between\n\n# Ünïcode")
+	if err != nil {
+		t.Fatalf("Failed to render: %v", err)
+	}
+	expected := `<h1 id="guide">Guide</h1>` + "\n" +
+		`<ul class="toc">` + "\n" +
+		`<li><a href="#guide">Guide</a>` + "\n" +
+		`<ul>` + "\n" +
+		`<li><a href="#setup">Setup</a>` + "\n" +
+		`<ul>` + "\n" +
+		`<li><a href="#first-step">First step</a></li>` + "\n" +
+		`</ul>` + "\n" +
+		`</li>` + "\n" +
+		`<li><a href="#setup-1">Setup</a>` + "\n" +
+		`<ul>` + "\n" +
+		`<li><a href="#deep">Deep</a></li>` + "\n" +
+		`<li><a href="#between">Between</a></li>` + "\n" +
+		`</ul>` + "\n" +
+		`</li>` + "\n" +
+		`</ul>` + "\n" +
+		`</li>` + "\n" +
+		`<li><a href="#ncode">Ünïcode</a></li>` + "\n" +
+		`</ul>` + "\n"
+	if !strings.HasPrefix(rendered, expected) {
+		t.Fatalf("Unexpected HTML:\n%s", rendered)
+	}
+	for _, heading := range []string{`<h2 id="setup">`, `<h3 id="first-step">`, `<h2 id="setup-1">`, `<h4 id="deep">`, `<h1 id="ncode">`} {
+		if !strings.Contains(rendered, heading) {
+			t.Errorf("Expected %s in:\n%s", heading, rendered)
+		}
+	}
+	if Sanitize(rendered) != rendered {
+		t.Errorf("Sanitizing changed the table of contents:\n%s", Sanitize(rendered))
+	}
+
+	// Without any headings, the marker disappears.
+	rendered, _ = Markdown("Before\n\n[TOC]\n\nAfter [TOC]")
+	if rendered != "<p>Before</p>\n<p>After [TOC]</p>\n" {
+		t.Fatalf("Unexpected HTML:\n%s", rendered)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+  rewrite.go
+
+  When a page or file is renamed, the links to it in other pages have to
+  change too. Links are rewritten in the markdown, which is what the user
+  edits, rather than in the rendered HTML.
+*/
+
+package render
+
+import (
+	"regexp"
+	"strings"
+)
+
+// A LinkChange is a link in a markdown document which was rewritten.
+type LinkChange struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+var (
+	// [text](destination "title") and ![alt](destination)
+	inlineLinkPattern = regexp.MustCompile(`(\]\([ \t]*)(<[^<>\n]*>|[^\s()<>]+)`)
+	// [label]: destination
+	referencePattern = regexp.MustCompile(`^( {0,3}\[[^\]\n]+\]:[ \t]*)(<[^<>\n]*>|\S+)`)
+	// <a href="destination"> and <img src="destination">
+	htmlLinkPattern = regexp.MustCompile(`((?:href|src)[ \t]*=[ \t]*["'])([^"'\n]*)`)
+	// [[target]] and [[target|label]]
+	wikiLinkPattern = regexp.MustCompile(`\[\[([^\[\]|\n]+)(\|[^\[\]\n]+)?\]\]`)
+	// The start or end of a fenced code block.
+	fencePattern = regexp.MustCompile("^ {0,3}(```|~~~)")
+)
+
+// RewriteLinks changes the links in a markdown document. The destination
+// of each link or image, whether it's written in markdown or HTML, is
+// passed to rewriteURL, and the target of each wiki link is passed to
+// rewriteWikiLink. They return the replacement, and whether it's
+// different. Links in code are left alone, since they're only examples.
+// Returns the new document, and the links which changed.
+func RewriteLinks(source string, rewriteURL, rewriteWikiLink func(string) (string, bool)) (string, []LinkChange) {
+	changes := []LinkChange{}
+
+	// Replaces the destinations matched by a pattern, which captures the
+	// text before the destination and then the destination itself.
+	rewriteDestinations := func(pattern *regexp.Regexp, text string) string {
+		return pattern.ReplaceAllStringFunc(text, func(match string) string {
+			parts := pattern.FindStringSubmatch(match)
+			destination, bracketed := parts[2], false
+			if strings.HasPrefix(destination, "<") && strings.HasSuffix(destination, ">") {
+				destination, bracketed = destination[1:len(destination)-1], true
+			}
+			replacement, ok := rewriteURL(destination)
+			if !ok {
+				return match
+			}
+			changes = append(changes, LinkChange{Old: destination, New: replacement})
+			if bracketed {
+				replacement = "<" + replacement + ">"
+			}
+			return parts[1] + replacement
+		})
+	}
+
+	// Wiki links keep showing the same text, even though they point at a
+	// new target.
+	rewriteWikiLinks := func(text string) string {
+		return wikiLinkPattern.ReplaceAllStringFunc(text, func(match string) string {
+			parts := wikiLinkPattern.FindStringSubmatch(match)
+			target := strings.TrimSpace(parts[1])
+			replacement, ok := rewriteWikiLink(target)
+			if !ok {
+				return match
+			}
+			label := parts[2]
+			if label == "" {
+				label = "|" + parts[1]
+			}
+			changes = append(changes, LinkChange{Old: match, New: "[[" + replacement + label + "]]"})
+			return "[[" + replacement + label + "]]"
+		})
+	}
+
+	lines := strings.Split(source, "\n")
+	fenced := false
+	for i, line := range lines {
+		if fencePattern.MatchString(line) {
+			fenced = !fenced
+			continue
+		}
+		if fenced {
+			continue
+		}
+
+		// Every other piece of the line, between backticks, is code.
+		pieces := strings.Split(line, "`")
+		for j := 0; j < len(pieces); j += 2 {
+			if j == 0 {
+				pieces[j] = rewriteDestinations(referencePattern, pieces[j])
+			}
+			pieces[j] = rewriteWikiLinks(pieces[j])
+			pieces[j] = rewriteDestinations(inlineLinkPattern, pieces[j])
+			pieces[j] = rewriteDestinations(htmlLinkPattern, pieces[j])
+		}
+		lines[i] = strings.Join(pieces, "`")
+	}
+	return strings.Join(lines, "\n"), changes
+}
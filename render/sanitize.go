@@ -0,0 +1,111 @@
+/*
+  sanitize.go
+
+  Every site is served from a subdomain of the same parent domain, so
+  a script on one site could read the cookies of another. To prevent
+  that, the HTML of every page is cleaned up using an allowlist of
+  elements and attributes before it is stored or served.
+*/
+
+package render
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+var (
+	policyMutex    sync.RWMutex
+	policy         = newPolicy(nil)
+	documentPolicy = newDocumentPolicy(nil)
+)
+
+var doctypePattern = regexp.MustCompile(`(?i)^\s*<!doctype html>`)
+
+// Configure sets up the sanitization policy for this deployment. The
+// iframeHosts are the hostnames which pages are allowed to embed in
+// iframes, e.g. www.youtube.com. If there aren't any, iframes are removed.
+func Configure(iframeHosts []string) {
+	p := newPolicy(iframeHosts)
+	d := newDocumentPolicy(iframeHosts)
+
+	policyMutex.Lock()
+	defer policyMutex.Unlock()
+	policy = p
+	documentPolicy = d
+}
+
+// Sanitize removes anything from the HTML which isn't on the allowlist,
+// such as scripts, event handlers and javascript: links.
+func Sanitize(html string) string {
+	policyMutex.RLock()
+	defer policyMutex.RUnlock()
+	return policy.Sanitize(html)
+}
+
+// SanitizeDocument cleans up a whole HTML document, such as a page
+// wrapped in a layout that a user wrote. It allows the same things as
+// Sanitize, plus the parts of a document which only belong in its head,
+// like stylesheets and meta tags.
+func SanitizeDocument(document string) string {
+	policyMutex.RLock()
+	defer policyMutex.RUnlock()
+
+	// The doctype isn't an element, so the policy would drop it, and
+	// browsers would fall back to quirks mode.
+	sanitized := documentPolicy.Sanitize(document)
+	if doctypePattern.MatchString(document) {
+		sanitized = "<!DOCTYPE html>\n" + strings.TrimLeft(sanitized, " \t\r\n")
+	}
+	return sanitized
+}
+
+// The policy starts from bluemonday's policy for user generated content,
+// and adds the things that the markdown renderer produces (task lists
+// and footnotes), plus classes so that people can style their sites.
+func newPolicy(iframeHosts []string) *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+
+	// These are people's own sites, so their links shouldn't be
+	// treated as untrusted.
+	p.RequireNoFollowOnLinks(false)
+
+	p.AllowStyling()
+	p.AllowAttrs("role").Matching(regexp.MustCompile(`^doc-[a-z]+$`)).Globally()
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").Matching(regexp.MustCompile(`^$`)).OnElements("input")
+
+	hosts := []string{}
+	for _, host := range iframeHosts {
+		if host != "" {
+			hosts = append(hosts, regexp.QuoteMeta(strings.ToLower(host)))
+		}
+	}
+	if len(hosts) > 0 {
+		src := regexp.MustCompile(`^https://(` + strings.Join(hosts, "|") + `)(/|$)`)
+		p.AllowAttrs("src").Matching(src).OnElements("iframe")
+		p.AllowAttrs("width", "height").Matching(bluemonday.NumberOrPercent).OnElements("iframe")
+		p.AllowAttrs("frameborder").Matching(bluemonday.Integer).OnElements("iframe")
+		p.AllowAttrs("allowfullscreen").Matching(regexp.MustCompile(`^(|allowfullscreen|true)$`)).OnElements("iframe")
+	}
+	return p
+}
+
+// The document policy allows the elements of a page's structure, and the
+// tags in its head which can't run scripts. Styles are kept as they are,
+// since CSS can't run scripts in the browsers we support, but meta tags
+// can't refresh the page and links can't point at javascript: URLs.
+func newDocumentPolicy(iframeHosts []string) *bluemonday.Policy {
+	p := newPolicy(iframeHosts)
+	p.AllowElements("html", "head", "body", "title", "header", "footer", "main", "nav")
+	p.AllowAttrs("charset").Matching(regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)).OnElements("meta")
+	p.AllowAttrs("name", "content", "property").OnElements("meta")
+	p.AllowAttrs("rel", "type", "href", "media", "sizes").OnElements("link")
+	p.AllowAttrs("media").OnElements("style")
+	p.AllowElements("style")
+	p.AllowUnsafe(true)
+	return p
+}
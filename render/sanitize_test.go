@@ -0,0 +1,123 @@
+package render
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+// Elements and URL schemes which could run a script. Event handler
+// attributes (on*), style and srcdoc are also never allowed.
+var (
+	dangerousElements = regexp.MustCompile(`^(script|style|svg|math|object|embed|iframe|form|meta|base|link|body)$`)
+	urlAttributes     = regexp.MustCompile(`^(href|src|action|formaction|background|data)$`)
+	safeURL           = regexp.MustCompile(`(?i)^(https?:|mailto:|[/#.]|[a-z0-9_\-.]+(/|$))`)
+)
+
+// Returns a description of the first dangerous thing in the HTML, or an
+// empty string if there isn't one. Text is ignored, since it's escaped.
+func findDangerous(s string) string {
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := z.Token()
+			if dangerousElements.MatchString(token.Data) {
+				return "element " + token.Data
+			}
+			for _, attr := range token.Attr {
+				if strings.HasPrefix(attr.Key, "on") || attr.Key == "style" || attr.Key == "srcdoc" {
+					return "attribute " + attr.Key
+				}
+				if urlAttributes.MatchString(attr.Key) && !safeURL.MatchString(attr.Val) {
+					return "url " + attr.Val
+				}
+			}
+		}
+	}
+}
+
+func TestXSSCorpus(t *testing.T) {
+	f, err := os.Open("testdata/xss.txt")
+	if err != nil {
+		t.Fatalf("Couldn't open the XSS corpus: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		payload := scanner.Text()
+		if payload == "" || strings.HasPrefix(payload, "#") {
+			continue
+		}
+
+		rendered, err := Markdown(payload)
+		if err != nil {
+			t.Fatalf("Couldn't render %q: %v", payload, err)
+		}
+		for _, input := range []string{payload, rendered} {
+			clean := Sanitize(input)
+			if problem := findDangerous(clean); problem != "" {
+				t.Errorf("Sanitizing %q left a dangerous %s:\n%s", input, problem, clean)
+			}
+		}
+	}
+}
+
+// The HTML that the renderer produces for ordinary markdown should make
+// it through the sanitizer untouched, apart from how characters are
+// escaped.
+func TestSanitizeKeepsMarkdown(t *testing.T) {
+	tests := []string{
+		"| a | b |\n|---|---|\n| 1 | 2 |",
+		"- [x] done\n- [ ] todo",
+		"text[^1]\n\n[^1]: the footnote",
+		"```go\nfunc main() {}\n```",
+		"[a link](https://markdown.ninja) and [another](/files/file.txt)",
+		"![katana](/files/katana.png)",
+		"<img width=\"64\" src=\"/files/katana.svg\">",
+	}
+
+	for _, markdown := range tests {
+		rendered, err := Markdown(markdown)
+		if err != nil {
+			t.Fatalf("Couldn't render %q: %v", markdown, err)
+		}
+		clean := Sanitize(rendered)
+		if html.UnescapeString(clean) != html.UnescapeString(rendered) {
+			t.Errorf("Sanitizer changed the rendering of %q:\n%s\n%s", markdown, rendered, clean)
+		}
+	}
+}
+
+func TestIframeHosts(t *testing.T) {
+	defer Configure(nil)
+
+	embed := `<iframe src="https://www.youtube.com/embed/abc" width="560" height="315"></iframe>`
+	if strings.Contains(Sanitize(embed), "<iframe") {
+		t.Fatalf("Iframes shouldn't be allowed by default.")
+	}
+
+	Configure([]string{"www.youtube.com"})
+	if !strings.Contains(Sanitize(embed), `<iframe src="https://www.youtube.com/embed/abc"`) {
+		t.Fatalf("Iframe from an allowed host was removed: %s", Sanitize(embed))
+	}
+
+	for _, src := range []string{
+		"http://www.youtube.com/embed/abc",
+		"https://www.youtube.com.evil.example/embed/abc",
+		"https://evil.example/?https://www.youtube.com/",
+		"javascript:alert(1)",
+	} {
+		clean := Sanitize(`<iframe src="` + src + `"></iframe>`)
+		if strings.Contains(clean, "<iframe") {
+			t.Errorf("Iframe from %s should have been removed: %s", src, clean)
+		}
+	}
+}
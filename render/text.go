@@ -0,0 +1,44 @@
+/*
+  text.go
+
+  Some things, like search, need the text of a page without any of
+  its markup.
+*/
+
+package render
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Tags which separate the text before them from the text after them.
+// Other tags, like <em>, can be in the middle of a word.
+var blockTags = map[string]bool{
+	"address": true, "blockquote": true, "br": true, "dd": true, "div": true,
+	"dl": true, "dt": true, "figcaption": true, "figure": true, "h1": true,
+	"h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "hr": true,
+	"li": true, "ol": true, "p": true, "pre": true, "section": true,
+	"table": true, "td": true, "th": true, "tr": true, "ul": true,
+}
+
+// PlainText returns the text of an HTML document, with the tags
+// removed and the whitespace collapsed.
+func PlainText(document string) string {
+	tokenizer := html.NewTokenizer(strings.NewReader(document))
+	var text strings.Builder
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return strings.Join(strings.Fields(text.String()), " ")
+		case html.TextToken:
+			text.Write(tokenizer.Text())
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			if blockTags[string(name)] {
+				text.WriteString(" ")
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+/*
+  toc.go
+
+  Every heading gets an id made from its text, so that people can link
+  to a part of a long page. A paragraph containing only [TOC] is
+  replaced by a table of contents, with a link to each heading.
+*/
+
+package render
+
+import (
+	"bytes"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// TOCMarker is replaced by the table of contents.
+const TOCMarker = "[TOC]"
+
+// The class of the list which holds the table of contents, so that
+// styles can tell it apart from other lists.
+const tocClass = "toc"
+
+type tocTransformer struct{}
+
+// Transform replaces the markers with the table of contents. The ids of
+// the headings have already been set by the parser.
+func (t *tocTransformer) Transform(document *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	markers := []ast.Node{}
+	headings := []*ast.Heading{}
+	ast.Walk(document, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := node.(type) {
+		case *ast.Heading:
+			headings = append(headings, n)
+			return ast.WalkSkipChildren, nil
+		case *ast.Paragraph:
+			lines := n.Lines()
+			if lines.Len() == 1 && string(bytes.TrimSpace(source[lines.At(0).Start:lines.At(0).Stop])) == TOCMarker {
+				markers = append(markers, n)
+			}
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+
+	// A page without headings doesn't have any contents to list, so the
+	// marker just disappears.
+	for _, marker := range markers {
+		toc := tableOfContents(headings, source)
+		if toc.ChildCount() == 0 {
+			marker.Parent().RemoveChild(marker.Parent(), marker)
+			continue
+		}
+		toc.SetAttributeString("class", []byte(tocClass))
+		marker.Parent().ReplaceChild(marker.Parent(), marker, toc)
+	}
+}
+
+// Builds a list of links to the headings. Each heading is nested under
+// the closest heading before it with a higher level, so a page which
+// starts at h2, or skips from h2 to h4, still comes out right.
+func tableOfContents(headings []*ast.Heading, source []byte) *ast.List {
+	lists := []*ast.List{newTOCList()}
+	levels := []int{}
+	for _, heading := range headings {
+		id, ok := heading.AttributeString("id")
+		if !ok {
+			continue
+		}
+		if len(levels) == 0 {
+			levels = append(levels, heading.Level)
+		}
+
+		// Go back up to the list which the heading belongs in. If it's
+		// between the levels of two lists, it joins the lower one.
+		for len(lists) > 1 && heading.Level < levels[len(levels)-1] {
+			if heading.Level > levels[len(levels)-2] {
+				levels[len(levels)-1] = heading.Level
+				break
+			}
+			lists, levels = lists[:len(lists)-1], levels[:len(levels)-1]
+		}
+		list := lists[len(lists)-1]
+		if heading.Level > levels[len(levels)-1] && list.LastChild() != nil {
+			parent := list.LastChild()
+			list = newTOCList()
+			parent.AppendChild(parent, list)
+			lists, levels = append(lists, list), append(levels, heading.Level)
+		}
+
+		link := ast.NewLink()
+		link.Destination = append([]byte("#"), id.([]byte)...)
+		link.AppendChild(link, ast.NewString(headingText(heading, source)))
+		block := ast.NewTextBlock()
+		block.AppendChild(block, link)
+		item := ast.NewListItem(2)
+		item.AppendChild(item, block)
+		list.AppendChild(list, item)
+	}
+	return lists[0]
+}
+
+func newTOCList() *ast.List {
+	list := ast.NewList('-')
+	list.IsTight = true
+	return list
+}
+
+// Returns the text of the heading, without any of its markup. Links in
+// the heading can't be kept, since they'd be inside another link.
+func headingText(heading *ast.Heading, source []byte) []byte {
+	var buf bytes.Buffer
+	ast.Walk(heading, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := node.(type) {
+		case *ast.Text:
+			buf.Write(n.Segment.Value(source))
+			if n.SoftLineBreak() || n.HardLineBreak() {
+				buf.WriteByte(' ')
+			}
+		case *ast.String:
+			buf.Write(n.Value)
+		case *ast.CodeSpan:
+			for child := n.FirstChild(); child != nil; child = child.NextSibling() {
+				if t, ok := child.(*ast.Text); ok {
+					buf.Write(t.Segment.Value(source))
+				}
+			}
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	return buf.Bytes()
+}
+
+type tableOfContentsExtension struct{}
+
+// Extend gives headings ids, and adds the transformer which fills in the
+// table of contents.
+func (e *tableOfContentsExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithAutoHeadingID(),
+		parser.WithASTTransformers(util.Prioritized(&tocTransformer{}, 100)),
+	)
+}
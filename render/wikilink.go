@@ -0,0 +1,100 @@
+/*
+  wikilink.go
+
+  Pages can link to each other by name, by writing [[Page Name]], or
+  [[Page Name|some other text]] to change the text of the link. The
+  names are resolved to URLs by whoever is rendering the page, since the
+  renderer doesn't know what pages exist.
+*/
+
+package render
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// A WikiLinkResolver returns the URL that a wiki link to the target
+// should point to, and whether the target exists.
+type WikiLinkResolver func(target string) (url string, exists bool)
+
+// The key of the resolver in the parser's context.
+var wikiLinkResolverKey = parser.NewContextKey()
+
+// The classes of the links which are produced. Links to pages which don't
+// exist are marked, so they can be styled differently.
+const (
+	wikiLinkClass       = "wikilink"
+	brokenWikiLinkClass = "wikilink broken"
+)
+
+type wikiLinkParser struct{}
+
+func (p *wikiLinkParser) Trigger() []byte {
+	return []byte{'['}
+}
+
+func (p *wikiLinkParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	resolve, _ := pc.Get(wikiLinkResolverKey).(WikiLinkResolver)
+	line, _ := block.PeekLine()
+	if resolve == nil || len(line) < 5 || line[1] != '[' {
+		return nil
+	}
+	end := bytes.Index(line[2:], []byte("]]"))
+	if end < 1 || bytes.IndexAny(line[2:2+end], "[]") != -1 {
+		return nil
+	}
+
+	target := string(line[2 : 2+end])
+	label := target
+	if i := strings.Index(target, "|"); i != -1 {
+		target, label = target[:i], target[i+1:]
+	}
+	target, label = strings.TrimSpace(target), strings.TrimSpace(label)
+	if target == "" || label == "" {
+		return nil
+	}
+	block.Advance(end + 4)
+
+	url, exists := resolve(target)
+	link := ast.NewLink()
+	link.Destination = []byte(url)
+	link.AppendChild(link, ast.NewString([]byte(label)))
+	if exists {
+		link.SetAttributeString("class", []byte(wikiLinkClass))
+	} else {
+		link.SetAttributeString("class", []byte(brokenWikiLinkClass))
+	}
+	return link
+}
+
+type wikiLinks struct{}
+
+// Extend adds the wiki link parser ahead of the normal link parser, so
+// that [[ isn't treated as the start of an ordinary link.
+func (e *wikiLinks) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithInlineParsers(
+		util.Prioritized(&wikiLinkParser{}, 199),
+	))
+}
+
+// MarkdownWithWikiLinks renders a markdown document into HTML, like
+// Markdown, but also turns wiki links into ordinary links using the
+// resolver.
+func MarkdownWithWikiLinks(source string, resolve WikiLinkResolver) (string, error) {
+	context := parser.NewContext()
+	context.Set(wikiLinkResolverKey, resolve)
+
+	var buf bytes.Buffer
+	err := renderer.Convert([]byte(source), &buf, parser.WithContext(context))
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
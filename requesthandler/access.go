@@ -0,0 +1,173 @@
+/*
+  access.go
+
+  Pages can be unlisted, protected by a password or private. Before a
+  page or file is served, we check that the visitor is allowed to see it.
+  Visitors who enter the password for a page are given a cookie for that
+  site, so they don't need to enter it again. Private pages can only be
+  seen by the site's owner.
+*/
+
+package requesthandler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+
+	"github.com/colin353/markdown.ninja/models"
+)
+
+// The template for the form which asks for a page's password.
+const passwordFile = "web/layouts/password.html"
+
+// How long visitors are remembered after entering a password, in seconds.
+const accessCookieAge = 30 * 24 * 60 * 60
+
+// The variables available to the password template.
+type passwordPage struct {
+	Path  string
+	Wrong bool
+}
+
+// Returns the name of the cookie which lets visitors see the pages which
+// are protected by the rule. Each rule has its own cookie.
+func accessCookieName(rule *models.AccessRule) string {
+	sum := sha1.Sum([]byte(rule.Path))
+	return "md_access_" + hex.EncodeToString(sum[:8])
+}
+
+// Returns the value of the cookie for the rule. It can't be made without
+// knowing our secret, and it stops working when the password changes.
+func accessToken(rule *models.AccessRule) string {
+	mac := hmac.New(sha256.New, []byte(AppConfig.CookieSecret))
+	mac.Write([]byte(rule.Domain + "\x00" + rule.Path + "\x00" + rule.PasswordHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Reports whether the visitor is allowed to see the things protected by
+// the rule.
+func visitorAllowed(rule *models.AccessRule, r *http.Request) (bool, error) {
+	switch rule.Visibility {
+	case models.VisibilityPassword:
+		cookie, err := r.Cookie(accessCookieName(rule))
+		return err == nil && hmac.Equal([]byte(cookie.Value), []byte(accessToken(rule))), nil
+	case models.VisibilityPrivate:
+		return visitorIsOwner(rule.Domain, r)
+	}
+	return true, nil
+}
+
+// Checks that the visitor is allowed to see the page. If they aren't, it
+// responds to the request itself and returns false: private pages look
+// like they don't exist, and protected pages ask for the password, which
+// is posted back to the page.
+func checkPageAccess(p *models.Page, w http.ResponseWriter, r *http.Request) bool {
+	rule, err := models.PageAccess(p.Domain, p.Name)
+	if err != nil {
+		unavailable(w, err)
+		return false
+	}
+
+	if rule.Visibility == models.VisibilityPassword && r.Method == http.MethodPost {
+		if !rule.CheckPassword(r.PostFormValue("password")) {
+			renderPasswordForm(p, true, w, r)
+			return false
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     accessCookieName(rule),
+			Value:    accessToken(rule),
+			Path:     "/",
+			MaxAge:   accessCookieAge,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+		return false
+	}
+
+	allowed, err := visitorAllowed(rule, r)
+	if err != nil {
+		unavailable(w, err)
+		return false
+	}
+	if !allowed && rule.Visibility == models.VisibilityPassword {
+		renderPasswordForm(p, false, w, r)
+		return false
+	}
+	if !allowed {
+		renderNotFound(p.Domain, w, r)
+		return false
+	}
+
+	// Pages which aren't listed shouldn't turn up in search engines, and
+	// protected pages shouldn't be cached where others might see them.
+	if !rule.Listed() {
+		p.NoIndex = true
+	}
+	if rule.Visibility == models.VisibilityPassword || rule.Visibility == models.VisibilityPrivate {
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+	return true
+}
+
+// Checks that the visitor is allowed to download the file. Visitors who
+// can't see any of the pages that protect the file are told that it
+// doesn't exist, and false is returned.
+func checkFileAccess(f *models.File, w http.ResponseWriter, r *http.Request) bool {
+	rules, err := models.FileAccess(f.Domain, f.Name)
+	if err != nil {
+		unavailable(w, err)
+		return false
+	}
+	if len(rules) == 0 {
+		return true
+	}
+
+	for _, rule := range rules {
+		allowed, err := visitorAllowed(rule, r)
+		if err != nil {
+			unavailable(w, err)
+			return false
+		}
+		if allowed {
+			w.Header().Set("Cache-Control", "private, no-store")
+			return true
+		}
+	}
+	renderNotFound(f.Domain, w, r)
+	return false
+}
+
+// Asks the visitor for the password of the page. The page's own title
+// and contents are kept secret.
+func renderPasswordForm(p *models.Page, wrong bool, w http.ResponseWriter, r *http.Request) {
+	t, err := loadLayoutFile(passwordFile)
+	if err != nil {
+		log.Printf("Could not load the password template: %v", err)
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return
+	}
+	var content bytes.Buffer
+	err = t.Execute(&content, passwordPage{r.URL.Path, wrong})
+	if err != nil {
+		log.Printf("Could not render the password form for `%s`: %v", p.Key(), err)
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return
+	}
+
+	form := models.Page{
+		Published: true,
+		Domain:    p.Domain,
+		Name:      p.Name,
+		Title:     "Password required",
+		NoIndex:   true,
+		HTML:      content.String(),
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	renderWithLayout(&form, http.StatusUnauthorized, w, r)
+}
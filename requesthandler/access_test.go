@@ -0,0 +1,147 @@
+package requesthandler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordProtectedPages(t *testing.T) {
+	createSite(t, "passwords", "Home page")
+	publishPost(t, "passwords", "secret.md", "---\ntitle: Secret plans\n---\nThe plan is ![map](/files/map.png)")
+	f := &models.File{Domain: "passwords", Name: "map.png", Hash: "abc"}
+	err := models.Insert(f)
+	if err != nil {
+		t.Fatalf("Failed to insert file: %v", err)
+	}
+	ioutil.WriteFile(f.GetPath(), []byte("map"), 0644)
+	defer os.Remove(f.GetPath())
+	rule := &models.AccessRule{Domain: "passwords", Path: "secret.md", Visibility: models.VisibilityPassword}
+	rule.SetPassword("hunter2")
+	err = models.Insert(rule)
+	if err != nil {
+		t.Fatalf("Failed to insert rule: %v", err)
+	}
+
+	// Visitors are asked for the password, without seeing the page.
+	w := fetch("passwords", "passwords.localhost", "/secret", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), `<input type="password" name="password"`)
+	assert.NotContains(t, w.Body.String(), "Secret plans")
+	assert.Equal(t, http.StatusNotFound, fetch("passwords", "passwords.localhost", "/files/map.png", nil).Code)
+	assert.NotContains(t, visit("passwords", "/sitemap.xml"), "/secret")
+
+	post := func(password string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/secret", strings.NewReader(url.Values{"password": {password}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		renderSubdomain("passwords", w, r)
+		return w
+	}
+	w = post("wrong")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "That isn't the right password.")
+
+	w = post("hunter2")
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	cookie := w.Header().Get("Set-Cookie")
+	assert.Contains(t, cookie, "HttpOnly")
+	headers := map[string]string{"Cookie": strings.Split(cookie, ";")[0]}
+
+	w = fetch("passwords", "passwords.localhost", "/secret", headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "The plan is")
+	assert.Contains(t, w.Body.String(), `<meta name="robots" content="noindex">`)
+	assert.Equal(t, "private, no-store", w.Header().Get("Cache-Control"))
+
+	// The file is only linked from the protected page, so the cookie is
+	// needed for it too.
+	w = fetch("passwords", "passwords.localhost", "/files/map.png", headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "map", w.Body.String())
+
+	// Changing the password logs visitors out.
+	rule.SetPassword("hunter3")
+	models.Save(rule)
+	assert.Equal(t, http.StatusUnauthorized, fetch("passwords", "passwords.localhost", "/secret", headers).Code)
+}
+
+func TestPrivatePages(t *testing.T) {
+	createSite(t, "private", "Home page")
+	publishPost(t, "private", "notes/todo.md", "Buy milk")
+	publishPost(t, "private", "notes/shared.md", "Shared notes")
+	for _, rule := range []*models.AccessRule{
+		{Domain: "private", Path: "notes/", Visibility: models.VisibilityPrivate},
+		{Domain: "private", Path: "notes/shared.md", Visibility: models.VisibilityUnlisted},
+	} {
+		err := models.Insert(rule)
+		if err != nil {
+			t.Fatalf("Failed to insert rule: %v", err)
+		}
+	}
+
+	// Private pages look like they don't exist.
+	w := fetch("private", "private.localhost", "/notes/todo", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.NotContains(t, w.Body.String(), "Buy milk")
+
+	// Unlisted pages can be seen, but they aren't listed.
+	assert.Contains(t, visit("private", "/notes/shared"), "Shared notes")
+	assert.NotContains(t, visit("private", "/feed.xml"), "notes")
+
+	// The editor's session doesn't reach the site, so it doesn't help.
+	r := httptest.NewRequest("GET", "/notes/todo", nil)
+	w = httptest.NewRecorder()
+	session, _ := SessionStore.Get(r, "authentication")
+	session.Values["authenticated"] = true
+	session.Values["domain"] = "private"
+	session.Save(r, w)
+	sessionCookie := strings.Split(w.Header().Get("Set-Cookie"), ";")[0]
+	w = siteRequest("private.localhost", "/notes/todo", sessionCookie)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// The owner follows the link from the editor, which signs them in
+	// to the site and takes them to the same page without the token.
+	u := &models.User{Domain: "private"}
+	models.Load(u)
+	w = siteRequest("private.localhost", "/notes/todo"+strings.Replace(OwnerPath(u), "/?", "?", 1), "")
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/notes/todo", w.Header().Get("Location"))
+	cookie := w.Header().Get("Set-Cookie")
+	assert.Contains(t, cookie, "HttpOnly")
+	assert.NotContains(t, cookie, "Domain=")
+	w = siteRequest("private.localhost", "/notes/todo", strings.Split(cookie, ";")[0])
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Buy milk")
+
+	// The cookie only works for the site it was given for.
+	assert.Equal(t, http.StatusNotFound, siteRequest("private.localhost", "/notes/todo", "md_owner=1.abc").Code)
+	createSite(t, "otherprivate", "Home page")
+	publishPost(t, "otherprivate", "notes/todo.md", "Other milk")
+	models.Insert(&models.AccessRule{Domain: "otherprivate", Path: "notes/", Visibility: models.VisibilityPrivate})
+	assert.Equal(t, http.StatusNotFound, siteRequest("otherprivate.localhost", "/notes/todo", strings.Split(cookie, ";")[0]).Code)
+
+	// Changing the password signs the owner out.
+	u.SetPassword("a new password")
+	models.Save(u)
+	assert.Equal(t, http.StatusNotFound, siteRequest("private.localhost", "/notes/todo", strings.Split(cookie, ";")[0]).Code)
+}
+
+// Makes a request to a site the same way a browser would, through its
+// subdomain.
+func siteRequest(host, path, cookie string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://"+host+path, nil)
+	if cookie != "" {
+		r.Header.Set("Cookie", cookie)
+	}
+	SubdomainHandler(w, r)
+	return w
+}
@@ -0,0 +1,143 @@
+/*
+  blog.go
+
+  Sites with blog posts get listings of their posts for free, at URLs
+  like /posts/, /posts/page/2, /posts/2026/ and /posts/2026/page/2. The
+  listings are wrapped in the site's layout, just like any other page.
+*/
+
+package requesthandler
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/colin353/markdown.ninja/models"
+)
+
+// The number of posts shown on each page of a listing.
+const postsPerPage = 10
+
+// The template for the contents of a listing.
+const listingFile = "web/layouts/posts.html"
+
+// Matches the paths of listings, capturing the year and page number.
+var listingPath = regexp.MustCompile(fmt.Sprintf(`^/%s(?:/(\d{4}))?(?:/page/(\d+))?/?$`, models.PostsFolder))
+
+// A listingPost is a post as it appears in a listing.
+type listingPost struct {
+	Title   string
+	Path    string
+	Date    time.Time
+	Excerpt template.HTML
+}
+
+// The variables available to the listing template.
+type listing struct {
+	Title string
+	Posts []listingPost
+	Years []int
+	Newer string
+	Older string
+}
+
+// Returns the path of one of the pages of a listing.
+func listingPagePath(year, page int) string {
+	path := "/" + models.PostsFolder
+	if year != 0 {
+		path += fmt.Sprintf("/%d", year)
+	}
+	if page > 1 {
+		return path + fmt.Sprintf("/page/%d", page)
+	}
+	return path + "/"
+}
+
+// Serves a listing of blog posts, if that's what the request is for. It
+// returns false if the request isn't for a listing, or for a listing which
+// doesn't have any posts on it, so the caller can serve a 404 instead.
+func renderListing(domain string, w http.ResponseWriter, r *http.Request) bool {
+	match := listingPath.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		return false
+	}
+	year, _ := strconv.Atoi(match[1])
+	page := 1
+	if match[2] != "" {
+		page, _ = strconv.Atoi(match[2])
+	}
+
+	posts, err := models.PublishedPosts(domain)
+	if err != nil {
+		unavailable(w, err)
+		return true
+	}
+
+	// The archives link to every year which has a post, and the listing
+	// only shows the posts from the year that was asked for.
+	l := listing{Title: "Posts", Years: []int{}}
+	shown := []*models.Page{}
+	for _, p := range posts {
+		postYear := p.Date.Year()
+		if len(l.Years) == 0 || l.Years[len(l.Years)-1] != postYear {
+			l.Years = append(l.Years, postYear)
+		}
+		if year == 0 || year == postYear {
+			shown = append(shown, p)
+		}
+	}
+	if year != 0 {
+		l.Title = fmt.Sprintf("Posts from %d", year)
+	}
+
+	start := (page - 1) * postsPerPage
+	if page < 1 || len(shown) == 0 || start >= len(shown) {
+		return false
+	}
+	if page > 1 {
+		l.Newer = listingPagePath(year, page-1)
+	}
+	if start+postsPerPage < len(shown) {
+		l.Older = listingPagePath(year, page+1)
+		shown = shown[:start+postsPerPage]
+	}
+	for _, p := range shown[start:] {
+		l.Posts = append(l.Posts, listingPost{
+			Title:   p.DisplayTitle(),
+			Path:    models.PageURLPath(p.Name),
+			Date:    p.Date,
+			Excerpt: template.HTML(p.Excerpt),
+		})
+	}
+
+	t, err := loadLayoutFile(listingFile)
+	if err != nil {
+		log.Printf("Could not load the listing template: %v", err)
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return true
+	}
+	var content bytes.Buffer
+	err = t.Execute(&content, l)
+	if err != nil {
+		log.Printf("Could not render the listing of `%s`: %v", r.URL.Path, err)
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return true
+	}
+
+	// The listing is shown as if it were the index page of the folder.
+	p := models.Page{
+		Published: true,
+		Domain:    domain,
+		Name:      models.PostsFolder + "/index.md",
+		Title:     l.Title,
+		HTML:      content.String(),
+	}
+	renderWithLayout(&p, http.StatusOK, w, r)
+	return true
+}
@@ -0,0 +1,64 @@
+package requesthandler
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func publishPost(t *testing.T, domain, name, markdown string) {
+	p := &models.Page{Domain: domain, Name: name, Markdown: markdown}
+	err := models.Insert(p)
+	if err == nil {
+		err = p.Publish()
+	}
+	if err != nil {
+		t.Fatalf("Failed to publish post: %v", err)
+	}
+}
+
+func TestBlogListings(t *testing.T) {
+	createSite(t, "blog", "Hello")
+	for i := 1; i <= 11; i++ {
+		markdown := fmt.Sprintf("---\ntitle: Post %d\ndate: 2026-01-%02d\n---\nExcerpt %d\n\nThe rest.", i, i, i)
+		publishPost(t, "blog", fmt.Sprintf("posts/post%d.md", i), markdown)
+	}
+	publishPost(t, "blog", "posts/old.md", "---\ntitle: Old\ndate: 2025-06-01\n---\nOld post")
+	publishPost(t, "blog", "posts/undated.md", "Undated")
+	publishPost(t, "blog", "posts/draft.md", "---\ndate: 2026-02-01\ndraft: true\n---\nDraft")
+
+	// The newest posts come first, with their excerpts.
+	body := visit("blog", "/posts/")
+	assert.Contains(t, body, "<title>Posts</title>")
+	assert.Contains(t, body, `<a href="/posts/post11">Post 11</a>`)
+	assert.Contains(t, body, "<p>Excerpt 11</p>")
+	assert.NotContains(t, body, "The rest.")
+	assert.Contains(t, body, `<a href="/posts/page/2">Older posts</a>`)
+	assert.Contains(t, body, `<a href="/posts/2026/">2026</a> <a href="/posts/2025/">2025</a>`)
+	assert.Equal(t, 10, strings.Count(body, "class='md_post'"), body)
+	assert.NotContains(t, body, "Undated")
+	assert.NotContains(t, body, "Draft")
+
+	body = visit("blog", "/posts/page/2")
+	assert.Contains(t, body, "Post 1<")
+	assert.Contains(t, body, "Old")
+	assert.Contains(t, body, `<a href="/posts/">Newer posts</a>`)
+	assert.NotContains(t, body, "Older posts")
+
+	body = visit("blog", "/posts/2025/")
+	assert.Contains(t, body, "<title>Posts from 2025</title>")
+	assert.Equal(t, 1, strings.Count(body, "class='md_post'"))
+
+	// Posts are still served as pages, and listings past the end don't
+	// exist.
+	assert.Contains(t, visit("blog", "/posts/post3"), "The rest.")
+	for _, path := range []string{"/posts/page/3", "/posts/2024/", "/posts/page/0"} {
+		w := httptest.NewRecorder()
+		renderSubdomain("blog", w, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, 404, w.Code, path)
+	}
+}
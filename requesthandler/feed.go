@@ -0,0 +1,253 @@
+/*
+  feed.go
+
+  Every site has an RSS feed at /feed.xml and an Atom feed at /atom.xml,
+  so that readers can subscribe to it. The feeds contain the site's blog
+  posts, or all of its pages if it doesn't have any posts.
+*/
+
+package requesthandler
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/colin353/markdown.ninja/render"
+)
+
+// The maximum number of pages in a feed.
+const feedLength = 20
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	GUID        string `xml:"guid"`
+	PubDate     string `xml:"pubDate,omitempty"`
+	Description string `xml:"description"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title     string      `xml:"title"`
+	ID        string      `xml:"id"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published,omitempty"`
+	Link      atomLink    `xml:"link"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// Returns the URL of the root of the site, as the visitor sees it. Sites
+// can be visited through their subdomain or their external domain, so
+// the host comes from the request.
+func siteURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
+
+// Returns the page's HTML as it should appear in a feed. Readers show it
+// away from the site, so the links in it have to be absolute.
+func feedContent(p *models.Page, link string) string {
+	content := render.Sanitize(p.HTML)
+	base, err := url.Parse(link)
+	if err != nil {
+		return content
+	}
+	return render.AbsoluteLinks(content, base)
+}
+
+// Returns the time the page last changed, as far as we know.
+func pageUpdated(p *models.Page) time.Time {
+	if p.PublishedAt.After(p.Date) {
+		return p.PublishedAt
+	}
+	return p.Date
+}
+
+// Returns the pages which belong in the site's feed, newest first.
+func feedPages(domain string) ([]*models.Page, error) {
+	pages, err := models.PublishedPosts(domain)
+	if err != nil || len(pages) > 0 {
+		return pages, err
+	}
+
+	// The site doesn't have a blog, so the feed has its pages instead.
+	published, err := models.PublishedPages(domain)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range published {
+		if !p.Draft {
+			pages = append(pages, p)
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		a, b := pageUpdated(pages[i]), pageUpdated(pages[j])
+		if !a.Equal(b) {
+			return a.After(b)
+		}
+		return pages[i].Name < pages[j].Name
+	})
+	return pages, nil
+}
+
+// Builds the RSS version of the feed.
+func rssDocument(u *models.User, site string, pages []*models.Page, updated time.Time) interface{} {
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       u.Name,
+			Link:        site + "/",
+			Description: u.Bio,
+			Items:       []rssItem{},
+		},
+	}
+	if !updated.IsZero() {
+		feed.Channel.LastBuildDate = updated.Format(time.RFC1123Z)
+	}
+	for _, p := range pages {
+		link := site + models.PageURLPath(p.Name)
+		item := rssItem{
+			Title:       p.DisplayTitle(),
+			Link:        link,
+			GUID:        link,
+			Description: feedContent(p, link),
+		}
+		if !p.Date.IsZero() {
+			item.PubDate = p.Date.Format(time.RFC1123Z)
+		}
+		feed.Channel.Items = append(feed.Channel.Items, item)
+	}
+	return feed
+}
+
+// Builds the Atom version of the feed. Atom requires every entry to have
+// an updated time, so pages which don't have one use the feed's.
+func atomDocument(u *models.User, site string, pages []*models.Page, updated time.Time) interface{} {
+	feed := atomFeed{
+		Title:   u.Name,
+		ID:      site + "/",
+		Updated: updated.Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: site + "/"},
+			{Href: site + "/atom.xml", Rel: "self"},
+		},
+		Author:  atomAuthor{u.Name},
+		Entries: []atomEntry{},
+	}
+	for _, p := range pages {
+		link := site + models.PageURLPath(p.Name)
+		entry := atomEntry{
+			Title:   p.DisplayTitle(),
+			ID:      link,
+			Updated: updated.Format(time.RFC3339),
+			Link:    atomLink{Href: link},
+			Content: atomContent{Type: "html", Body: feedContent(p, link)},
+		}
+		if t := pageUpdated(p); !t.IsZero() {
+			entry.Updated = t.Format(time.RFC3339)
+		}
+		if !p.Date.IsZero() {
+			entry.Published = p.Date.Format(time.RFC3339)
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return feed
+}
+
+// Serves one of the site's feeds. The document function builds the feed
+// in a particular format. Readers poll feeds often, so they can use
+// If-Modified-Since or If-None-Match to skip downloading it again.
+func renderFeed(domain string, document func(*models.User, string, []*models.Page, time.Time) interface{}, contentType string, w http.ResponseWriter, r *http.Request) {
+	domain, err := resolveDomain(domain)
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, "404: that thing doesn't exist!", http.StatusNotFound)
+		return
+	}
+
+	user := models.User{}
+	user.Domain = domain
+	err = models.Load(&user)
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return
+	}
+
+	pages, err := feedPages(domain)
+	if err != nil {
+		unavailable(w, err)
+		return
+	}
+	if len(pages) > feedLength {
+		pages = pages[:feedLength]
+	}
+	var updated time.Time
+	for _, p := range pages {
+		if t := pageUpdated(p); t.After(updated) {
+			updated = t
+		}
+	}
+
+	output, err := xml.MarshalIndent(document(&user, siteURL(r), pages, updated), "", "  ")
+	if err != nil {
+		log.Printf("Unable to generate feed for `%s`: %v", domain, err)
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return
+	}
+	output = append([]byte(xml.Header), output...)
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", fmt.Sprintf("\"%x\"", sha1.Sum(output)))
+	http.ServeContent(w, r, "", updated, bytes.NewReader(output))
+}
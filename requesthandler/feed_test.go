@@ -0,0 +1,84 @@
+package requesthandler
+
+import (
+	"encoding/xml"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func fetch(domain, host, path string, headers map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", path, nil)
+	r.Host = host
+	for header, value := range headers {
+		r.Header.Set(header, value)
+	}
+	renderSubdomain(domain, w, r)
+	return w
+}
+
+func TestFeeds(t *testing.T) {
+	createSite(t, "feeds", "Home page")
+	publishPost(t, "feeds", "posts/first.md", "---\ntitle: First <post>\ndate: 2026-03-01\n---\nHello *world*")
+	publishPost(t, "feeds", "posts/second.md", "---\ntitle: Second\ndate: 2026-03-02\n---\n[Again](/posts/first) ![me](/files/me.png)")
+
+	w := fetch("feeds", "feeds.localhost:8080", "/feed.xml", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/rss+xml; charset=utf-8", w.Header().Get("Content-Type"))
+	rss := rssFeed{}
+	err := xml.Unmarshal(w.Body.Bytes(), &rss)
+	assert.Nil(t, err)
+	assert.Equal(t, "http://feeds.localhost:8080/", rss.Channel.Link)
+	assert.Len(t, rss.Channel.Items, 2)
+	assert.Equal(t, "Second", rss.Channel.Items[0].Title)
+	assert.Equal(t, "First <post>", rss.Channel.Items[1].Title)
+	assert.Equal(t, "http://feeds.localhost:8080/posts/first", rss.Channel.Items[1].Link)
+	assert.Equal(t, "<p>Hello <em>world</em></p>\n", rss.Channel.Items[1].Description)
+	assert.Equal(t, "Sun, 01 Mar 2026 00:00:00 +0000", rss.Channel.Items[1].PubDate)
+
+	// Feeds can be polled without downloading them again.
+	etag, lastModified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	assert.NotEmpty(t, etag)
+	w = fetch("feeds", "feeds.localhost:8080", "/feed.xml", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, 304, w.Code)
+	w = fetch("feeds", "feeds.localhost:8080", "/feed.xml", map[string]string{"If-Modified-Since": lastModified})
+	assert.Equal(t, 304, w.Code)
+
+	// Sites visited through their external domain link to that domain.
+	err = models.Insert(&models.Domain{ExternalDomain: "feeds.example.com", InternalDomain: "feeds"})
+	assert.Nil(t, err)
+	w = fetch("feeds.example.com", "feeds.example.com", "/atom.xml", map[string]string{"X-Forwarded-Proto": "https"})
+	assert.Equal(t, 200, w.Code)
+	atom := atomFeed{}
+	err = xml.Unmarshal(w.Body.Bytes(), &atom)
+	assert.Nil(t, err)
+	assert.Equal(t, "Layout <Tester>", atom.Title)
+	assert.Equal(t, "https://feeds.example.com/atom.xml", atom.Links[1].Href)
+	assert.Len(t, atom.Entries, 2)
+	assert.Equal(t, "https://feeds.example.com/posts/second", atom.Entries[0].Link.Href)
+	assert.Equal(t, "html", atom.Entries[0].Content.Type)
+	assert.Equal(t, "2026-03-02T00:00:00Z", atom.Entries[0].Published)
+	assert.NotEmpty(t, atom.Entries[0].Updated)
+
+	// Links in the content point back at the site, since readers show
+	// it somewhere else.
+	assert.Equal(t, `<p><a href="https://feeds.example.com/posts/first">Again</a> <img src="https://feeds.example.com/files/me.png" alt="me"></p>`+"\n", atom.Entries[0].Content.Body)
+}
+
+func TestFeedWithoutPosts(t *testing.T) {
+	createSite(t, "feedpages", "Home page")
+	publishPost(t, "feedpages", "hidden.md", "---\ndraft: true\n---\nHidden")
+
+	w := fetch("feedpages", "feedpages.localhost", "/feed.xml", nil)
+	rss := rssFeed{}
+	err := xml.Unmarshal(w.Body.Bytes(), &rss)
+	assert.Nil(t, err)
+	assert.Len(t, rss.Channel.Items, 1)
+	assert.Equal(t, "http://feedpages.localhost/", rss.Channel.Items[0].Link)
+
+	w = fetch("nobody", "nobody.localhost", "/feed.xml", nil)
+	assert.Equal(t, 404, w.Code)
+}
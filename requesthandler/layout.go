@@ -0,0 +1,233 @@
+/*
+  layout.go
+
+  Pages are wrapped in a layout before they're served. A layout is an
+  html/template which is given the page, site and user variables. Users
+  can write their own layouts, styles can come with a layout, and there's
+  a default layout for everything else.
+*/
+
+package requesthandler
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/colin353/markdown.ninja/render"
+)
+
+// The layout which is used when neither the user nor their style
+// provides one.
+const defaultLayoutFile = "web/layouts/default.html"
+
+// The style used when the user's style doesn't make sense.
+const defaultStyle = "default"
+
+// LayoutData contains the variables which are available to a layout.
+// For example, a layout can use {{.Page.Title}} or {{.User.Name}}.
+type LayoutData struct {
+	Page LayoutPage
+	Site LayoutSite
+	User LayoutUser
+}
+
+// LayoutPage describes the page being shown. Content is the page's
+// HTML, which has already been sanitized, so it isn't escaped again.
+type LayoutPage struct {
+	Name        string
+	Title       string
+	Description string
+	Date        time.Time
+	Tags        []string
+	NoIndex     bool
+	Content     template.HTML
+}
+
+// LayoutSite describes the site the page belongs to. CSS contains the
+// stylesheets for the user's style. Menu is empty unless the user has
+// turned on the navigation menu.
+type LayoutSite struct {
+	Domain string
+	Host   string
+	Style  string
+	CSS    template.CSS
+	Menu   []LayoutMenuItem
+}
+
+// LayoutMenuItem is a link in the navigation menu. Active is set for
+// the link to the page being shown.
+type LayoutMenuItem struct {
+	Title  string
+	Path   string
+	Active bool
+}
+
+// LayoutUser contains the public details of the user who owns the site.
+type LayoutUser struct {
+	Name string
+	Bio  string
+}
+
+// A layout which could be used for a page. Layouts written by users
+// aren't trusted, since html/template only escapes the variables, and
+// the rest of the layout could contain scripts.
+type layout struct {
+	template *template.Template
+	custom   bool
+}
+
+// ParseLayout parses the source of a layout. Variables used by the
+// layout are escaped according to where they appear.
+func ParseLayout(name, source string) (*template.Template, error) {
+	return template.New(name).Parse(source)
+}
+
+// Returns the name of the user's style, or the default style if the
+// name couldn't be used to find its files.
+func styleName(u *models.User) string {
+	if !models.ValidLayoutName(u.Style) {
+		return defaultStyle
+	}
+	return u.Style
+}
+
+// Reads the stylesheets needed for the user's style.
+func loadStyleCSS(style string) (template.CSS, error) {
+	styleCSS, err := ioutil.ReadFile(fmt.Sprintf("web/css/webstyles/%s.css", style))
+	if err != nil {
+		return "", err
+	}
+	requiredCSS, err := ioutil.ReadFile("web/css/webstyles/required.css")
+	if err != nil {
+		return "", err
+	}
+	return template.CSS(string(styleCSS) + "\n" + string(requiredCSS)), nil
+}
+
+// Reads and parses a layout from a file.
+func loadLayoutFile(filename string) (*template.Template, error) {
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseLayout(filename, string(source))
+}
+
+// Returns the layouts which could be used for the page, in order of
+// preference. The user's own layouts come first: the one named by the
+// page's front matter, then their default layout. Then comes the layout
+// which goes with their style, if it has one, and finally the default
+// layout. Layouts which don't exist or don't parse are skipped.
+func pageLayouts(p *models.Page, u *models.User) ([]layout, error) {
+	layouts := []layout{}
+
+	names := []string{models.DefaultLayoutName}
+	if p.Layout != "" && p.Layout != models.DefaultLayoutName {
+		names = []string{p.Layout, models.DefaultLayoutName}
+	}
+	for _, name := range names {
+		l := models.Layout{Domain: u.Domain, Name: name}
+		err := models.Load(&l)
+		if models.IsStorageError(err) {
+			return nil, err
+		}
+		if err != nil {
+			continue
+		}
+		t, err := ParseLayout(l.Name, l.Template)
+		if err != nil {
+			log.Printf("Unable to parse layout `%s`: %v", l.Key(), err)
+			continue
+		}
+		layouts = append(layouts, layout{t, true})
+	}
+
+	styleLayout := fmt.Sprintf("web/css/webstyles/%s.html", styleName(u))
+	t, err := loadLayoutFile(styleLayout)
+	if err == nil {
+		layouts = append(layouts, layout{t, false})
+	} else if !os.IsNotExist(err) {
+		log.Printf("Unable to load layout `%s`: %v", styleLayout, err)
+	}
+
+	t, err = loadLayoutFile(defaultLayoutFile)
+	if err != nil {
+		return nil, err
+	}
+	return append(layouts, layout{t, false}), nil
+}
+
+// Renders the page inside the first of the layouts which works. If the
+// user's layout fails, the page is still shown with the next one, rather
+// than not at all. The output of the user's layouts is sanitized.
+func executeLayouts(layouts []layout, data *LayoutData) ([]byte, error) {
+	var err error
+	for _, l := range layouts {
+		var b bytes.Buffer
+		err = l.template.Execute(&b, data)
+		if err == nil && l.custom {
+			return []byte(render.SanitizeDocument(b.String())), nil
+		}
+		if err == nil {
+			return b.Bytes(), nil
+		}
+		log.Printf("Unable to render layout `%s`: %v", l.template.Name(), err)
+	}
+	return nil, err
+}
+
+// Builds the navigation menu for the site, if the user wants one.
+func siteMenu(p *models.Page) ([]LayoutMenuItem, error) {
+	n := models.Navigation{}
+	n.Domain = p.Domain
+	err := models.Load(&n)
+	if models.IsStorageError(err) {
+		return nil, err
+	}
+	if err != nil || !n.Enabled {
+		return nil, nil
+	}
+
+	pages, err := models.PublishedPages(p.Domain)
+	if err != nil {
+		return nil, err
+	}
+	current := models.PageURLPath(p.Name)
+	menu := []LayoutMenuItem{}
+	for _, item := range n.Menu(pages) {
+		menu = append(menu, LayoutMenuItem{item.Title, item.Path, item.Path == current})
+	}
+	return menu, nil
+}
+
+// Collects the variables that the layout can use.
+func newLayoutData(p *models.Page, u *models.User, host string, css template.CSS, menu []LayoutMenuItem) *LayoutData {
+	return &LayoutData{
+		Page: LayoutPage{
+			Name:        p.Name,
+			Title:       p.Title,
+			Description: p.Description,
+			Date:        p.Date,
+			Tags:        p.Tags,
+			NoIndex:     p.NoIndex,
+			Content:     template.HTML(p.HTML),
+		},
+		Site: LayoutSite{
+			Domain: u.Domain,
+			Host:   host,
+			Style:  styleName(u),
+			CSS:    css,
+			Menu:   menu,
+		},
+		User: LayoutUser{
+			Name: u.Name,
+			Bio:  u.Bio,
+		},
+	}
+}
@@ -0,0 +1,135 @@
+package requesthandler
+
+import (
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/colin353/markdown.ninja/config"
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	AppConfig = config.LoadConfig("../config")
+	AppConfig.Database = "memory"
+	models.AppConfig = AppConfig
+	SessionStore = sessions.NewCookieStore([]byte(AppConfig.CookieSecret))
+	err := models.Connect()
+	if err != nil {
+		log.Fatalf("Unable to connect to the database: %v", err)
+	}
+
+	// Pages are rendered using files relative to the root directory.
+	os.Chdir("../")
+}
+
+// Creates a user with a published page, and returns the user.
+func createSite(t *testing.T, domain, markdown string) *models.User {
+	u := models.NewUser()
+	u.Name = "Layout <Tester>"
+	u.Domain = domain
+	u.Email = "layout@test.com"
+	u.SetPassword("layout password")
+	err := models.Insert(u)
+	if err != nil {
+		t.Fatalf("Failed to insert user: %v", err)
+	}
+
+	p := &models.Page{Domain: domain, Name: "index.md", Markdown: markdown}
+	err = models.Insert(p)
+	if err == nil {
+		err = p.Publish()
+	}
+	if err != nil {
+		t.Fatalf("Failed to publish page: %v", err)
+	}
+	return u
+}
+
+func visit(domain, path string) string {
+	w := httptest.NewRecorder()
+	renderSubdomain(domain, w, httptest.NewRequest("GET", path, nil))
+	return w.Body.String()
+}
+
+func TestDefaultLayout(t *testing.T) {
+	createSite(t, "defaultlayout", "---\ntitle: Tom & \"Jerry\"\ndescription: <script>\n---\n# Hello")
+
+	body := visit("defaultlayout", "/")
+	assert.True(t, strings.HasPrefix(body, "<!DOCTYPE html>"), body)
+	assert.Contains(t, body, "<title>Tom &amp; &#34;Jerry&#34;</title>")
+	assert.Contains(t, body, `<meta name="description" content="&lt;script&gt;">`)
+	assert.Contains(t, body, `<h1 id="hello">Hello</h1>`)
+	assert.Contains(t, body, ".md_container")
+}
+
+func TestCustomLayouts(t *testing.T) {
+	createSite(t, "customlayout", "---\nlayout: plain\n---\nHello")
+
+	// The style's layout is used until the user writes their own.
+	body := visit("customlayout", "/")
+	assert.Contains(t, body, "<!DOCTYPE html>")
+
+	err := models.Insert(&models.Layout{Domain: "customlayout", Name: "default", Template: "default {{.User.Name}}"})
+	assert.Nil(t, err)
+	body = visit("customlayout", "/")
+	assert.Equal(t, "default Layout &lt;Tester&gt;", body)
+
+	// The page asks for the plain layout in its front matter.
+	err = models.Insert(&models.Layout{Domain: "customlayout", Name: "plain", Template: "plain {{.Page.Content}}"})
+	assert.Nil(t, err)
+	body = visit("customlayout", "/")
+	assert.Equal(t, "plain <p>Hello</p>\n", body)
+
+	// A broken layout falls back to the next one.
+	err = models.Save(&models.Layout{Domain: "customlayout", Name: "plain", Template: "plain {{.Page.Missing}}"})
+	assert.Nil(t, err)
+	body = visit("customlayout", "/")
+	assert.Equal(t, "default Layout &lt;Tester&gt;", body)
+}
+
+func TestCustomLayoutScripts(t *testing.T) {
+	createSite(t, "layoutscripts", "Hello")
+
+	// html/template only escapes the variables, so the rest of a user's
+	// layout has to be sanitized before it's served.
+	source := "<!DOCTYPE html>\n<html lang=\"en\"><head><meta charset=\"utf-8\">" +
+		"<meta http-equiv=\"refresh\" content=\"0;url=https://evil.com\">" +
+		"<link rel=\"stylesheet\" href=\"/style.css\"><link rel=\"stylesheet\" href=\"javascript:alert(2)\">" +
+		"<style>p > a { color: red; }</style><script>alert(3)</script></head>" +
+		"<body onload=\"alert(4)\"><img src=\"x\" onerror=\"alert(5)\"><iframe src=\"https://evil.com\"></iframe>" +
+		"{{.Page.Content}}</body></html>"
+	err := models.Insert(&models.Layout{Domain: "layoutscripts", Name: "default", Template: source})
+	assert.Nil(t, err)
+
+	body := visit("layoutscripts", "/")
+	assert.True(t, strings.HasPrefix(body, "<!DOCTYPE html>"), body)
+	assert.Contains(t, body, `<meta charset="utf-8">`)
+	assert.Contains(t, body, `<link rel="stylesheet" href="/style.css">`)
+	assert.Contains(t, body, "<style>p > a { color: red; }</style>")
+	assert.Contains(t, body, "<p>Hello</p>")
+	for _, unsafe := range []string{"alert", "<script", "onload", "onerror", "<iframe", "http-equiv", "javascript:"} {
+		assert.NotContains(t, body, unsafe)
+	}
+}
+
+func TestNavigationMenu(t *testing.T) {
+	createSite(t, "navigation", "Hello")
+	about := &models.Page{Domain: "navigation", Name: "about.md", Markdown: "---\ntitle: About\n---\n"}
+	models.Insert(about)
+	about.Publish()
+	models.Insert(&models.Page{Domain: "navigation", Name: "draft.md"})
+
+	// The menu isn't shown until it's turned on.
+	assert.NotContains(t, visit("navigation", "/"), "<nav")
+
+	err := models.Insert(&models.Navigation{Domain: "navigation", Enabled: true, Order: []string{"about.md"}})
+	assert.Nil(t, err)
+	body := visit("navigation", "/about")
+	assert.Contains(t, body, "<a href=\"/about\" class='active'>About</a>\n      <a href=\"/\">Home</a>")
+	assert.NotContains(t, body, "draft")
+}
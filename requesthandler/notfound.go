@@ -0,0 +1,89 @@
+/*
+  notfound.go
+
+  When a visitor asks for something that doesn't exist, they're shown a
+  page in the site's layout, so they can find their way back. Users can
+  write this page themselves, otherwise a default one is shown.
+*/
+
+package requesthandler
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/colin353/markdown.ninja/render"
+)
+
+// The template for the contents of the default not found page.
+const notFoundFile = "web/layouts/404.html"
+
+// The variables available to the not found template.
+type notFoundPage struct {
+	Path string
+}
+
+// Serves the site's not found page with a 404 status. If the site itself
+// doesn't exist, there's no layout to use, so the visitor just gets the
+// status.
+func renderNotFound(domain string, w http.ResponseWriter, r *http.Request) {
+	domain, err := resolveDomain(domain)
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, "404: that thing doesn't exist!", http.StatusNotFound)
+		return
+	}
+
+	user := models.User{}
+	user.Domain = domain
+	err = models.Load(&user)
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return
+	}
+
+	p := models.Page{}
+	p.Published = true
+	p.Domain = domain
+	p.Name = user.NotFoundPageName()
+	err = models.Load(&p)
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return
+	}
+	if err == nil && !p.Draft {
+		p.HTML = render.Sanitize(p.HTML)
+		p.NoIndex = true
+		renderWithLayout(&p, http.StatusNotFound, w, r)
+		return
+	}
+
+	t, err := loadLayoutFile(notFoundFile)
+	if err != nil {
+		log.Printf("Could not load the not found template: %v", err)
+		http.Error(w, "404: that thing doesn't exist!", http.StatusNotFound)
+		return
+	}
+	var content bytes.Buffer
+	err = t.Execute(&content, notFoundPage{r.URL.Path})
+	if err != nil {
+		log.Printf("Could not render the not found page for `%s`: %v", r.URL.Path, err)
+		http.Error(w, "404: that thing doesn't exist!", http.StatusNotFound)
+		return
+	}
+
+	p = models.Page{
+		Published: true,
+		Domain:    domain,
+		Name:      user.NotFoundPageName(),
+		Title:     "Page not found",
+		NoIndex:   true,
+		HTML:      content.String(),
+	}
+	renderWithLayout(&p, http.StatusNotFound, w, r)
+}
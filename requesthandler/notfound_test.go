@@ -0,0 +1,43 @@
+package requesthandler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotFoundPage(t *testing.T) {
+	u := createSite(t, "notfound", "Home page")
+
+	// Without a page of their own, sites get the default one, in their
+	// layout.
+	w := fetch("notfound", "notfound.localhost", "/missing", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "<title>Page not found</title>")
+	assert.Contains(t, w.Body.String(), "<code>/missing</code>")
+	assert.Contains(t, w.Body.String(), `<meta name="robots" content="noindex">`)
+
+	publishPost(t, "notfound", "404.md", "# Lost?\nTry the [home page](/).")
+	w = fetch("notfound", "notfound.localhost", "/files/missing.png", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), `<h1 id="lost">Lost?</h1>`)
+
+	// Users can choose another page.
+	publishPost(t, "notfound", "gone.md", "Gone fishing")
+	u.NotFoundPage = "gone.md"
+	err := models.Save(u)
+	if err != nil {
+		t.Fatalf("Failed to save user: %v", err)
+	}
+	w = fetch("notfound", "notfound.localhost", "/missing", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "Gone fishing")
+	assert.NotContains(t, visit("notfound", "/sitemap.xml"), "/gone")
+
+	// Sites which don't exist don't have a layout.
+	w = fetch("nosuchsite", "nosuchsite.localhost", "/", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "404: that thing doesn't exist!\n", w.Body.String())
+}
@@ -0,0 +1,133 @@
+/*
+  owner.go
+
+  Owners can see their own private pages. The editor is served from the
+  main host, so its session cookie isn't sent to the site's subdomain.
+  Instead, the editor gives the owner a signed link to their site, and
+  the token in it is kept in a cookie for that site.
+*/
+
+package requesthandler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/colin353/markdown.ninja/models"
+)
+
+// The name of the query parameter and cookie holding an owner token.
+const (
+	ownerParameter = "owner"
+	ownerCookie    = "md_owner"
+)
+
+// How long an owner token works for.
+const ownerTokenAge = 12 * time.Hour
+
+// Returns the signature of an owner token for the user which expires at
+// the given time. It can't be made without knowing our secret, and it
+// stops working when the user's password changes.
+func ownerSignature(u *models.User, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(AppConfig.CookieSecret))
+	mac.Write([]byte(fmt.Sprintf("owner\x00%s\x00%d\x00%s", u.Domain, expires, u.PasswordHash)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// OwnerToken returns a token which lets the user see their own private
+// pages, for a while. It's of the form [expiry].[signature], where the
+// expiry is in seconds since the epoch.
+func OwnerToken(u *models.User) string {
+	expires := time.Now().Add(ownerTokenAge).Unix()
+	return fmt.Sprintf("%d.%s", expires, ownerSignature(u, expires))
+}
+
+// OwnerPath returns the path, relative to the root of the user's site,
+// which signs them in as its owner.
+func OwnerPath(u *models.User) string {
+	return "/?" + ownerParameter + "=" + OwnerToken(u)
+}
+
+// Reports when the token stops working, if it's a valid owner token for
+// the domain.
+func checkOwnerToken(domain, token string) (time.Time, bool, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return time.Time{}, false, nil
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || !time.Now().Before(time.Unix(expires, 0)) {
+		return time.Time{}, false, nil
+	}
+
+	u := models.User{}
+	u.Domain = domain
+	err = models.Load(&u)
+	if models.IsStorageError(err) {
+		return time.Time{}, false, err
+	}
+	if err != nil {
+		return time.Time{}, false, nil
+	}
+	valid := hmac.Equal([]byte(parts[1]), []byte(ownerSignature(&u, expires)))
+	return time.Unix(expires, 0), valid, nil
+}
+
+// Reports whether the visitor is the owner of the site.
+func visitorIsOwner(domain string, r *http.Request) (bool, error) {
+	cookie, err := r.Cookie(ownerCookie)
+	if err != nil {
+		return false, nil
+	}
+	_, valid, err := checkOwnerToken(domain, cookie.Value)
+	return valid, err
+}
+
+// Signs the visitor in as the owner of the site, if the request has an
+// owner token, and redirects them to the same page without it, so that
+// the token doesn't end up in their history. Returns true if it has
+// responded to the request.
+func signInOwner(domain string, w http.ResponseWriter, r *http.Request) bool {
+	token := r.URL.Query().Get(ownerParameter)
+	if token == "" {
+		return false
+	}
+
+	domain, err := resolveDomain(domain)
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return true
+	}
+	if err != nil {
+		return false
+	}
+
+	expires, valid, err := checkOwnerToken(domain, token)
+	if err != nil {
+		unavailable(w, err)
+		return true
+	}
+	if valid {
+		http.SetCookie(w, &http.Cookie{
+			Name:     ownerCookie,
+			Value:    token,
+			Path:     "/",
+			Expires:  expires,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	query := r.URL.Query()
+	query.Del(ownerParameter)
+	target := *r.URL
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.RequestURI(), http.StatusSeeOther)
+	return true
+}
@@ -0,0 +1,97 @@
+/*
+  preview.go
+
+  Visitors with a preview link see the drafts of a site's pages, as they
+  will look once they're published. The token in the link is kept in a
+  cookie, so that they can follow links around the site.
+*/
+
+package requesthandler
+
+import (
+	"net/http"
+
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/colin353/markdown.ninja/render"
+)
+
+// The name of the query parameter and cookie holding a preview token.
+const (
+	previewParameter = "preview"
+	previewCookie    = "md_preview"
+)
+
+// Serves the draft of the page, if the visitor has a preview link which
+// allows them to see it. It returns false if they don't, so the caller
+// can serve the published page instead. Preview links which don't work
+// any more are treated as if the page doesn't exist, rather than showing
+// the published page and leaving the reviewer wondering where the
+// changes went.
+func renderPreview(domain string, w http.ResponseWriter, r *http.Request) bool {
+	token := r.URL.Query().Get(previewParameter)
+	fromCookie := false
+	if token == "" {
+		cookie, err := r.Cookie(previewCookie)
+		if err != nil {
+			return false
+		}
+		token, fromCookie = cookie.Value, true
+	}
+
+	domain, err := resolveDomain(domain)
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return true
+	}
+	if err != nil {
+		return false
+	}
+
+	preview, err := models.FindPreviewToken(domain, token)
+	if err != nil {
+		unavailable(w, err)
+		return true
+	}
+	if preview == nil && fromCookie {
+		http.SetCookie(w, &http.Cookie{Name: previewCookie, Path: "/", MaxAge: -1})
+		return false
+	}
+	if preview == nil {
+		renderNotFound(domain, w, r)
+		return true
+	}
+	if !fromCookie {
+		http.SetCookie(w, &http.Cookie{
+			Name:     previewCookie,
+			Value:    preview.Token,
+			Path:     "/",
+			Expires:  preview.ExpiresAt,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	p := models.Page{}
+	p.Domain = domain
+	err = loadPageAtPath(&p, r.URL.Path)
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return true
+	}
+	if err != nil || !preview.Allows(p.Name) {
+		return false
+	}
+
+	// A link to the whole site doesn't get past the site's own
+	// protection, since the user might not have meant to share those
+	// pages.
+	if preview.Page == "" && !checkPageAccess(&p, w, r) {
+		return true
+	}
+
+	p.HTML = render.Sanitize(p.HTML)
+	p.NoIndex = true
+	w.Header().Set("Cache-Control", "private, no-store")
+	renderWithLayout(&p, http.StatusOK, w, r)
+	return true
+}
@@ -0,0 +1,70 @@
+package requesthandler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreviewLinks(t *testing.T) {
+	createSite(t, "previews", "Home page")
+	publishPost(t, "previews", "post.md", "Published words")
+	p := &models.Page{Domain: "previews", Name: "post.md"}
+	err := models.Load(p)
+	if err == nil {
+		p.Markdown = "Draft words"
+		err = models.Save(p)
+	}
+	if err != nil {
+		t.Fatalf("Failed to edit draft: %v", err)
+	}
+	publishPost(t, "previews", "secret.md", "Secret words")
+	err = models.Insert(&models.AccessRule{Domain: "previews", Path: "secret.md", Visibility: models.VisibilityPrivate})
+	if err != nil {
+		t.Fatalf("Failed to insert rule: %v", err)
+	}
+
+	// Without a token, visitors see the published page.
+	assert.Contains(t, visit("previews", "/post"), "Published words")
+	assert.Equal(t, http.StatusNotFound, fetch("previews", "previews.localhost", "/post?preview=0123456789abcdef0123456789abcdef", nil).Code)
+
+	site, err := models.NewPreviewToken("previews", "", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create preview token: %v", err)
+	}
+	w := fetch("previews", "previews.localhost", "/post?preview="+site.Token, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Draft words")
+	assert.Contains(t, w.Body.String(), `<meta name="robots" content="noindex">`)
+	assert.Equal(t, "private, no-store", w.Header().Get("Cache-Control"))
+
+	// The cookie keeps the preview going around the site, but it doesn't
+	// get past the site's own protection.
+	cookie := w.Header().Get("Set-Cookie")
+	assert.Contains(t, cookie, "HttpOnly")
+	headers := map[string]string{"Cookie": strings.Split(cookie, ";")[0]}
+	assert.Contains(t, fetch("previews", "previews.localhost", "/post", headers).Body.String(), "Draft words")
+	assert.Equal(t, http.StatusNotFound, fetch("previews", "previews.localhost", "/secret", headers).Code)
+
+	// Once the token is revoked, the cookie is cleared and visitors see
+	// the published page again.
+	err = models.Delete(site)
+	if err != nil {
+		t.Fatalf("Failed to revoke preview token: %v", err)
+	}
+	w = fetch("previews", "previews.localhost", "/post", headers)
+	assert.Contains(t, w.Body.String(), "Published words")
+	assert.Contains(t, w.Header().Get("Set-Cookie"), "Max-Age=0")
+
+	// A token for one page only shows that page's draft.
+	page, err := models.NewPreviewToken("previews", "index.md", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create preview token: %v", err)
+	}
+	assert.Contains(t, visit("previews", "/?preview="+page.Token), "Home page")
+	assert.Contains(t, visit("previews", "/post?preview="+page.Token), "Published words")
+}
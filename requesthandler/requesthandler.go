@@ -34,8 +34,19 @@ var (
 	ResponseInssuficientSpace = SimpleResponse{"insufficient space", true}
 	ResponseFileTooBig        = SimpleResponse{"file too big", true}
 	ResponseDuplicate         = SimpleResponse{"duplicate", true}
+	ResponseUnavailable       = SimpleResponse{"service unavailable", true}
+	ResponseConflict          = SimpleResponse{"conflict", true}
 )
 
+// Unavailable reports that the database couldn't be reached, by setting
+// the 503 status code. Responders should return the result of this function
+// when a model function returns a storage error, so the client knows that
+// it can try the request again later.
+func Unavailable(w http.ResponseWriter) interface{} {
+	http.Error(w, "", http.StatusServiceUnavailable)
+	return ResponseUnavailable
+}
+
 // A Responder is a function which can respond directly to an HTTP
 // request.
 type Responder func(*models.User, http.ResponseWriter, *http.Request) interface{}
@@ -126,41 +137,46 @@ func routeRequest(rh RequestHandler, u *models.User, w http.ResponseWriter, r *h
 }
 
 // CheckAuthentication uses the current session and request variables to check
-// if the authentication requirements are met. It returns true if met. Might raise
-// an error if something goes wrong: but it automatically reports status 500, so
-// no need to handle.
-func CheckAuthentication(w http.ResponseWriter, r *http.Request) (bool, *models.User) {
+// if the authentication requirements are met. It returns true if met. If the
+// database couldn't be reached to check the user record, it returns the
+// storage error, and the caller should report that the service is unavailable.
+func CheckAuthentication(w http.ResponseWriter, r *http.Request) (bool, *models.User, error) {
 	// If an error occurs while loading the session, it may be because the client
 	// provided invalid information so we will just report them as an illegal login.
 	session, err := SessionStore.Get(r, "authentication")
 	if err != nil {
-		return false, nil
+		return false, nil, nil
 	}
 
 	authenticated, ok := session.Values["authenticated"].(bool)
 	if !ok {
-		return false, nil
+		return false, nil, nil
 	}
 
 	domain, ok := session.Values["domain"].(string)
 	if !ok {
-		return false, nil
+		return false, nil, nil
 	}
 
 	// It's also necessary to check that the user record in the datbaase is valid.
 	user := models.User{}
 	user.Domain = domain
 	err = models.Load(&user)
+	if models.IsStorageError(err) {
+		// We don't know whether the record exists, so we can't log
+		// them out.
+		return false, nil, err
+	}
 	if err != nil {
 		// The record doesn't exist: so they are not authenticatd. In addition to
 		// returning false, we'll also delete their invalid cookie.
 		session.Options.MaxAge = -1
 		session.Save(r, w)
 
-		return false, nil
+		return false, nil, nil
 	}
 
-	return authenticated, &user
+	return authenticated, &user, nil
 }
 
 // CreateAuthenticatedHandler takes a RequestHandler and wraps it with
@@ -168,7 +184,12 @@ func CheckAuthentication(w http.ResponseWriter, r *http.Request) (bool, *models.
 // without logging in first.
 func CreateAuthenticatedHandler(rh RequestHandler) IntermediateResponder {
 	return func(w http.ResponseWriter, r *http.Request) {
-		authenticated, user := CheckAuthentication(w, r)
+		authenticated, user, err := CheckAuthentication(w, r)
+		if err != nil {
+			log.Printf("503: couldn't check authentication for `%v`: %v", r.URL.Path, err)
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
 
 		// Check if the authentication requirements are met
 		if !authenticated || user == nil {
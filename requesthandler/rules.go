@@ -0,0 +1,94 @@
+/*
+  rules.go
+
+  Before a page or file is served, the site's rules file is checked, in
+  case it redirects the visitor somewhere else, serves a different path
+  or adds headers to the response.
+*/
+
+package requesthandler
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/colin353/markdown.ninja/models"
+)
+
+// Applies the site's rules to the request. Headers are added to the
+// response straight away. It returns true if the visitor was redirected,
+// in which case there's nothing left to do. A rewrite changes the path of
+// the request, which is then served as usual.
+func applyRules(domain string, w http.ResponseWriter, r *http.Request) bool {
+	domain, err := resolveDomain(domain)
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return true
+	}
+	if err != nil {
+		// The site doesn't exist, which will be dealt with later.
+		return false
+	}
+
+	rules := models.SiteRules{}
+	rules.Domain = domain
+	err = models.Load(&rules)
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return true
+	}
+	if err != nil {
+		// The site doesn't have any rules.
+		return false
+	}
+	redirects, headers, err := rules.Parse()
+	if err != nil {
+		log.Printf("Unable to parse the rules for `%s`: %v", domain, err)
+		return false
+	}
+
+	path := r.URL.Path
+	for _, h := range headers {
+		if !h.Match(path) {
+			continue
+		}
+		for name, values := range h.Headers {
+			for _, value := range values {
+				w.Header().Add(name, value)
+			}
+		}
+	}
+
+	for _, rule := range redirects {
+		to, ok := rule.Match(path)
+		if !ok {
+			continue
+		}
+		if rule.Status == http.StatusOK {
+			rewriteRequest(r, to)
+			return false
+		}
+		if r.URL.RawQuery != "" && !strings.Contains(to, "?") {
+			to += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, to, rule.Status)
+		return true
+	}
+	return false
+}
+
+// Changes the request so that it's for another path on the site.
+func rewriteRequest(r *http.Request, to string) {
+	u, err := url.Parse(to)
+	if err != nil {
+		return
+	}
+	r.URL.Path = u.Path
+	r.URL.RawPath = ""
+	if u.RawQuery != "" {
+		r.URL.RawQuery = u.RawQuery
+	}
+	r.RequestURI = r.URL.RequestURI()
+}
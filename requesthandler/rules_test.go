@@ -0,0 +1,36 @@
+package requesthandler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSiteRules(t *testing.T) {
+	createSite(t, "siterules", "Home page")
+	publishPost(t, "siterules", "about.md", "About me")
+	err := models.Insert(&models.SiteRules{Domain: "siterules", Text: "/old-about    /about\n" +
+		"/archive/*    /posts/:splat    302\n" +
+		"/me    /about    200\n" +
+		"/*\n" +
+		"  X-Frame-Options: DENY\n"})
+	if err != nil {
+		t.Fatalf("Failed to save rules: %v", err)
+	}
+
+	w := fetch("siterules", "siterules.localhost", "/old-about?x=1", nil)
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "/about?x=1", w.Header().Get("Location"))
+
+	w = fetch("siterules", "siterules.localhost", "/archive/2019/hello", nil)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/posts/2019/hello", w.Header().Get("Location"))
+
+	// Rewrites serve the other path without redirecting.
+	w = fetch("siterules", "siterules.localhost", "/me", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "About me")
+	assert.Equal(t, "DENY", w.Header().Get("X-Frame-Options"))
+}
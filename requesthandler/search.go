@@ -0,0 +1,96 @@
+/*
+  search.go
+
+  Users can let visitors search their site at /search?q=words. The
+  results are wrapped in the site's layout, just like any other page.
+*/
+
+package requesthandler
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/colin353/markdown.ninja/models"
+)
+
+// The template for the contents of the search page.
+const searchFile = "web/layouts/search.html"
+
+// The maximum number of results shown for a search.
+const searchResultsLength = 20
+
+// A searchResult is a page as it appears in the search results.
+type searchResult struct {
+	Title   string
+	Path    string
+	Snippet template.HTML
+}
+
+// The variables available to the search template.
+type searchPage struct {
+	Query   string
+	Results []searchResult
+}
+
+// Serves the search page for the site, if the user has allowed it.
+// Otherwise, /search is just an ordinary page.
+func renderSearch(domain string, w http.ResponseWriter, r *http.Request) {
+	internalDomain, err := resolveDomain(domain)
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return
+	}
+	user := models.User{}
+	user.Domain = internalDomain
+	err = models.Load(&user)
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return
+	}
+	if err != nil || !user.PublicSearch {
+		renderPage(domain, w, r)
+		return
+	}
+
+	s := searchPage{Query: r.URL.Query().Get("q")}
+	if s.Query != "" {
+		results, err := models.Search(internalDomain, true, s.Query, searchResultsLength)
+		if err != nil {
+			unavailable(w, err)
+			return
+		}
+		for _, result := range results {
+			// The snippet is escaped by the search, apart from the
+			// highlighting.
+			s.Results = append(s.Results, searchResult{result.Title, result.Path, template.HTML(result.Snippet)})
+		}
+	}
+
+	t, err := loadLayoutFile(searchFile)
+	if err != nil {
+		log.Printf("Could not load the search template: %v", err)
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return
+	}
+	var content bytes.Buffer
+	err = t.Execute(&content, s)
+	if err != nil {
+		log.Printf("Could not render the search results for `%s`: %v", s.Query, err)
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return
+	}
+
+	// Search results shouldn't end up in search engines.
+	p := models.Page{
+		Published: true,
+		Domain:    internalDomain,
+		Name:      "search",
+		Title:     "Search",
+		NoIndex:   true,
+		HTML:      content.String(),
+	}
+	renderWithLayout(&p, http.StatusOK, w, r)
+}
@@ -0,0 +1,33 @@
+package requesthandler
+
+import (
+	"testing"
+
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublicSearch(t *testing.T) {
+	u := createSite(t, "publicsearch", "Welcome to my garden")
+	publishPost(t, "publicsearch", "roses.md", "---\ntitle: Roses\n---\nRoses grow in my <b>garden</b>.")
+
+	// Search is off unless the user turns it on.
+	w := fetch("publicsearch", "publicsearch.localhost", "/search?q=garden", nil)
+	assert.Equal(t, 404, w.Code)
+
+	u.PublicSearch = true
+	err := models.Save(u)
+	assert.Nil(t, err)
+	w = fetch("publicsearch", "publicsearch.localhost", "/search?q=garden", nil)
+	assert.Equal(t, 200, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, `<input type="search" name="q" value="garden">`)
+	assert.Contains(t, body, `<a href="/roses">Roses</a>`)
+	assert.Contains(t, body, "Roses grow in my <mark>garden</mark>.")
+	assert.Contains(t, body, "Welcome to my <mark>garden</mark>")
+	assert.Contains(t, body, `<meta name="robots" content="noindex">`)
+
+	body = fetch("publicsearch", "publicsearch.localhost", "/search?q=%3Cscript%3E+tulips", nil).Body.String()
+	assert.Contains(t, body, "Nothing matched your search.")
+	assert.Contains(t, body, `value="&lt;script&gt; tulips"`)
+}
@@ -0,0 +1,132 @@
+/*
+  sitemap.go
+
+  Every site has a sitemap.xml and a robots.txt, so that search engines
+  can find its pages. Pages can ask not to be indexed with noindex in
+  their front matter, and users can write their own robots.txt.
+*/
+
+package requesthandler
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/colin353/markdown.ninja/models"
+)
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Location     string `xml:"loc"`
+	LastModified string `xml:"lastmod,omitempty"`
+}
+
+// Serves the sitemap, which lists every published page that search
+// engines are allowed to index. The page shown for missing URLs is left
+// out, since it isn't really part of the site.
+func renderSitemap(domain string, w http.ResponseWriter, r *http.Request) {
+	domain, err := resolveDomain(domain)
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, "404: that thing doesn't exist!", http.StatusNotFound)
+		return
+	}
+
+	user := models.User{}
+	user.Domain = domain
+	err = models.Load(&user)
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return
+	}
+
+	pages, err := models.PublishedPages(domain)
+	if err != nil {
+		unavailable(w, err)
+		return
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i].Name < pages[j].Name
+	})
+
+	site := siteURL(r)
+	sitemap := sitemapURLSet{URLs: []sitemapURL{}}
+	hasPosts, hasPostsIndex := false, false
+	var postsUpdated time.Time
+	for _, p := range pages {
+		if p.IsPost() {
+			hasPosts = true
+			if t := pageUpdated(p); t.After(postsUpdated) {
+				postsUpdated = t
+			}
+		}
+		hasPostsIndex = hasPostsIndex || p.Name == models.PostsFolder+"/index.md"
+		if p.NoIndex || p.Draft || p.Name == user.NotFoundPageName() {
+			continue
+		}
+		u := sitemapURL{Location: site + models.PageURLPath(p.Name)}
+		if t := pageUpdated(p); !t.IsZero() {
+			u.LastModified = t.Format(time.RFC3339)
+		}
+		sitemap.URLs = append(sitemap.URLs, u)
+	}
+
+	// The listing of blog posts is generated, so it isn't a page. It
+	// changes whenever one of the posts does.
+	if hasPosts && !hasPostsIndex {
+		sitemap.URLs = append(sitemap.URLs, sitemapURL{
+			Location:     site + listingPagePath(0, 1),
+			LastModified: postsUpdated.Format(time.RFC3339),
+		})
+	}
+
+	output, err := xml.MarshalIndent(sitemap, "", "  ")
+	if err != nil {
+		log.Printf("Unable to generate sitemap for `%s`: %v", domain, err)
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(output)
+}
+
+// Serves the robots.txt for the site. Unless the user has written their
+// own, it allows everything and points to the sitemap.
+func renderRobots(domain string, w http.ResponseWriter, r *http.Request) {
+	domain, err := resolveDomain(domain)
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, "404: that thing doesn't exist!", http.StatusNotFound)
+		return
+	}
+
+	user := models.User{}
+	user.Domain = domain
+	err = models.Load(&user)
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if user.Robots != "" {
+		w.Write([]byte(user.Robots))
+		return
+	}
+	fmt.Fprintf(w, "User-agent: *\nAllow: /\n\nSitemap: %s/sitemap.xml\n", siteURL(r))
+}
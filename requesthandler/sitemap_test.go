@@ -0,0 +1,53 @@
+package requesthandler
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSitemap(t *testing.T) {
+	createSite(t, "sitemap", "Home page")
+	publishPost(t, "sitemap", "about.md", "About")
+	publishPost(t, "sitemap", "private.md", "---\nnoindex: true\n---\nPrivate")
+	publishPost(t, "sitemap", "posts/hello.md", "---\ndate: 2026-04-01\n---\nHello")
+	models.Insert(&models.Page{Domain: "sitemap", Name: "unpublished.md"})
+
+	w := fetch("sitemap", "sitemap.localhost", "/sitemap.xml", nil)
+	assert.Equal(t, 200, w.Code)
+	sitemap := sitemapURLSet{}
+	err := xml.Unmarshal(w.Body.Bytes(), &sitemap)
+	assert.Nil(t, err)
+
+	locations := []string{}
+	for _, u := range sitemap.URLs {
+		locations = append(locations, u.Location)
+		assert.NotEmpty(t, u.LastModified)
+	}
+	assert.Equal(t, []string{
+		"http://sitemap.localhost/about",
+		"http://sitemap.localhost/",
+		"http://sitemap.localhost/posts/hello",
+		"http://sitemap.localhost/posts/",
+	}, locations)
+
+	// Pages which shouldn't be indexed say so themselves, too.
+	assert.Contains(t, visit("sitemap", "/private"), `<meta name="robots" content="noindex">`)
+	assert.NotContains(t, visit("sitemap", "/about"), `name="robots"`)
+}
+
+func TestRobots(t *testing.T) {
+	u := createSite(t, "robots", "Home page")
+
+	w := fetch("robots", "robots.localhost", "/robots.txt", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "User-agent: *\nAllow: /\n\nSitemap: http://robots.localhost/sitemap.xml\n", w.Body.String())
+
+	u.Robots = "User-agent: *\nDisallow: /\n"
+	err := models.Save(u)
+	assert.Nil(t, err)
+	w = fetch("robots", "robots.localhost", "/robots.txt", nil)
+	assert.Equal(t, "User-agent: *\nDisallow: /\n", w.Body.String())
+}
@@ -7,13 +7,14 @@
 package requesthandler
 
 import (
-	"fmt"
-	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"path/filepath"
 	"strings"
 
 	"github.com/colin353/markdown.ninja/models"
+	"github.com/colin353/markdown.ninja/render"
 )
 
 // SubdomainHandler determines whether to serve subdomain content or not. If
@@ -78,26 +79,49 @@ func getSubdomainFromHost(host string, hostnames []string) string {
 // for everything else. This function checks the request string and figure out
 // whether we should be responding with a page or a file, and calls the appropriate
 // function.
+//
+// Each site also has feeds at /feed.xml and /atom.xml, a sitemap.xml
+// and robots.txt for search engines, and possibly a search page. The
+// site's rules can redirect or rewrite any of these paths first, and
+// visitors with a preview link see the drafts of pages. Owners arrive
+// with a link from the editor, which signs them in to the site.
 func renderSubdomain(domain string, w http.ResponseWriter, r *http.Request) {
-	if len(r.RequestURI) < 7 || r.RequestURI[0:7] != "/files/" {
-		renderPage(domain, w, r)
+	if signInOwner(domain, w, r) || applyRules(domain, w, r) {
+		return
+	}
+
+	if r.URL.Path == "/search" {
+		renderSearch(domain, w, r)
+	} else if r.URL.Path == "/sitemap.xml" {
+		renderSitemap(domain, w, r)
+	} else if r.URL.Path == "/robots.txt" {
+		renderRobots(domain, w, r)
+	} else if r.URL.Path == "/feed.xml" {
+		renderFeed(domain, rssDocument, "application/rss+xml; charset=utf-8", w, r)
+	} else if r.URL.Path == "/atom.xml" {
+		renderFeed(domain, atomDocument, "application/atom+xml; charset=utf-8", w, r)
+	} else if len(r.RequestURI) < 7 || r.RequestURI[0:7] != "/files/" {
+		if !renderPreview(domain, w, r) {
+			renderPage(domain, w, r)
+		}
 	} else {
 		renderFile(domain, w, r)
 	}
 }
 
+// Visitors only ever see the published copy of a page, never the draft,
+// and only if they're allowed to see it.
 func renderPage(domain string, w http.ResponseWriter, r *http.Request) {
 	p := models.Page{}
+	p.Published = true
 	p.Domain = domain
 	log.Printf("Request URI: %s", r.RequestURI)
 
-	if r.RequestURI == "/" || r.RequestURI == "/index.md" {
-		p.Name = "index.md"
-	} else {
-		p.Name = r.RequestURI[1:]
+	err := loadPageAtPath(&p, r.URL.Path)
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return
 	}
-
-	err := models.Load(&p)
 	if err != nil {
 		// Okay, it didn't exist as a subdomain. But it might exist as
 		// an external domain. Let's check there first.
@@ -107,52 +131,158 @@ func renderPage(domain string, w http.ResponseWriter, r *http.Request) {
 		d := models.Domain{}
 		d.ExternalDomain = domain
 		err = models.Load(&d)
+		if models.IsStorageError(err) {
+			unavailable(w, err)
+			return
+		}
 		if err != nil {
+			if renderListing(domain, w, r) || renderRedirect(domain, w, r) {
+				return
+			}
 			log.Printf("Didn't find anything at key: `%v`", p.Key())
-			http.Error(w, "404: that thing doesn't exist!", http.StatusNotFound)
+			renderNotFound(domain, w, r)
 			return
 		}
 
 		p.Domain = d.InternalDomain
 		domain = d.InternalDomain
-		err = models.Load(&p)
+		err = loadPageAtPath(&p, r.URL.Path)
+		if models.IsStorageError(err) {
+			unavailable(w, err)
+			return
+		}
 		if err != nil {
+			if renderListing(domain, w, r) || renderRedirect(domain, w, r) {
+				return
+			}
 			log.Printf("Didn't find anything at key: `%v`", p.Key())
-			http.Error(w, "404: that thing doesn't exist!", http.StatusNotFound)
+			renderNotFound(domain, w, r)
 			return
 		}
 	}
 
+	if !checkPageAccess(&p, w, r) {
+		return
+	}
+
+	// Pages are sanitized when they're saved, but they're sanitized
+	// again here, in case they were saved before the sanitizer existed
+	// or the policy has become stricter since.
+	p.HTML = render.Sanitize(p.HTML)
+	renderWithLayout(&p, http.StatusOK, w, r)
+}
+
+// Wraps the page in the user's layout and serves it with the status. The
+// page's HTML must already be safe to show.
+func renderWithLayout(p *models.Page, status int, w http.ResponseWriter, r *http.Request) {
 	user := models.User{}
-	user.Domain = domain
-	models.Load(&user)
+	user.Domain = p.Domain
+	err := models.Load(&user)
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return
+	}
 
-	defaultStyle, err := ioutil.ReadFile(fmt.Sprintf("web/css/webstyles/%s.css", user.Style))
+	css, err := loadStyleCSS(styleName(&user))
 	if err != nil {
-		log.Println("Could not open required style file: web/css/webstyles/default.css")
+		log.Printf("Could not open the stylesheets for style `%s`: %v", user.Style, err)
 		http.Error(w, "Internal error.", http.StatusInternalServerError)
 		return
 	}
 
-	requiredStyle, err := ioutil.ReadFile("web/css/webstyles/required.css")
+	layouts, err := pageLayouts(p, &user)
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return
+	}
 	if err != nil {
-		log.Println("Could not open required style file: web/css/webstyles/required.css")
+		log.Printf("Could not load a layout for `%s`: %v", p.Key(), err)
 		http.Error(w, "Internal error.", http.StatusInternalServerError)
 		return
 	}
 
-	w.Write([]byte(fmt.Sprintf(`
-			<head>
-	    <meta name="viewport" content="width=550, user-scalable=0">
-      <style>
-        %s
-        %s
-      </style>
-			</head>
-      <div class='md_container'>
-        <div class='content'>%s</div>
-      </div>
-    `, defaultStyle, requiredStyle, p.HTML)))
+	menu, err := siteMenu(p)
+	if err != nil {
+		unavailable(w, err)
+		return
+	}
+
+	page, err := executeLayouts(layouts, newLayoutData(p, &user, r.Host, css, menu))
+	if err != nil {
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(page)
+}
+
+// Pages can be nested in folders, so the path /blog/hello could be
+// served by a page called blog/hello, blog/hello.md or blog/hello/index.md,
+// in that order of preference. The root of the site is index.md.
+func loadPageAtPath(p *models.Page, path string) error {
+	path = strings.Trim(path, "/")
+	candidates := []string{"index.md"}
+	if path != "" {
+		candidates = []string{path, path + ".md", path + "/index.md"}
+	}
+
+	var err error
+	for _, name := range candidates {
+		p.Name = name
+		err = models.Load(p)
+		if err == nil || models.IsStorageError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// Sends the visitor on to the new URL of something which was renamed, if
+// that's what they asked for. It returns false if there's nowhere to send
+// them, so the caller can serve a 404 instead.
+func renderRedirect(domain string, w http.ResponseWriter, r *http.Request) bool {
+	redirect, err := models.FindRedirect(domain, r.URL.Path)
+	if err != nil {
+		unavailable(w, err)
+		return true
+	}
+	if redirect == nil {
+		return false
+	}
+
+	to := redirect.To
+	if r.URL.RawQuery != "" {
+		to += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, to, http.StatusMovedPermanently)
+	return true
+}
+
+// Finds the internal domain of the site being visited, which might be
+// one of our subdomains, or an external domain belonging to a user.
+func resolveDomain(domain string) (string, error) {
+	u := models.User{}
+	u.Domain = domain
+	err := models.Load(&u)
+	if err == nil || models.IsStorageError(err) {
+		return domain, err
+	}
+
+	d := models.Domain{}
+	d.ExternalDomain = domain
+	err = models.Load(&d)
+	if err != nil {
+		return "", err
+	}
+	return d.InternalDomain, nil
+}
+
+// If the database is down, we'll tell the visitor to try again later,
+// rather than claiming that the page doesn't exist.
+func unavailable(w http.ResponseWriter, err error) {
+	log.Printf("Unable to reach the database: %v", err)
+	http.Error(w, "503: please try again in a moment.", http.StatusServiceUnavailable)
 }
 
 func renderFile(domain string, w http.ResponseWriter, r *http.Request) {
@@ -160,15 +290,25 @@ func renderFile(domain string, w http.ResponseWriter, r *http.Request) {
 	f.Domain = domain
 	f.Name = r.RequestURI[7:]
 	err := models.Load(&f)
-
+	if models.IsStorageError(err) {
+		unavailable(w, err)
+		return
+	}
 	if err != nil {
 
 		d := models.Domain{}
 		d.ExternalDomain = domain
 		err = models.Load(&d)
+		if models.IsStorageError(err) {
+			unavailable(w, err)
+			return
+		}
 		if err != nil {
+			if renderRedirect(domain, w, r) {
+				return
+			}
 			log.Printf("Didn't find anything at key: `%v`", f.Key())
-			http.Error(w, "404: that thing doesn't exist!", http.StatusNotFound)
+			renderNotFound(domain, w, r)
 			return
 		}
 
@@ -176,12 +316,30 @@ func renderFile(domain string, w http.ResponseWriter, r *http.Request) {
 		domain = d.InternalDomain
 
 		err = models.Load(&f)
+		if models.IsStorageError(err) {
+			unavailable(w, err)
+			return
+		}
 		if err != nil {
+			if renderRedirect(domain, w, r) {
+				return
+			}
 			log.Printf("Didn't find anything at key: `%v`", f.Key())
-			http.Error(w, "404: that thing doesn't exist!", http.StatusNotFound)
+			renderNotFound(domain, w, r)
 			return
 		}
 	}
 
+	if !checkFileAccess(&f, w, r) {
+		return
+	}
+
+	// The contents are stored under their hash, which doesn't have an
+	// extension to guess the type from, but it makes a good ETag.
+	contentType := mime.TypeByExtension(filepath.Ext(f.Name))
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("ETag", `"`+f.Hash+`"`)
 	http.ServeFile(w, r, f.GetPath())
 }
@@ -0,0 +1,51 @@
+package requesthandler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenamedPageRedirects(t *testing.T) {
+	createSite(t, "redirects", "Home page")
+	publishPost(t, "redirects", "old.md", "Moving soon")
+
+	p := &models.Page{Domain: "redirects", Name: "old.md"}
+	err := models.Load(p)
+	if err == nil {
+		err = p.RenamePage("new.md")
+	}
+	if err != nil {
+		t.Fatalf("Failed to rename page: %v", err)
+	}
+
+	w := fetch("redirects", "redirects.localhost", "/old?ref=feed", nil)
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "/new?ref=feed", w.Header().Get("Location"))
+
+	assert.Contains(t, visit("redirects", "/new"), "Moving soon")
+	assert.Equal(t, http.StatusNotFound, fetch("redirects", "redirects.localhost", "/missing", nil).Code)
+}
+
+func TestServeFileFromBlob(t *testing.T) {
+	createSite(t, "blobfiles", "Home page")
+	f := &models.File{Domain: "blobfiles", Name: "style.css"}
+	err := models.SaveFile(f, []byte("body { color: red; }"), 100)
+	if err != nil {
+		t.Fatalf("Failed to save file: %v", err)
+	}
+	defer models.DeleteFile(f)
+
+	// The contents are stored under their hash, but the type still comes
+	// from the file's name.
+	w := fetch("blobfiles", "blobfiles.localhost", "/files/style.css", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "body { color: red; }", w.Body.String())
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/css")
+	assert.Equal(t, `"`+f.Hash+`"`, w.Header().Get("ETag"))
+
+	w = fetch("blobfiles", "blobfiles.localhost", "/files/style.css", map[string]string{"If-None-Match": `"` + f.Hash + `"`})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+}
@@ -0,0 +1,167 @@
+/*
+  revisions.go
+
+  Routes for browsing the revision history of a page, and for restoring
+  an old revision. They're part of the edit handler.
+*/
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/colin353/markdown.ninja/requesthandler"
+)
+
+// Return the list of revisions of a page, newest first.
+func pageRevisions(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type revisionsArgs struct {
+		Name string `json:"name"`
+	}
+	args := revisionsArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	rev := models.PageRevision{}
+	rev.Domain = u.Domain
+	rev.PageName = args.Name
+	iterator, err := models.GetList(&rev)
+	if err != nil {
+		log.Printf("Tried to load revisions under `%s`, but it failed.", rev.RegistrationKey())
+		return requesthandler.Unavailable(w)
+	}
+
+	type revisionSummary struct {
+		revision int
+		export   map[string]interface{}
+	}
+	summaries := make([]revisionSummary, 0, iterator.Count())
+	for iterator.Next() {
+		value := iterator.Value().(*models.PageRevision)
+		summaries = append(summaries, revisionSummary{value.Revision, value.Export()})
+	}
+	if iterator.Err() != nil {
+		return requesthandler.Unavailable(w)
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].revision > summaries[j].revision
+	})
+	revisionList := make([]map[string]interface{}, 0, len(summaries))
+	for _, summary := range summaries {
+		revisionList = append(revisionList, summary.export)
+	}
+	return revisionList
+}
+
+// Loads a revision of one of the user's pages, writing an error
+// response if it can't be found.
+func loadRevision(u *models.User, name string, revision int, w http.ResponseWriter) (*models.PageRevision, interface{}) {
+	rev := &models.PageRevision{}
+	rev.Domain = u.Domain
+	rev.PageName = name
+	rev.Revision = revision
+	err := models.Load(rev)
+	if models.IsStorageError(err) {
+		return nil, requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		http.Error(w, "", http.StatusNotFound)
+		return nil, requesthandler.ResponseError
+	}
+	return rev, nil
+}
+
+// Return a unified diff between two revisions of a page.
+func diffRevisions(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type diffArgs struct {
+		Name string `json:"name"`
+		From int    `json:"from"`
+		To   int    `json:"to"`
+	}
+	args := diffArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	from, response := loadRevision(u, args.Name, args.From, w)
+	if from == nil {
+		return response
+	}
+	to, response := loadRevision(u, args.Name, args.To, w)
+	if to == nil {
+		return response
+	}
+
+	diff, err := from.Diff(to)
+	if err != nil {
+		log.Printf("Failed to diff revisions of `%s`: %v", args.Name, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return requesthandler.ResponseError
+	}
+
+	type diffResponse struct {
+		Diff string `json:"diff"`
+	}
+	return diffResponse{diff}
+}
+
+// Restore an old revision of a page. The restored copy is saved as a new
+// revision, so the restore can itself be undone.
+func restoreRevision(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type restoreArgs struct {
+		Name             string `json:"name"`
+		Revision         int    `json:"revision"`
+		ExpectedRevision *int   `json:"expected_revision"`
+	}
+	args := restoreArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	rev, response := loadRevision(u, args.Name, args.Revision, w)
+	if rev == nil {
+		return response
+	}
+
+	p := models.Page{}
+	p.Domain = u.Domain
+	p.Name = args.Name
+	err = models.Load(&p)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		http.Error(w, "", http.StatusNotFound)
+		return requesthandler.ResponseError
+	}
+
+	if args.ExpectedRevision != nil {
+		p.Revision = *args.ExpectedRevision
+	}
+	p.Markdown = rev.Markdown
+	p.EditedBy = u.Name
+	err = models.Save(&p)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if models.IsRevisionConflict(err) {
+		return pageConflict(&p, w)
+	}
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	return editResponse{SimpleResponse: requesthandler.ResponseOK, Revision: p.Revision, Page: p.Export()}
+}
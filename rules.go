@@ -0,0 +1,76 @@
+/*
+  rules.go
+
+  Routes for editing a user's rules file, which redirects, rewrites and
+  adds headers to the URLs of their site. They're part of the edit
+  handler.
+*/
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/colin353/markdown.ninja/models"
+	"github.com/colin353/markdown.ninja/requesthandler"
+)
+
+// Return the user's rules file. If they haven't written one, it's empty.
+func getRules(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	s := models.SiteRules{}
+	s.Domain = u.Domain
+	err := models.Load(&s)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	return s.Export()
+}
+
+// Replace the user's rules file. The rules must all make sense, or none
+// of them are saved.
+func setRules(u *models.User, w http.ResponseWriter, r *http.Request) interface{} {
+	type rulesArgs struct {
+		Text string `json:"text"`
+	}
+	args := rulesArgs{}
+	err := requesthandler.ParseArguments(r, &args)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	s := models.SiteRules{}
+	s.Domain = u.Domain
+	err = models.Load(&s)
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	exists := err == nil
+
+	// Let the user know which line is wrong, so they can fix it.
+	type rulesResponse struct {
+		requesthandler.SimpleResponse
+		Message string `json:"message,omitempty"`
+	}
+	s.Text = args.Text
+	_, _, err = s.Parse()
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return rulesResponse{requesthandler.ResponseInvalidArgs, err.Error()}
+	}
+
+	if exists {
+		err = models.Save(&s)
+	} else {
+		err = models.Insert(&s)
+	}
+	if models.IsStorageError(err) {
+		return requesthandler.Unavailable(w)
+	}
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return requesthandler.ResponseInvalidArgs
+	}
+
+	return rulesResponse{SimpleResponse: requesthandler.ResponseOK}
+}